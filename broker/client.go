@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/codechimp-io/keti/codec"
 	"github.com/codechimp-io/keti/log"
 
 	"github.com/nats-io/go-nats"
@@ -33,7 +34,7 @@ func NewClient(o *nats.Options) (*nats.Conn, error) {
 			log.Info("NATS Client Reconnected")
 		},
 		AsyncErrorCB: func(conn *nats.Conn, sub *nats.Subscription, err error) {
-			log.Errorf("NATS async error for %s: %s", sub, err)
+			log.Errorf("NATS async error for %v: %s", sub, err)
 		},
 	}
 
@@ -48,8 +49,15 @@ func NewClient(o *nats.Options) (*nats.Conn, error) {
 // NewEncodedClient is a blocking way to create and establish connection
 // to the NATS server. The function will only return after a timeout
 // has reached or a connection has been established. It returns
-// the connection and any timeout error encountered.
-func NewEncodedClient(o *nats.Options) (*nats.EncodedConn, error) {
+// the connection using the given codec encoding and any timeout error encountered.
+func NewEncodedClient(o *nats.Options, encoding string) (*nats.EncodedConn, error) {
+	if encoding == "" {
+		encoding = codec.JSON
+	}
+	if _, err := codec.Encoder(encoding); err != nil {
+		return nil, err
+	}
+
 	if o.Timeout == 0 {
 		o.Timeout = DefaultEstablishTimeout
 	}
@@ -82,7 +90,7 @@ func NewEncodedClient(o *nats.Options) (*nats.EncodedConn, error) {
 
 	select {
 	case conn := <-connch:
-		ec, err := nats.NewEncodedConn(conn, nats.JSON_ENCODER)
+		ec, err := nats.NewEncodedConn(conn, encoding)
 		if err != nil {
 			return nil, err
 		}
@@ -12,14 +12,16 @@ import (
 	"github.com/nats-io/go-nats"
 )
 
-// RunAndConnect starts new embedded NATS instance and returns JSON encoded connection to it.
+// RunAndConnect starts new embedded NATS instance and returns an encoded connection to it,
+// using the encoding set in config.
 func RunAndConnect(ctx context.Context, wg *sync.WaitGroup) *nats.EncodedConn {
 
 	// Configure new embed broker
-	nsq, err := NewServer(config.Options.Debug)
+	nsq, err := NewServer(config.Options.Debug, config.Options.Broker.Routes)
 	if err != nil {
 		log.Fatalf("Cannot configure new NATS Broker %s", err)
 	}
+	nsq.SlowConsumerPending = config.Options.Broker.SlowConsumerPending
 
 	wg.Add(1)
 	go nsq.Start(ctx, wg)
@@ -38,12 +40,61 @@ func RunAndConnect(ctx context.Context, wg *sync.WaitGroup) *nats.EncodedConn {
 	opts.Name = fmt.Sprintf("discord-shards-%d-%d", config.Options.Discord.ShardOffset, config.Options.Discord.ShardOffset+config.Options.Discord.ShardCount)
 	opts.Url = fmt.Sprintf("nats://%s:%v", nsq.Opts.Host, nsq.Opts.Port)
 
-	nc, err := NewEncodedClient(&opts)
+	nc, err := NewEncodedClient(&opts, config.Options.Broker.Encoding)
 	if err != nil {
 		log.Fatalf("Error connecting to local NATS server: %s", err)
 	}
 
-	log.Infof("Connected to NATS: %s", opts.Url)
+	log.Infof("Connected to NATS: %s (encoding: %s)", opts.Url, config.Options.Broker.Encoding)
 
 	return nc
 }
+
+// RunPublisher creates the publisher of the events on nc, applying the backpressure policy set in config.
+// With the disk policy, the spooled events are published in the background until ctx is done.
+func RunPublisher(ctx context.Context, wg *sync.WaitGroup, nc *nats.EncodedConn) *Publisher {
+	bc := config.Options.Broker
+
+	p := NewPublisher(nc)
+	p.Policy = bc.Backpressure
+	p.MaxPending = bc.MaxPendingBytes
+	p.BlockTimeout = bc.BlockTimeout
+
+	if p.Policy != PolicyDisk {
+		return p
+	}
+
+	spool, err := OpenSpool(bc.SpoolFile)
+	if err != nil {
+		log.Fatalf("Cannot open spool file: %s", err)
+	}
+	p.Spool = spool
+	if n := spool.Len(); n > 0 {
+		log.Infof("Publishing %d events left in %s", n, bc.SpoolFile)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.replaySpool()
+			case <-ctx.Done():
+				if n := spool.Len(); n > 0 {
+					log.Warnf("%d events left in %s, published on the next start", n, bc.SpoolFile)
+				}
+				if err := spool.Close(); err != nil {
+					log.Errorf("Cannot close spool file: %s", err)
+				}
+				return
+			}
+		}
+	}()
+
+	return p
+}
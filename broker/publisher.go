@@ -0,0 +1,224 @@
+package broker
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Backpressure policies, applied to the events that cannot be published right away
+const (
+	// Drop the event and count it
+	PolicyDrop = "drop"
+
+	// Append the event to a spool file, published in order once the broker catches up
+	PolicyDisk = "disk"
+
+	// Block the caller, the shard's event loop, until the event is published, BlockTimeout passes
+	// or the deadline set with SetDeadline
+	PolicyBlock = "block"
+)
+
+// Policies lists the backpressure policies
+var Policies = []string{PolicyDrop, PolicyDisk, PolicyBlock}
+
+// Publisher publishes events on the broker. When publishing fails, or when more than MaxPending bytes
+// wait to be written to the broker, the event is handled by the backpressure policy instead.
+type Publisher struct {
+	// One of Policies
+	Policy string
+
+	// Bytes waiting to be written to the broker above which the connection is backed up, 0 for no limit
+	MaxPending int
+
+	// Longest a publish blocks with PolicyBlock, the event is dropped after
+	BlockTimeout time.Duration
+
+	// Set with PolicyDisk
+	Spool *Spool
+
+	nc *nats.EncodedConn
+
+	// Unix nanoseconds blocking publishes give up at, 0 if unset
+	deadline int64
+
+	// Set while the connection is backed up, to log the transitions only
+	pressured int32
+}
+
+// NewPublisher creates a publisher over nc dropping the events it cannot publish.
+func NewPublisher(nc *nats.EncodedConn) *Publisher {
+	return &Publisher{
+		Policy:       PolicyDrop,
+		BlockTimeout: 30 * time.Second,
+		nc:           nc,
+	}
+}
+
+// Publish encodes v with the encoder of the connection and publishes it on subject, or applies the policy.
+// It returns an error when the event is dropped.
+func (p *Publisher) Publish(subject string, v interface{}) error {
+	data, err := p.nc.Enc.Encode(subject, v)
+	if err != nil {
+		return p.drop(subject, "encoding", err)
+	}
+
+	return p.PublishData(subject, data)
+}
+
+// PublishData publishes data as is on subject, or applies the policy. It returns an error when
+// the message is dropped.
+func (p *Publisher) PublishData(subject string, data []byte) error {
+	// Spooled events go first, to keep them in order
+	if p.Policy == PolicyDisk && p.Spool != nil && (p.Spool.Len() > 0 || p.backedUp()) {
+		return p.spool(subject, data)
+	}
+
+	if p.Policy == PolicyBlock {
+		return p.publishBlocking(subject, data)
+	}
+
+	if p.backedUp() {
+		return p.drop(subject, "pending", fmt.Errorf("More than %d bytes pending", p.MaxPending))
+	}
+
+	err := p.nc.Conn.Publish(subject, data)
+	if err == nil {
+		p.setPressured(false)
+		return nil
+	}
+	publishErrorsCounter.WithLabelValues(errorLabel(err)).Inc()
+
+	if p.Policy == PolicyDisk && p.Spool != nil && err != nats.ErrMaxPayload {
+		return p.spool(subject, data)
+	}
+
+	return p.drop(subject, errorLabel(err), err)
+}
+
+// SetDeadline makes blocking publishes give up at t at the latest, e.g. by the shutdown deadline
+// so that draining the shards does not wait for BlockTimeout.
+func (p *Publisher) SetDeadline(t time.Time) {
+	atomic.StoreInt64(&p.deadline, t.UnixNano())
+}
+
+// publishBlocking retries until the connection catches up and the event is published, BlockTimeout
+// or the deadline passes.
+func (p *Publisher) publishBlocking(subject string, data []byte) error {
+	start := time.Now()
+	defer func() {
+		blockedSecondsCounter.Add(time.Since(start).Seconds())
+	}()
+
+	var err error
+	for {
+		if !p.backedUp() {
+			if err = p.nc.Conn.Publish(subject, data); err == nil {
+				p.setPressured(false)
+				return nil
+			}
+			publishErrorsCounter.WithLabelValues(errorLabel(err)).Inc()
+			if err == nats.ErrMaxPayload || err == nats.ErrConnectionClosed {
+				return p.drop(subject, errorLabel(err), err)
+			}
+		} else {
+			err = fmt.Errorf("More than %d bytes pending", p.MaxPending)
+		}
+
+		if time.Since(start) >= p.BlockTimeout {
+			return p.drop(subject, "timeout", err)
+		}
+		if d := atomic.LoadInt64(&p.deadline); d != 0 && time.Now().UnixNano() >= d {
+			return p.drop(subject, "deadline", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (p *Publisher) spool(subject string, data []byte) error {
+	p.setPressured(true)
+
+	if err := p.Spool.Append(subject, data); err != nil {
+		log.Errorf("Cannot spool event on %s: %s", subject, err)
+		return p.drop(subject, "spool", err)
+	}
+	spooledGauge.Set(float64(p.Spool.Len()))
+
+	return nil
+}
+
+func (p *Publisher) drop(subject, reason string, err error) error {
+	droppedCounter.WithLabelValues(reason).Inc()
+	if err == nats.ErrMaxPayload {
+		// Not a matter of pressure, the event is too large for the broker
+		log.Errorf("Dropped event on %s: %s", subject, err)
+	} else {
+		p.setPressured(true)
+	}
+
+	return fmt.Errorf("Dropped event on %s: %s", subject, err)
+}
+
+// backedUp reports whether more than MaxPending bytes wait to be written.
+func (p *Publisher) backedUp() bool {
+	n, err := p.nc.Conn.Buffered()
+	if err != nil {
+		// Publishing tells what is wrong
+		return false
+	}
+	pendingBytesGauge.Set(float64(n))
+
+	return p.MaxPending > 0 && n > p.MaxPending
+}
+
+func (p *Publisher) setPressured(pressured bool) {
+	if pressured {
+		if atomic.CompareAndSwapInt32(&p.pressured, 0, 1) {
+			log.Warnf("Broker connection backed up, applying the %s backpressure policy", p.Policy)
+		}
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&p.pressured, 1, 0) {
+		log.Info("Broker connection caught up")
+	}
+}
+
+// replaySpool publishes the spooled events while the connection keeps up, it returns once the spool is
+// empty or publishing fails.
+func (p *Publisher) replaySpool() {
+	for p.Spool.Len() > 0 && p.nc.Conn.IsConnected() && !p.backedUp() {
+		n, err := p.Spool.Replay(p.nc.Conn.Publish, 1000)
+		spooledGauge.Set(float64(p.Spool.Len()))
+		if err != nil {
+			publishErrorsCounter.WithLabelValues(errorLabel(err)).Inc()
+			return
+		}
+		if n == 0 {
+			return
+		}
+	}
+	if p.Spool.Len() == 0 {
+		p.setPressured(false)
+	}
+}
+
+// errorLabel names a publish error for the metrics
+func errorLabel(err error) string {
+	switch err {
+	case nats.ErrMaxPayload:
+		return "max_payload"
+	case nats.ErrReconnectBufExceeded:
+		return "reconnect_buffer"
+	case nats.ErrConnectionClosed:
+		return "closed"
+	case nats.ErrSlowConsumer:
+		return "slow_consumer"
+	default:
+		return "error"
+	}
+}
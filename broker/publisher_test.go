@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codechimp-io/keti/codec"
+
+	"github.com/nats-io/go-nats"
+)
+
+// startServer runs an embedded broker until the test ends and connects to it.
+func startServer(t *testing.T) (*Server, *nats.EncodedConn) {
+	t.Helper()
+
+	srv, err := NewServer(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random client port, without the monitoring and cluster listeners
+	srv.Opts.Host = "127.0.0.1"
+	srv.Opts.Port = 0
+	srv.Opts.HTTPPort = 0
+	srv.Opts.Cluster.Port = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go srv.Start(ctx, wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	if !srv.Server.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Broker not ready")
+	}
+
+	nc, err := NewEncodedClient(&nats.Options{
+		Url:     fmt.Sprintf("nats://%s", srv.Server.Addr()),
+		Timeout: 5 * time.Second,
+	}, codec.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	return srv, nc
+}
+
+// backUp stops the broker, the client buffers the events published after until it reconnects.
+func backUp(t *testing.T, srv *Server, nc *nats.EncodedConn) {
+	t.Helper()
+
+	srv.Server.Shutdown()
+	for deadline := time.Now().Add(5 * time.Second); nc.Conn.IsConnected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Still connected to the broker")
+		}
+	}
+}
+
+func TestPublisherBlockTimeout(t *testing.T) {
+	srv, nc := startServer(t)
+
+	p := NewPublisher(nc)
+	p.Policy = PolicyBlock
+	p.MaxPending = 1
+	p.BlockTimeout = 200 * time.Millisecond
+
+	backUp(t, srv, nc)
+	if err := p.Publish("gateway:exchange", "1"); err != nil {
+		t.Fatalf("First event not buffered: %s", err)
+	}
+
+	start := time.Now()
+	err := p.Publish("gateway:exchange", "2")
+	took := time.Since(start)
+	if err == nil {
+		t.Fatal("Event published while backed up")
+	}
+	if took < p.BlockTimeout || took > 2*time.Second {
+		t.Errorf("Blocked for %s with a %s timeout", took, p.BlockTimeout)
+	}
+}
+
+func TestPublisherDeadline(t *testing.T) {
+	srv, nc := startServer(t)
+
+	p := NewPublisher(nc)
+	p.Policy = PolicyBlock
+	p.MaxPending = 1
+	p.BlockTimeout = time.Minute
+
+	backUp(t, srv, nc)
+	if err := p.Publish("gateway:exchange", "1"); err != nil {
+		t.Fatalf("First event not buffered: %s", err)
+	}
+
+	// The deadline cuts the block timeout short, e.g. on shutdown
+	start := time.Now()
+	p.SetDeadline(start.Add(200 * time.Millisecond))
+	if err := p.Publish("gateway:exchange", "2"); err == nil {
+		t.Fatal("Event published while backed up")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("Blocked for %s with a deadline in 200ms", took)
+	}
+}
+
+func TestPublisherSpoolOrder(t *testing.T) {
+	_, nc := startServer(t)
+
+	received := make(chan string, 10)
+	if _, err := nc.Subscribe("gateway:exchange", func(s string) {
+		received <- s
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := OpenSpool(filepath.Join(t.TempDir(), "keti.spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+
+	p := NewPublisher(nc)
+	p.Policy = PolicyDisk
+	p.Spool = spool
+
+	// Left by a backed up connection, the next events wait behind it
+	if err := spool.Append("gateway:exchange", []byte(`"1"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish("gateway:exchange", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PublishData("gateway:exchange", []byte(`"3"`)); err != nil {
+		t.Fatal(err)
+	}
+	if spool.Len() != 3 {
+		t.Fatalf("%d events spooled, want 3", spool.Len())
+	}
+
+	p.replaySpool()
+	if spool.Len() != 0 {
+		t.Fatalf("%d events left in the spool", spool.Len())
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("Received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Event %q not received", want)
+		}
+	}
+
+	// Published right away once the spool is empty
+	if err := p.Publish("gateway:exchange", "4"); err != nil || spool.Len() != 0 {
+		t.Fatalf("Published with %v, %d events spooled", err, spool.Len())
+	}
+}
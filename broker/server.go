@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -19,11 +20,19 @@ type Server struct {
 	Server *gnatsd.Server
 	Opts   *gnatsd.Options
 
+	// Bytes pending to a client above which it is reported as a slow consumer, 0 to only report the
+	// ones cut off by the broker
+	SlowConsumerPending int
+
 	started bool
+
+	// Slow consumers cut off by the broker at the last stats update
+	slowConsumers int64
 }
 
-// New creates a new instance of the Server struct with a fully configured NATS embedded server
-func NewServer(debug bool) (s *Server, err error) {
+// New creates a new instance of the Server struct with a fully configured NATS embedded server,
+// routes are the nats-route:// URLs of the other brokers of the cluster
+func NewServer(debug bool, routes []string) (s *Server, err error) {
 	s = &Server{
 		Opts:    &gnatsd.Options{},
 		started: false,
@@ -44,7 +53,7 @@ func NewServer(debug bool) (s *Server, err error) {
 	s.Opts.HTTPPort = gnatsd.DEFAULT_HTTP_PORT
 
 	// Configure cluster options
-	err = s.configureCluster()
+	err = s.configureCluster(routes)
 	if err != nil {
 		return s, fmt.Errorf("Could not configure NATS Cluster: %s", err)
 	}
@@ -57,28 +66,23 @@ func NewServer(debug bool) (s *Server, err error) {
 	return
 }
 
-func (s *Server) configureCluster() (err error) {
+func (s *Server) configureCluster(routes []string) (err error) {
 	s.Opts.Cluster.Host = gnatsd.DEFAULT_HOST
 	s.Opts.Cluster.NoAdvertise = true
 	s.Opts.Cluster.Port = gnatsd.DEFAULT_PORT + 1000
 	s.Opts.Cluster.Username = "clusterino"
 	s.Opts.Cluster.Password = "s3cret"
-	/*
-		peers, err := config.GetPeers()
+
+	for _, r := range routes {
+		u, err := url.Parse(r)
 		if err != nil {
-			return fmt.Errorf("Could not determine network broker peers: %s", err)
+			return fmt.Errorf("Could not parse broker route %q: %s", r, err)
 		}
 
-		for _, p := range peers {
-			u, err := p.URL()
-			if err != nil {
-				return fmt.Errorf("Could not parse Peer configuration: %s", err)
-			}
+		log.Infof("Adding %s as network peer", u.Host)
+		s.Opts.Routes = append(s.Opts.Routes, u)
+	}
 
-			log.Infof("Adding %s as network peer", u.String())
-			s.opts.Routes = append(s.opts.Routes, u)
-		}
-	*/
 	// Remove any host/ip that points to itself in Route
 	newroutes, err := gnatsd.RemoveSelfReference(s.Opts.Cluster.Port, s.Opts.Routes)
 	if err != nil {
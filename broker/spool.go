@@ -0,0 +1,183 @@
+package broker
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Size of the header of the spool file, the offset of the next record to publish
+const spoolOffsetSize = 8
+
+// Size of the header of a spool record, the subject and data lengths
+const spoolHeaderSize = 6
+
+// Spool is a file of encoded events waiting to be published, in order. It survives restarts,
+// the events left in it are published by the next run. The offset of the next event to publish
+// is kept at the start of the file, so that a restart does not publish the events before it again.
+type Spool struct {
+	sync.Mutex
+
+	f *os.File
+
+	// Offset of the next record to publish, end of the last record, and records in between
+	offset int64
+	end    int64
+	count  int
+}
+
+// OpenSpool opens the spool file at path, creating it if needed. A record cut short by a crash is discarded.
+func OpenSpool(path string) (*Spool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &Spool{f: f, offset: spoolOffsetSize}
+	var header [spoolOffsetSize]byte
+	if _, err := f.ReadAt(header[:], 0); err == nil {
+		s.offset = int64(binary.BigEndian.Uint64(header[:]))
+	}
+	if s.offset < spoolOffsetSize || s.offset > fi.Size() {
+		// New file, or cut short while being emptied
+		s.offset = spoolOffsetSize
+	}
+
+	s.end = s.offset
+	for {
+		_, _, n, err := s.read(s.end)
+		if err != nil {
+			break
+		}
+		s.end += n
+		s.count++
+	}
+	if s.count == 0 {
+		s.offset, s.end = spoolOffsetSize, spoolOffsetSize
+	}
+	if err := f.Truncate(s.end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := s.writeOffset(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Append adds an event at the end of the spool.
+func (s *Spool) Append(subject string, data []byte) error {
+	if len(subject) > 1<<16-1 {
+		return errors.New("Subject too long to be spooled")
+	}
+
+	rec := make([]byte, spoolHeaderSize+len(subject)+len(data))
+	binary.BigEndian.PutUint16(rec, uint16(len(subject)))
+	binary.BigEndian.PutUint32(rec[2:], uint32(len(data)))
+	copy(rec[spoolHeaderSize:], subject)
+	copy(rec[spoolHeaderSize+len(subject):], data)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, err := s.f.WriteAt(rec, s.end); err != nil {
+		return err
+	}
+	s.end += int64(len(rec))
+	s.count++
+
+	return nil
+}
+
+// Len returns the number of events in the spool.
+func (s *Spool) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.count
+}
+
+// Replay publishes up to max events in order, stopping at the first publish error. The offset
+// is saved after every event, and the file is emptied once every event is published.
+// It returns the number of events published.
+func (s *Spool) Replay(publish func(subject string, data []byte) error, max int) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	n := 0
+	for n < max && s.count > 0 {
+		subject, data, size, err := s.read(s.offset)
+		if err != nil {
+			return n, err
+		}
+		if err := publish(subject, data); err != nil {
+			return n, err
+		}
+		s.offset += size
+		s.count--
+		n++
+
+		if err := s.writeOffset(); err != nil {
+			return n, err
+		}
+	}
+
+	if s.count == 0 && s.end > spoolOffsetSize {
+		// Truncated first, an offset past the end of the file is taken as an empty spool
+		s.offset, s.end = spoolOffsetSize, spoolOffsetSize
+		if err := s.f.Truncate(s.end); err != nil {
+			return n, err
+		}
+		if err := s.writeOffset(); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Close closes the spool file, the events left in it are kept.
+func (s *Spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.f.Close()
+}
+
+// writeOffset saves the offset of the next record to publish.
+func (s *Spool) writeOffset() error {
+	var header [spoolOffsetSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(s.offset))
+	_, err := s.f.WriteAt(header[:], 0)
+
+	return err
+}
+
+// read returns the record at offset and its size.
+func (s *Spool) read(offset int64) (string, []byte, int64, error) {
+	var header [spoolHeaderSize]byte
+	if _, err := s.f.ReadAt(header[:], offset); err != nil {
+		return "", nil, 0, err
+	}
+	subjectLen := int64(binary.BigEndian.Uint16(header[:]))
+	dataLen := int64(binary.BigEndian.Uint32(header[2:]))
+
+	rec := make([]byte, subjectLen+dataLen)
+	if _, err := s.f.ReadAt(rec, offset+spoolHeaderSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, 0, err
+	}
+
+	return string(rec[:subjectLen]), rec[subjectLen:], spoolHeaderSize + subjectLen + dataLen, nil
+}
@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// record collects the events replayed as subject=data.
+type record []string
+
+func (r *record) publish(subject string, data []byte) error {
+	*r = append(*r, subject+"="+string(data))
+	return nil
+}
+
+func openSpool(t *testing.T, path string) *Spool {
+	t.Helper()
+
+	s, err := OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func appendEvents(t *testing.T, s *Spool, events ...string) {
+	t.Helper()
+
+	for _, e := range events {
+		if err := s.Append("gateway:exchange", []byte(e)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSpoolOrder(t *testing.T) {
+	s := openSpool(t, filepath.Join(t.TempDir(), "keti.spool"))
+	appendEvents(t, s, "1", "2", "3")
+
+	var got record
+	if n, err := s.Replay(got.publish, 2); n != 2 || err != nil {
+		t.Fatalf("Replayed %d events: %v", n, err)
+	}
+	appendEvents(t, s, "4")
+	if n, err := s.Replay(got.publish, 10); n != 2 || err != nil {
+		t.Fatalf("Replayed %d events: %v", n, err)
+	}
+
+	want := record{"gateway:exchange=1", "gateway:exchange=2", "gateway:exchange=3", "gateway:exchange=4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Replayed %v, want %v", got, want)
+	}
+	if s.Len() != 0 {
+		t.Errorf("%d events left", s.Len())
+	}
+}
+
+func TestSpoolPublishError(t *testing.T) {
+	s := openSpool(t, filepath.Join(t.TempDir(), "keti.spool"))
+	appendEvents(t, s, "1", "2")
+
+	failed := errors.New("Disconnected")
+	n, err := s.Replay(func(string, []byte) error { return failed }, 10)
+	if n != 0 || err != failed {
+		t.Fatalf("Replayed %d events: %v, want the publish error", n, err)
+	}
+
+	// Nothing is lost, the failed event is published first
+	var got record
+	s.Replay(got.publish, 10)
+	if want := (record{"gateway:exchange=1", "gateway:exchange=2"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replayed %v, want %v", got, want)
+	}
+}
+
+func TestSpoolTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keti.spool")
+	s, err := OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, s, "1", "2")
+	s.Close()
+
+	// A crash while appending the third event, after its header
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 16, 0, 0, 0, 1, 'g', 'a', 't'})
+	f.Close()
+
+	s = openSpool(t, path)
+	if s.Len() != 2 {
+		t.Fatalf("%d events after a crash, want 2", s.Len())
+	}
+
+	// Appended after the last complete record
+	appendEvents(t, s, "3")
+	var got record
+	s.Replay(got.publish, 10)
+	want := record{"gateway:exchange=1", "gateway:exchange=2", "gateway:exchange=3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Replayed %v, want %v", got, want)
+	}
+}
+
+func TestSpoolRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keti.spool")
+	crashed := openSpool(t, path)
+	appendEvents(t, crashed, "1", "2", "3")
+
+	// Stopped in the middle of a replay, without closing the spool
+	var got record
+	crashed.Replay(got.publish, 2)
+
+	s := openSpool(t, path)
+	if s.Len() != 1 {
+		t.Fatalf("%d events after a restart, want the one left", s.Len())
+	}
+	s.Replay(got.publish, 10)
+	want := record{"gateway:exchange=1", "gateway:exchange=2", "gateway:exchange=3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Replayed %v, want every event once %v", got, want)
+	}
+
+	// Emptied once every event is published
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != spoolOffsetSize {
+		t.Errorf("Spool of %d bytes once replayed, want only its header", fi.Size())
+	}
+	s = openSpool(t, path)
+	if s.Len() != 0 {
+		t.Errorf("%d events after replaying them all", s.Len())
+	}
+}
@@ -3,6 +3,8 @@ package broker
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/codechimp-io/keti/log"
@@ -62,6 +64,36 @@ var (
 		Name: "gnatsd_network_subscriptions",
 		Help: "Number of active subscriptions to subjects on this broker",
 	}, []string{"identity"})
+
+	clientPendingGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gnatsd_client_pending_bytes",
+		Help: "Bytes waiting to be written to the clients with the most pending, by client name",
+	}, []string{"name"})
+
+	publishErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_broker_publish_errors_total",
+		Help: "Events which failed to be published on the broker, by error",
+	}, []string{"error"})
+
+	droppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_broker_dropped_events_total",
+		Help: "Events dropped instead of being published on the broker, by reason",
+	}, []string{"reason"})
+
+	pendingBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "keti_broker_pending_bytes",
+		Help: "Bytes published by keti waiting to be written to the broker",
+	})
+
+	spooledGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "keti_broker_spooled_events",
+		Help: "Events waiting in the spool file to be published on the broker",
+	})
+
+	blockedSecondsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keti_broker_blocked_seconds_total",
+		Help: "Time the shards spent blocked publishing events on the broker",
+	})
 )
 
 func init() {
@@ -75,6 +107,12 @@ func init() {
 	prometheus.MustRegister(outBytesGauge)
 	prometheus.MustRegister(slowConsumerGauge)
 	prometheus.MustRegister(subscriptionsGauge)
+	prometheus.MustRegister(clientPendingGauge)
+	prometheus.MustRegister(publishErrorsCounter)
+	prometheus.MustRegister(droppedCounter)
+	prometheus.MustRegister(pendingBytesGauge)
+	prometheus.MustRegister(spooledGauge)
+	prometheus.MustRegister(blockedSecondsCounter)
 }
 
 func (s *Server) scrapeVarz() (*gnatsd.Varz, error) {
@@ -119,4 +157,39 @@ func (s *Server) updatePrometheus() {
 	outBytesGauge.WithLabelValues(i).Set(float64(varz.OutBytes))
 	slowConsumerGauge.WithLabelValues(i).Set(float64(varz.SlowConsumers))
 	subscriptionsGauge.WithLabelValues(i).Set(float64(varz.Subscriptions))
+
+	s.reportSlowConsumers(varz.SlowConsumers)
+}
+
+// reportSlowConsumers updates the pending bytes of the clients with the most pending, and names the ones
+// above SlowConsumerPending, or all of them when the broker has cut off new slow consumers.
+func (s *Server) reportSlowConsumers(slowConsumers int64) {
+	cut := slowConsumers > s.slowConsumers
+	s.slowConsumers = slowConsumers
+
+	connz, err := s.Server.Connz(&gnatsd.ConnzOptions{Sort: gnatsd.ByPending, Subscriptions: true, Limit: 10})
+	if err != nil {
+		log.Errorf("Could not update stats from NATS /connz: %s", err)
+		return
+	}
+
+	clientPendingGauge.Reset()
+	for _, c := range connz.Conns {
+		if c.Pending == 0 {
+			break
+		}
+
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("%s:%d", c.IP, c.Port)
+		}
+		clientPendingGauge.WithLabelValues(name).Set(float64(c.Pending))
+
+		if cut || (s.SlowConsumerPending > 0 && c.Pending >= s.SlowConsumerPending) {
+			log.Warnf("Slow consumer %s (cid %d): %d bytes pending, subscribed to %s", name, c.Cid, c.Pending, strings.Join(c.Subs, ", "))
+		}
+	}
+	if cut {
+		log.Warnf("Broker cut off %d slow consumers since start", slowConsumers)
+	}
 }
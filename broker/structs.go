@@ -1,12 +1,7 @@
 package broker
 
-import "time"
+import "github.com/codechimp-io/keti/codec"
 
-// GatewayEvent holds data for an event sent from the gateway
-type GatewayEvent struct {
-	Shard  int
-	UserID interface{}
-	Data   interface{}
-	// When this event occured
-	Time time.Time
-}
+// GatewayEvent holds data for an event sent from the gateway,
+// it lives in the codec package so consumers don't have to import the broker.
+type GatewayEvent = codec.GatewayEvent
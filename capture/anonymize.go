@@ -0,0 +1,132 @@
+package capture
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+
+	"github.com/codechimp-io/keti/codec"
+)
+
+// Redacted replaces the values of the sensitive fields of anonymized payloads
+const Redacted = "[redacted]"
+
+// Payload fields whose string values are redacted, at any depth. Besides user details this covers
+// free text: names of guilds, channels, roles and commands, embeds, and component or option values.
+var sensitiveFields = map[string]bool{
+	"content":       true,
+	"username":      true,
+	"global_name":   true,
+	"display_name":  true,
+	"discriminator": true,
+	"nick":          true,
+	"email":         true,
+	"phone":         true,
+	"avatar":        true,
+	"banner":        true,
+	"bio":           true,
+	"name":          true,
+	"title":         true,
+	"description":   true,
+	"topic":         true,
+	"text":          true,
+	"value":         true,
+	"label":         true,
+	"placeholder":   true,
+	"custom_id":     true,
+	"token":         true,
+	"ip":            true,
+	"url":           true,
+	"proxy_url":     true,
+	"filename":      true,
+}
+
+// Anonymizer rewrites captured payloads so they can be shared. Snowflakes are replaced
+// consistently within the capture, keeping their timestamp so events still route to the
+// same shards, and the values of sensitive fields such as content or username are redacted.
+type Anonymizer struct {
+	key []byte
+}
+
+// NewAnonymizer creates an anonymizer with a random key, the replaced IDs cannot be mapped back.
+func NewAnonymizer() *Anonymizer {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	return &Anonymizer{key: key}
+}
+
+// Event returns a copy of e with its IDs replaced and its payload anonymized.
+func (a *Anonymizer) Event(e *codec.GatewayEvent) (*codec.GatewayEvent, error) {
+	data, err := a.Payload(e.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := *e
+	c.BotID = a.ID(e.BotID)
+	c.GuildID = a.ID(e.GuildID)
+	c.Data = data
+
+	return &c, nil
+}
+
+// Payload anonymizes a JSON dispatch payload.
+func (a *Anonymizer) Payload(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(a.value("", v))
+}
+
+func (a *Anonymizer) value(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = a.value(k, e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = a.value(key, e)
+		}
+	case string:
+		if sensitiveFields[key] && v != "" {
+			return Redacted
+		}
+		return a.ID(v)
+	}
+
+	return v
+}
+
+// ID replaces a snowflake, other strings are returned as is.
+func (a *Anonymizer) ID(s string) string {
+	if len(s) < 15 || len(s) > 20 {
+		return s
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return s
+	}
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(s))
+	sum := binary.BigEndian.Uint64(mac.Sum(nil))
+
+	// Keep the timestamp, replace the worker, process and increment bits
+	const low = 1<<22 - 1
+	return strconv.FormatUint(id&^low|sum&low, 10)
+}
@@ -0,0 +1,41 @@
+package capture
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizerPayload(t *testing.T) {
+	payload := `{"id":"1047566290853937192","guild_id":"41771983423143937","type":2,"token":"aW50ZXJhY3Rpb24",` +
+		`"member":{"nick":"Nell","user":{"id":"80351110224678912","username":"nelly","global_name":"Nelly",` +
+		`"display_name":"Nelly","discriminator":"1337","avatar":"8342729096ea3675442027381ff50dfe"}},` +
+		`"data":{"name":"remind","custom_id":"remind:80351110224678912","options":[{"name":"what","type":3,"value":"the dentist"}]},` +
+		`"message":{"embeds":[{"title":"Reminder","description":"Call the dentist","footer":{"text":"tomorrow"},` +
+		`"fields":[{"name":"When","value":"9am"}]}],"components":[{"type":1,"components":[{"type":2,"label":"Snooze","custom_id":"snooze"}]}]},` +
+		`"locale":"en-GB"}`
+
+	data, err := NewAnonymizer().Payload([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"Nell", "nelly", "1337", "8342729096ea", "remind", "dentist", "Reminder", "tomorrow",
+		"When", "9am", "Snooze", "snooze", "aW50ZXJhY3Rpb24", "1047566290853937192", "80351110224678912"} {
+		if strings.Contains(string(data), s) {
+			t.Errorf("%q left in %s", s, data)
+		}
+	}
+
+	var v struct {
+		Type    int    `json:"type"`
+		GuildID string `json:"guild_id"`
+		Locale  string `json:"locale"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Type != 2 || v.Locale != "en-GB" || len(v.GuildID) != len("41771983423143937") {
+		t.Errorf("Non sensitive fields changed: %+v", v)
+	}
+}
@@ -0,0 +1,146 @@
+// Package capture records gateway events to gzip compressed newline delimited JSON files,
+// and replays them onto the broker.
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/codec"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Record is a line of a capture file
+type Record struct {
+	// Time since the start of the capture
+	Offset time.Duration `json:"offset"`
+
+	Subject string              `json:"subject"`
+	Event   *codec.GatewayEvent `json:"event"`
+}
+
+// Recorder writes the events it is given to a capture
+type Recorder struct {
+	sync.Mutex
+
+	// If set, payloads are anonymized before they are written
+	Anonymizer *Anonymizer
+
+	gz    *gzip.Writer
+	buf   *bufio.Writer
+	c     io.Closer
+	enc   *json.Encoder
+	start time.Time
+	count int
+}
+
+// Create creates a capture file at path, replacing any existing one.
+func Create(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRecorder(f), nil
+}
+
+// NewRecorder creates a recorder writing to w, closed along with the recorder.
+func NewRecorder(w io.WriteCloser) *Recorder {
+	gz := gzip.NewWriter(w)
+	buf := bufio.NewWriter(gz)
+
+	return &Recorder{
+		gz:    gz,
+		buf:   buf,
+		c:     w,
+		enc:   json.NewEncoder(buf),
+		start: time.Now(),
+	}
+}
+
+// Record writes an event published on subject.
+func (r *Recorder) Record(subject string, e *codec.GatewayEvent) error {
+	if r.Anonymizer != nil {
+		var err error
+		if e, err = r.Anonymizer.Event(e); err != nil {
+			return err
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.count++
+	return r.enc.Encode(&Record{
+		Offset:  time.Since(r.start),
+		Subject: subject,
+		Event:   e,
+	})
+}
+
+// TapEvent records an event published by the manager, it implements discord.EventTap.
+func (r *Recorder) TapEvent(subject string, e *codec.GatewayEvent) {
+	if err := r.Record(subject, e); err != nil {
+		log.Errorf("Cannot record %s event: %s", e.Type, err)
+	}
+}
+
+// Subscribe records the events published on subject over nc with the given encoding.
+func (r *Recorder) Subscribe(nc *nats.Conn, subject, encoding string) (*nats.Subscription, error) {
+	if _, err := codec.Encoder(encoding); err != nil {
+		return nil, err
+	}
+
+	return nc.Subscribe(subject, func(msg *nats.Msg) {
+		var e codec.GatewayEvent
+		if err := codec.Decode(encoding, msg.Subject, msg.Data, &e); err != nil {
+			log.Errorf("Cannot decode event on %s: %s", msg.Subject, err)
+			return
+		}
+		r.TapEvent(msg.Subject, &e)
+	})
+}
+
+// Count returns the number of events recorded.
+func (r *Recorder) Count() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.count
+}
+
+// Flush writes the buffered events out, the file is readable up to them.
+func (r *Recorder) Flush() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.buf.Flush(); err != nil {
+		return err
+	}
+
+	return r.gz.Flush()
+}
+
+// Close flushes the capture and closes the underlying writer.
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.buf.Flush(); err != nil {
+		r.c.Close()
+		return err
+	}
+	if err := r.gz.Close(); err != nil {
+		r.c.Close()
+		return err
+	}
+
+	return r.c.Close()
+}
@@ -0,0 +1,54 @@
+package capture
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/log"
+)
+
+// Run starts recording the events of the manager to the capture file set in config,
+// it returns nil if none is set. The capture is closed when ctx is done.
+func Run(ctx context.Context, wg *sync.WaitGroup) *Recorder {
+	cc := config.Options.Capture
+	if cc.File == "" {
+		return nil
+	}
+
+	r, err := Create(cc.File)
+	if err != nil {
+		log.Fatalf("Cannot create capture file: %s", err)
+	}
+	if cc.Anonymize {
+		r.Anonymizer = NewAnonymizer()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Flush(); err != nil {
+					log.Errorf("Cannot write capture file: %s", err)
+				}
+			case <-ctx.Done():
+				if err := r.Close(); err != nil {
+					log.Errorf("Cannot close capture file: %s", err)
+				}
+				log.Infof("Captured %d events to %s", r.Count(), cc.File)
+				return
+			}
+		}
+	}()
+
+	log.Infof("Capturing events to %s", cc.File)
+
+	return r
+}
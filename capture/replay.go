@@ -0,0 +1,146 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/codechimp-io/keti/codec"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Largest line of a capture file, a GUILD_CREATE of a large guild can take megabytes
+const maxLineSize = 64 << 20
+
+// Reader reads the records of a capture
+type Reader struct {
+	gz      *gzip.Reader
+	scanner *bufio.Scanner
+}
+
+// NewReader reads a capture from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	return &Reader{gz: gz, scanner: scanner}, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the capture.
+func (r *Reader) Next() (*Record, error) {
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, err
+		}
+		if rec.Event == nil {
+			return nil, fmt.Errorf("Record without event")
+		}
+
+		return &rec, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// Replayer publishes captured events onto the broker
+type Replayer struct {
+	// Speed relative to the capture, 1 is real time, 0 as fast as possible
+	Speed float64
+
+	// If set, events are published on it instead of their captured subject
+	Subject string
+
+	nc       *nats.Conn
+	encoding string
+}
+
+// NewReplayer creates a replayer publishing over nc with the given encoding, in real time.
+func NewReplayer(nc *nats.Conn, encoding string) (*Replayer, error) {
+	if _, err := codec.Encoder(encoding); err != nil {
+		return nil, err
+	}
+
+	return &Replayer{Speed: 1, nc: nc, encoding: encoding}, nil
+}
+
+// ReplayFile replays the capture file at path, see Replay.
+func (p *Replayer) ReplayFile(ctx context.Context, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r, err := NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.Replay(ctx, r)
+}
+
+// Replay publishes the records of r, spaced by their offsets divided by Speed, until the end
+// of the capture or until ctx is done. It returns the number of events published.
+func (p *Replayer) Replay(ctx context.Context, r *Reader) (int, error) {
+	start := time.Now()
+	n := 0
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return n, p.nc.Flush()
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if p.Speed > 0 {
+			at := start.Add(time.Duration(float64(rec.Offset) / p.Speed))
+			if d := time.Until(at); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return n, ctx.Err()
+				case <-t.C:
+				}
+			}
+		} else if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		subject := rec.Subject
+		if p.Subject != "" {
+			subject = p.Subject
+		}
+
+		data, err := codec.Encode(p.encoding, subject, rec.Event)
+		if err != nil {
+			return n, err
+		}
+		if err := p.nc.Publish(subject, data); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
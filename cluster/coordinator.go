@@ -0,0 +1,489 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/discord"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Broker subjects used in coordinator mode
+const (
+	// Worker registrations, with capacity and running shards
+	RegisterSubject = "keti.coord.register"
+
+	// Shard assignments published by the leader
+	AssignSubject = "keti.coord.assign"
+)
+
+// IdentifyInterval is the minimum delay between two identifies of the bot
+var IdentifyInterval = 5 * time.Second
+
+type registration struct {
+	Instance string                      `json:"instance"`
+	Capacity int                         `json:"capacity"`
+	TTL      time.Duration               `json:"ttl"`
+	Shards   map[int]discord.SessionInfo `json:"shards"`
+
+	// Shard total the sessions of Shards were identified with
+	Total int `json:"total,omitempty"`
+
+	// Set when the worker shuts down
+	Leaving bool `json:"leaving,omitempty"`
+
+	expires time.Time
+}
+
+// Assignment maps every shard of the bot to a worker
+type Assignment struct {
+	Leader string `json:"leader"`
+	Epoch  int64  `json:"epoch"`
+	Total  int    `json:"total"`
+
+	// Worker of each shard, unassigned shards are missing
+	Shards map[int]string `json:"shards"`
+
+	// Earliest start of the shards that moved, spaced to respect identify limits
+	StartAt map[int]time.Time `json:"start_at,omitempty"`
+}
+
+// Coordinated are the shards of a worker, along with the shard total they are identified with
+type Coordinated interface {
+	Shards
+
+	RecommendedShards() (int, error)
+	GetShardsTotal() int
+	SetShardsTotal(total int) error
+}
+
+// Coordinator runs this instance as a worker of a cluster where the leader, the live
+// worker with the lowest name, assigns shards according to each worker capacity and
+// rebalances them when workers join or leave.
+type Coordinator struct {
+	sync.Mutex
+
+	// Unique name of this instance
+	Instance string
+
+	// Maximum number of shards this worker runs
+	Capacity int
+
+	// How long a registration lasts, and how often workers register
+	TTL      time.Duration
+	Interval time.Duration
+
+	// Total number of shards, the leader asks Discord for the recommended count when 0
+	ShardsTotal int
+
+	nc  *nats.Conn
+	mgr Coordinated
+
+	workers  map[string]*registration
+	sessions map[int]discord.SessionInfo
+	current  *Assignment
+	started  time.Time
+
+	nextIdentify time.Time
+}
+
+// NewCoordinator creates a coordinator worker publishing over nc.
+func NewCoordinator(nc *nats.Conn, instance string, capacity int) *Coordinator {
+	return &Coordinator{
+		Instance: instance,
+		Capacity: capacity,
+		TTL:      15 * time.Second,
+		Interval: 5 * time.Second,
+		nc:       nc,
+		workers:  make(map[string]*registration),
+		sessions: make(map[int]discord.SessionInfo),
+	}
+}
+
+// Listen subscribes to the coordination subjects.
+func (c *Coordinator) Listen() error {
+	if _, err := c.nc.Subscribe(RegisterSubject, c.onRegister); err != nil {
+		return err
+	}
+	if _, err := c.nc.Subscribe(AssignSubject, c.onAssign); err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.started = time.Now()
+	c.Unlock()
+
+	return nil
+}
+
+// Configure keeps the manager from starting the statically configured shards,
+// they are started once assigned.
+func (c *Coordinator) Configure(m *discord.Manager) {
+	m.ShardFilter = func(int) bool { return false }
+}
+
+// Start registers with the cluster and applies assignments in the background.
+func (c *Coordinator) Start(ctx context.Context, wg *sync.WaitGroup, m *discord.Manager) {
+	wg.Add(1)
+	go c.Run(ctx, wg, m)
+}
+
+// Run registers this worker, leads when it has the lowest name and applies the
+// current assignment, this is a blocking call until ctx is done.
+func (c *Coordinator) Run(ctx context.Context, wg *sync.WaitGroup, m Coordinated) {
+	defer wg.Done()
+
+	c.mgr = m
+
+	register := time.NewTicker(c.Interval)
+	defer register.Stop()
+	apply := time.NewTicker(time.Second)
+	defer apply.Stop()
+
+	c.register(false)
+	for {
+		select {
+		case <-register.C:
+			c.register(false)
+			c.lead()
+		case <-apply.C:
+			c.apply()
+		case <-ctx.Done():
+			waitStopped(m, c.TTL)
+			c.register(true)
+			return
+		}
+	}
+}
+
+// Assignment returns the last assignment received.
+func (c *Coordinator) Assignment() *Assignment {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.current
+}
+
+func (c *Coordinator) register(leaving bool) {
+	shards := c.mgr.RunningShards()
+	if leaving {
+		for shard, si := range c.mgr.ClosedSessions() {
+			shards[shard] = si
+		}
+	}
+
+	c.publish(RegisterSubject, &registration{
+		Instance: c.Instance,
+		Capacity: c.Capacity,
+		TTL:      c.TTL,
+		Shards:   shards,
+		Total:    c.mgr.GetShardsTotal(),
+		Leaving:  leaving,
+	})
+}
+
+func (c *Coordinator) onRegister(msg *nats.Msg) {
+	var r registration
+	if err := json.Unmarshal(msg.Data, &r); err != nil {
+		log.Errorf("Invalid worker registration: %s", err)
+		return
+	}
+
+	r.expires = time.Now().Add(r.TTL)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if r.Leaving {
+		delete(c.workers, r.Instance)
+	} else {
+		c.workers[r.Instance] = &r
+	}
+
+	// Remember the last session of every shard, the next owner resumes it.
+	// Sessions identified with another total cannot be resumed.
+	if c.current != nil && r.Total != c.current.Total {
+		return
+	}
+	for shard, si := range r.Shards {
+		if si.SessionID != "" {
+			c.sessions[shard] = si
+		}
+	}
+}
+
+func (c *Coordinator) onAssign(msg *nats.Msg) {
+	var a Assignment
+	if err := json.Unmarshal(msg.Data, &a); err != nil {
+		log.Errorf("Invalid shard assignment: %s", err)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.current != nil && c.current.Leader == a.Leader && a.Epoch <= c.current.Epoch {
+		return
+	}
+	if c.current == nil || !reflect.DeepEqual(c.current.Shards, a.Shards) {
+		log.Infof("New shard assignment from %s: %d shards for this worker", a.Leader, len(a.shardsOf(c.Instance)))
+	}
+	if c.current != nil && c.current.Total != a.Total {
+		// The sessions identified with the previous total cannot be resumed
+		c.sessions = make(map[int]discord.SessionInfo)
+	}
+
+	c.current = &a
+}
+
+// liveWorkers returns the names of the registered workers, sorted, it must be called with the lock held.
+func (c *Coordinator) liveWorkers(now time.Time) []string {
+	names := make([]string, 0, len(c.workers))
+	for name, w := range c.workers {
+		if w.expires.Before(now) {
+			log.Infof("Worker %s left the cluster", name)
+			delete(c.workers, name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// lead computes and publishes a new assignment when this worker is the leader.
+func (c *Coordinator) lead() {
+	now := time.Now()
+
+	c.Lock()
+	workers := c.liveWorkers(now)
+	if len(workers) == 0 || workers[0] != c.Instance || now.Sub(c.started) < c.TTL {
+		c.Unlock()
+		return
+	}
+
+	total := c.ShardsTotal
+	if total == 0 && c.current != nil {
+		total = c.current.Total
+	}
+	c.Unlock()
+
+	if total == 0 {
+		n, err := c.mgr.RecommendedShards()
+		if err != nil {
+			log.Errorf("Cannot get the recommended shard count: %s", err)
+			return
+		}
+		total = n
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	a := c.balance(workers, total, now)
+	if c.current != nil && c.current.Leader == c.Instance && c.current.Total == a.Total && reflect.DeepEqual(c.current.Shards, a.Shards) {
+		// Unchanged, republish so that new workers learn it
+		a = c.current
+	} else {
+		log.Infof("Assigning %d shards to %d workers", total, len(workers))
+		c.current = a
+	}
+
+	c.publish(AssignSubject, a)
+}
+
+// balance spreads the shards over the workers in proportion to their capacity,
+// keeping shards where they currently run when possible. It must be called with the lock held.
+func (c *Coordinator) balance(workers []string, total int, now time.Time) *Assignment {
+	capacity := 0
+	for _, name := range workers {
+		capacity += c.workers[name].Capacity
+	}
+
+	// Quota of each worker, remainders go to the first workers
+	quota := make(map[string]int, len(workers))
+	assigned := 0
+	for _, name := range workers {
+		q := 0
+		if capacity > 0 {
+			q = total * c.workers[name].Capacity / capacity
+		}
+		if q > c.workers[name].Capacity {
+			q = c.workers[name].Capacity
+		}
+		quota[name] = q
+		assigned += q
+	}
+	for i := 0; assigned < total && i < len(workers)*total; i++ {
+		name := workers[i%len(workers)]
+		if quota[name] < c.workers[name].Capacity {
+			quota[name]++
+			assigned++
+		}
+	}
+
+	a := &Assignment{
+		Leader:  c.Instance,
+		Epoch:   now.UnixNano(),
+		Total:   total,
+		Shards:  make(map[int]string, total),
+		StartAt: make(map[int]time.Time),
+	}
+
+	// Keep running shards in place
+	owner := make(map[int]string)
+	for _, name := range workers {
+		for shard := range c.workers[name].Shards {
+			owner[shard] = name
+		}
+	}
+	for shard := 0; shard < total; shard++ {
+		if name, ok := owner[shard]; ok && quota[name] > 0 {
+			a.Shards[shard] = name
+			quota[name]--
+		}
+	}
+
+	// Fill the remaining quotas in order, which gives ranges on a fresh cluster,
+	// and space the identifies of the moved shards
+	slot := now.Add(c.Interval)
+	w := 0
+	for shard := 0; shard < total; shard++ {
+		if _, ok := a.Shards[shard]; ok {
+			continue
+		}
+		for w < len(workers) && quota[workers[w]] == 0 {
+			w++
+		}
+		if w == len(workers) {
+			log.Warnf("Not enough worker capacity for shard %d", shard)
+			continue
+		}
+
+		a.Shards[shard] = workers[w]
+		a.StartAt[shard] = slot
+		slot = slot.Add(IdentifyInterval)
+		quota[workers[w]]--
+	}
+
+	return a
+}
+
+// apply stops the shards assigned elsewhere and starts, one at a time,
+// the shards assigned to this worker once their previous owner released them.
+func (c *Coordinator) apply() {
+	c.Lock()
+	a := c.current
+	c.Unlock()
+
+	if a == nil {
+		return
+	}
+
+	running := c.mgr.RunningShards()
+	for shard := range running {
+		if a.Shards[shard] != c.Instance {
+			log.Infof("Shard %d moved to %s, stopping it", shard, a.Shards[shard])
+			if err := c.mgr.StopShard(shard); err != nil {
+				log.Errorf("Error closing shard %d: %s", shard, err)
+			}
+		}
+	}
+
+	now := time.Now()
+	if now.Before(c.nextIdentify) {
+		return
+	}
+
+	if total := c.mgr.GetShardsTotal(); total != a.Total && len(running) > 0 {
+		// Sessions are bound to the shard total, the shards kept by this worker identify again
+		log.Infof("Shard total changed from %d to %d, stopping the %d running shards", total, a.Total, len(running))
+		for shard := range running {
+			if err := c.mgr.StopShard(shard); err != nil {
+				log.Errorf("Error closing shard %d: %s", shard, err)
+			}
+		}
+		running = nil
+	}
+	if err := c.mgr.SetShardsTotal(a.Total); err != nil {
+		log.Errorf("Cannot apply shard assignment: %s", err)
+		return
+	}
+
+	for _, shard := range a.shardsOf(c.Instance) {
+		if _, ok := running[shard]; ok {
+			continue
+		}
+		if now.Before(a.StartAt[shard]) {
+			continue
+		}
+
+		c.Lock()
+		busy := c.runningElsewhere(shard, now)
+		resume, ok := c.sessions[shard]
+		c.Unlock()
+		if busy {
+			continue
+		}
+
+		var si *discord.SessionInfo
+		if ok {
+			si = &resume
+		}
+
+		log.Infof("Starting assigned shard %d (resume: %t)", shard, si != nil)
+		if err := c.mgr.StartShard(shard, si); err != nil {
+			log.Errorf("Cannot start assigned shard %d: %s", shard, err)
+		}
+
+		c.nextIdentify = now.Add(IdentifyInterval)
+		c.register(false)
+		return
+	}
+}
+
+// runningElsewhere reports whether another live worker still runs the shard, it must be called with the lock held.
+func (c *Coordinator) runningElsewhere(shard int, now time.Time) bool {
+	for name, w := range c.workers {
+		if name == c.Instance || w.expires.Before(now) {
+			continue
+		}
+		if _, ok := w.Shards[shard]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Coordinator) publish(subject string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Cannot encode %s message: %s", subject, err)
+		return
+	}
+
+	if err := c.nc.Publish(subject, data); err != nil {
+		log.Errorf("Cannot publish on %s: %s", subject, err)
+	}
+}
+
+// shardsOf returns the shards assigned to the worker, in order.
+func (a *Assignment) shardsOf(instance string) []int {
+	var shards []int
+	for shard, name := range a.Shards {
+		if name == instance {
+			shards = append(shards, shard)
+		}
+	}
+	sort.Ints(shards)
+
+	return shards
+}
@@ -0,0 +1,181 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codechimp-io/keti/discord"
+
+	"github.com/nats-io/go-nats"
+)
+
+// fakeShards stands in for the manager of a worker
+type fakeShards struct {
+	sync.Mutex
+
+	total   int
+	running map[int]discord.SessionInfo
+	started []int
+	resumed map[int]discord.SessionInfo
+	stopped []int
+}
+
+func newFakeShards(total int, running ...int) *fakeShards {
+	f := &fakeShards{
+		total:   total,
+		running: make(map[int]discord.SessionInfo),
+		resumed: make(map[int]discord.SessionInfo),
+	}
+	for _, shard := range running {
+		f.running[shard] = discord.SessionInfo{SessionID: fmt.Sprintf("session-%d", shard), Sequence: 42}
+	}
+
+	return f
+}
+
+func (f *fakeShards) RunningShards() map[int]discord.SessionInfo {
+	f.Lock()
+	defer f.Unlock()
+
+	running := make(map[int]discord.SessionInfo, len(f.running))
+	for shard, si := range f.running {
+		running[shard] = si
+	}
+
+	return running
+}
+
+func (f *fakeShards) StartShard(shard int, resume *discord.SessionInfo) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.running[shard] = discord.SessionInfo{}
+	f.started = append(f.started, shard)
+	if resume != nil {
+		f.resumed[shard] = *resume
+	}
+
+	return nil
+}
+
+func (f *fakeShards) StopShard(shard int) error {
+	f.Lock()
+	defer f.Unlock()
+
+	delete(f.running, shard)
+	f.stopped = append(f.stopped, shard)
+
+	return nil
+}
+
+func (f *fakeShards) Stopped() <-chan struct{}                    { return nil }
+func (f *fakeShards) ClosedSessions() map[int]discord.SessionInfo { return nil }
+func (f *fakeShards) RecommendedShards() (int, error)             { return 4, nil }
+
+func (f *fakeShards) GetShardsTotal() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.total
+}
+
+// SetShardsTotal fails with running shards like the manager does
+func (f *fakeShards) SetShardsTotal(total int) error {
+	f.Lock()
+	defer f.Unlock()
+
+	if total != f.total && len(f.running) > 0 {
+		return fmt.Errorf("Cannot change the shard total from %d to %d with running shards", f.total, total)
+	}
+	f.total = total
+
+	return nil
+}
+
+func TestBalance(t *testing.T) {
+	c := NewCoordinator(nil, "a", 10)
+	now := time.Now()
+	c.workers["a"] = &registration{Instance: "a", Capacity: 10, expires: now.Add(time.Hour)}
+	c.workers["b"] = &registration{Instance: "b", Capacity: 10, expires: now.Add(time.Hour)}
+	c.workers["c"] = &registration{Instance: "c", Capacity: 5, expires: now.Add(time.Hour), Shards: map[int]discord.SessionInfo{0: {}}}
+
+	a := c.balance(c.liveWorkers(now), 12, now)
+	count := make(map[string]int)
+	for _, name := range a.Shards {
+		count[name]++
+	}
+	if want := map[string]int{"a": 5, "b": 5, "c": 2}; !reflect.DeepEqual(count, want) {
+		t.Errorf("Shards by worker %v, want %v", count, want)
+	}
+	if a.Shards[0] != "c" {
+		t.Errorf("Shard 0 moved from c to %s", a.Shards[0])
+	}
+	if _, ok := a.StartAt[0]; ok {
+		t.Error("Shard 0 did not move but has a start time")
+	}
+
+	// Beyond the capacity of the cluster
+	if a := c.balance(c.liveWorkers(now), 40, now); len(a.Shards) != 25 {
+		t.Errorf("%d shards assigned, want the 25 of the capacity", len(a.Shards))
+	}
+}
+
+// TestApplyTotalChange checks a worker running shards identified with another total restarts them,
+// instead of failing to apply the assignment.
+func TestApplyTotalChange(t *testing.T) {
+	f := newFakeShards(2, 0, 1)
+	c := NewCoordinator(nil, "a", 10)
+	c.mgr = f
+	c.sessions[0] = f.running[0]
+	c.onAssign(assignMsg(&Assignment{Leader: "a", Epoch: 1, Total: 2, Shards: map[int]string{0: "a", 1: "a"}}))
+	c.onAssign(assignMsg(&Assignment{Leader: "a", Epoch: 2, Total: 4, Shards: map[int]string{0: "a", 1: "a", 2: "a", 3: "b"}}))
+
+	c.apply()
+	sort.Ints(f.stopped)
+	if !reflect.DeepEqual(f.stopped, []int{0, 1}) {
+		t.Errorf("Stopped %v, want [0 1]", f.stopped)
+	}
+	if f.total != 4 {
+		t.Errorf("Shard total %d, want 4", f.total)
+	}
+
+	// One identify per interval
+	for i := 0; i < 3; i++ {
+		c.nextIdentify = time.Time{}
+		c.apply()
+	}
+	if !reflect.DeepEqual(f.started, []int{0, 1, 2}) {
+		t.Errorf("Started %v, want [0 1 2]", f.started)
+	}
+	if len(f.resumed) > 0 {
+		t.Errorf("Resumed sessions of the previous total: %v", f.resumed)
+	}
+}
+
+func TestRegisterTotal(t *testing.T) {
+	c := NewCoordinator(nil, "a", 10)
+	c.onAssign(assignMsg(&Assignment{Leader: "a", Epoch: 1, Total: 4, Shards: map[int]string{0: "b"}}))
+
+	for _, r := range []registration{
+		{Instance: "b", Capacity: 10, TTL: time.Minute, Total: 2, Shards: map[int]discord.SessionInfo{1: {SessionID: "old"}}},
+		{Instance: "c", Capacity: 10, TTL: time.Minute, Total: 4, Shards: map[int]discord.SessionInfo{0: {SessionID: "new"}}},
+	} {
+		data, _ := json.Marshal(&r)
+		c.onRegister(&nats.Msg{Subject: RegisterSubject, Data: data})
+	}
+
+	if want := map[int]discord.SessionInfo{0: {SessionID: "new"}}; !reflect.DeepEqual(c.sessions, want) {
+		t.Errorf("Sessions %v, want %v", c.sessions, want)
+	}
+}
+
+func assignMsg(a *Assignment) *nats.Msg {
+	data, _ := json.Marshal(a)
+
+	return &nats.Msg{Subject: AssignSubject, Data: data}
+}
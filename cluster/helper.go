@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/discord"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Member is the way an instance takes part in the cluster, either a Leaser or a Coordinator
+type Member interface {
+	// Configure is applied to the manager before its shards are started
+	Configure(m *discord.Manager)
+
+	// Start runs the membership in the background until ctx is done
+	Start(ctx context.Context, wg *sync.WaitGroup, m *discord.Manager)
+}
+
+// Join starts listening to the cluster subjects and returns the membership,
+// or nil if clustering is disabled. In lease mode it blocks for one lease TTL.
+func Join(nc *nats.Conn) Member {
+	cc := config.Options.Cluster
+	if !cc.Enabled {
+		return nil
+	}
+
+	instance := cc.Instance
+	if instance == "" {
+		host, _ := os.Hostname()
+		instance = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	if cc.Coordinator {
+		c := NewCoordinator(nc, instance, cc.Capacity)
+		c.TTL = cc.LeaseTTL
+		c.Interval = cc.Heartbeat
+		c.ShardsTotal = config.Options.Discord.ShardTotal
+
+		log.Infof("Joining cluster as worker %s with capacity %d", instance, c.Capacity)
+
+		if err := c.Listen(); err != nil {
+			log.Fatalf("Cannot subscribe to shard assignments: %s", err)
+		}
+
+		return c
+	}
+
+	l := NewLeaser(nc, instance)
+	l.TTL = cc.LeaseTTL
+	l.Interval = cc.Heartbeat
+	l.Standby = cc.Standby
+	l.ShardsTotal = config.Options.Discord.ShardTotal
+
+	log.Infof("Joining cluster as %s, waiting %s for shard leases", instance, l.TTL)
+
+	if err := l.Listen(); err != nil {
+		log.Fatalf("Cannot subscribe to shard leases: %s", err)
+	}
+
+	return l
+}
+
+// Configure keeps the manager from starting shards leased by other instances.
+func (l *Leaser) Configure(m *discord.Manager) {
+	m.ShardFilter = l.Available
+}
+
+// Start heartbeats the shards of the manager and takes over orphaned ones in the background.
+func (l *Leaser) Start(ctx context.Context, wg *sync.WaitGroup, m *discord.Manager) {
+	wg.Add(1)
+	go l.Run(ctx, wg, m)
+}
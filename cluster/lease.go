@@ -0,0 +1,444 @@
+// Package cluster coordinates shard ownership between keti instances sharing a broker.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/discord"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Broker subjects used for leases
+const (
+	// Heartbeats listing the shards an instance owns, with their gateway session
+	LeaseSubject = "keti.lease.heartbeat"
+
+	// Claims for orphaned shards
+	ClaimSubject = "keti.lease.claim"
+
+	// Ownership changes, published for operators and tooling
+	AdminShardsSubject = "keti.admin.shards"
+)
+
+// Ownership change actions
+const (
+	ActionAcquired = "acquired"
+	ActionReleased = "released"
+	ActionExpired  = "expired"
+)
+
+// Shards is the part of discord.Manager driven by the Leaser
+type Shards interface {
+	RunningShards() map[int]discord.SessionInfo
+	StartShard(shard int, resume *discord.SessionInfo) error
+	StopShard(shard int) error
+
+	// Closed once the shards are closed on shutdown, with the sessions to resume them from
+	Stopped() <-chan struct{}
+	ClosedSessions() map[int]discord.SessionInfo
+}
+
+// Lease is the ownership of a shard by an instance, renewed by its heartbeats
+type Lease struct {
+	Instance string              `json:"instance"`
+	Since    time.Time           `json:"since"`
+	Session  discord.SessionInfo `json:"session"`
+
+	expires time.Time
+}
+
+// OwnershipChange is published on AdminShardsSubject when a shard changes hands
+type OwnershipChange struct {
+	Shard    int       `json:"shard"`
+	Action   string    `json:"action"`
+	Instance string    `json:"instance"`
+	Previous string    `json:"previous,omitempty"`
+	Resumed  bool      `json:"resumed,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+type heartbeat struct {
+	Instance string         `json:"instance"`
+	TTL      time.Duration  `json:"ttl"`
+	Shards   map[int]*Lease `json:"shards"`
+
+	// Set when the instance shuts down, its leases end immediately
+	Release bool `json:"release,omitempty"`
+}
+
+type claim struct {
+	Instance string `json:"instance"`
+	Shard    int    `json:"shard"`
+}
+
+// Leaser announces the shards this instance owns and, in standby mode,
+// takes over the shards whose lease expired, resuming their session when possible.
+type Leaser struct {
+	sync.Mutex
+
+	// Unique name of this instance
+	Instance string
+
+	// How long a lease lasts without heartbeat, and how often heartbeats are sent
+	TTL      time.Duration
+	Interval time.Duration
+
+	// Standby instances take over orphaned shards
+	Standby bool
+
+	// Total number of shards of the bot, shards never leased are orphans too
+	ShardsTotal int
+
+	nc     *nats.Conn
+	shards Shards
+
+	leases  map[int]*Lease
+	owned   map[int]time.Time
+	claims  map[int]map[string]struct{}
+	started time.Time
+}
+
+// NewLeaser creates a leaser publishing over nc.
+func NewLeaser(nc *nats.Conn, instance string) *Leaser {
+	return &Leaser{
+		Instance: instance,
+		TTL:      15 * time.Second,
+		Interval: 5 * time.Second,
+		nc:       nc,
+		leases:   make(map[int]*Lease),
+		owned:    make(map[int]time.Time),
+		claims:   make(map[int]map[string]struct{}),
+	}
+}
+
+// Listen subscribes to the lease subjects and waits one TTL to learn the current leases.
+func (l *Leaser) Listen() error {
+	if _, err := l.nc.Subscribe(LeaseSubject, l.onHeartbeat); err != nil {
+		return err
+	}
+	if _, err := l.nc.Subscribe(ClaimSubject, l.onClaim); err != nil {
+		return err
+	}
+
+	l.Lock()
+	l.started = time.Now()
+	l.Unlock()
+
+	time.Sleep(l.TTL)
+
+	return nil
+}
+
+// Available reports whether this instance may start the shard, standby instances
+// never start shards by themselves and nobody starts a shard someone else holds.
+func (l *Leaser) Available(shard int) bool {
+	if l.Standby {
+		return false
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if lease, ok := l.leases[shard]; ok && lease.expires.After(time.Now()) {
+		log.Infof("Shard %d is leased by %s", shard, lease.Instance)
+		return false
+	}
+
+	return true
+}
+
+// Run heartbeats the shards of the manager and takes over orphaned ones,
+// this is a blocking call until ctx is done.
+func (l *Leaser) Run(ctx context.Context, wg *sync.WaitGroup, shards Shards) {
+	defer wg.Done()
+
+	l.shards = shards
+
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+
+	for {
+		l.heartbeat(false)
+		l.resolveClaims()
+		l.claimOrphans()
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			// Released once closed, so that the instances taking over resume from the last dispatch forwarded
+			waitStopped(shards, l.TTL)
+			l.heartbeat(true)
+			return
+		}
+	}
+}
+
+// Leases returns a copy of the known leases of other instances, by shard.
+func (l *Leaser) Leases() map[int]Lease {
+	l.Lock()
+	defer l.Unlock()
+
+	leases := make(map[int]Lease, len(l.leases))
+	for shard, lease := range l.leases {
+		leases[shard] = *lease
+	}
+
+	return leases
+}
+
+func (l *Leaser) heartbeat(release bool) {
+	running := l.shards.RunningShards()
+	if release {
+		for shard, si := range l.shards.ClosedSessions() {
+			running[shard] = si
+		}
+	}
+	now := time.Now()
+
+	l.Lock()
+	hb := heartbeat{
+		Instance: l.Instance,
+		TTL:      l.TTL,
+		Shards:   make(map[int]*Lease, len(running)),
+		Release:  release,
+	}
+	for shard, si := range running {
+		since, ok := l.owned[shard]
+		if !ok {
+			since = now
+			l.owned[shard] = since
+		}
+		hb.Shards[shard] = &Lease{Instance: l.Instance, Since: since, Session: si}
+	}
+	for shard := range l.owned {
+		if _, ok := running[shard]; !ok {
+			delete(l.owned, shard)
+		}
+	}
+	l.Unlock()
+
+	l.publish(LeaseSubject, hb)
+
+	if release {
+		for shard := range running {
+			l.publish(AdminShardsSubject, &OwnershipChange{
+				Shard:    shard,
+				Action:   ActionReleased,
+				Instance: l.Instance,
+				Time:     now,
+			})
+		}
+	}
+}
+
+func (l *Leaser) onHeartbeat(msg *nats.Msg) {
+	var hb heartbeat
+	if err := json.Unmarshal(msg.Data, &hb); err != nil {
+		log.Errorf("Invalid lease heartbeat: %s", err)
+		return
+	}
+	if hb.Instance == l.Instance {
+		return
+	}
+
+	now := time.Now()
+	expires := now.Add(hb.TTL)
+	if hb.Release {
+		expires = now
+	}
+
+	var conflicts []int
+
+	l.Lock()
+	for shard, lease := range hb.Shards {
+		lease.Instance = hb.Instance
+		lease.expires = expires
+		l.leases[shard] = lease
+
+		// Two owners, the oldest lease wins
+		if since, ok := l.owned[shard]; ok && !hb.Release {
+			if lease.Since.Before(since) || (lease.Since.Equal(since) && hb.Instance < l.Instance) {
+				conflicts = append(conflicts, shard)
+			}
+		}
+	}
+	l.Unlock()
+
+	for _, shard := range conflicts {
+		log.Warnf("Shard %d is also owned by %s since earlier, releasing it", shard, hb.Instance)
+		l.release(shard)
+	}
+}
+
+func (l *Leaser) onClaim(msg *nats.Msg) {
+	var c claim
+	if err := json.Unmarshal(msg.Data, &c); err != nil {
+		log.Errorf("Invalid lease claim: %s", err)
+		return
+	}
+
+	l.Lock()
+	if _, ok := l.claims[c.Shard]; !ok {
+		l.claims[c.Shard] = make(map[string]struct{})
+	}
+	l.claims[c.Shard][c.Instance] = struct{}{}
+	l.Unlock()
+}
+
+// claimOrphans claims the shards whose lease expired, or that were never leased.
+func (l *Leaser) claimOrphans() {
+	if !l.Standby {
+		return
+	}
+
+	now := time.Now()
+	running := l.shards.RunningShards()
+
+	var orphans []int
+
+	l.Lock()
+	for shard := 0; shard < l.ShardsTotal; shard++ {
+		if _, ok := running[shard]; ok {
+			continue
+		}
+		if _, ok := l.claims[shard]; ok {
+			continue
+		}
+
+		lease, ok := l.leases[shard]
+		switch {
+		case ok && lease.expires.After(now):
+			continue
+		case !ok && now.Sub(l.started) < 2*l.TTL:
+			// Give owners a chance to announce themselves after we started
+			continue
+		}
+
+		l.claims[shard] = map[string]struct{}{l.Instance: struct{}{}}
+		orphans = append(orphans, shard)
+	}
+	l.Unlock()
+
+	for _, shard := range orphans {
+		log.Infof("Shard %d has no live lease, claiming it", shard)
+		l.publish(ClaimSubject, &claim{Instance: l.Instance, Shard: shard})
+	}
+}
+
+// resolveClaims starts the shards claimed during the previous interval when this
+// instance has the lowest name among the claimants.
+func (l *Leaser) resolveClaims() {
+	now := time.Now()
+
+	type takeover struct {
+		shard int
+		lease *Lease
+	}
+	var won []takeover
+
+	l.Lock()
+	for shard, claimants := range l.claims {
+		names := make([]string, 0, len(claimants))
+		for name := range claimants {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		lease := l.leases[shard]
+		live := lease != nil && lease.expires.After(now)
+		if names[0] == l.Instance && !live {
+			won = append(won, takeover{shard, lease})
+		}
+	}
+	l.claims = make(map[int]map[string]struct{})
+	l.Unlock()
+
+	for _, t := range won {
+		l.acquire(t.shard, t.lease)
+	}
+}
+
+func (l *Leaser) acquire(shard int, previous *Lease) {
+	var resume *discord.SessionInfo
+	change := &OwnershipChange{
+		Shard:    shard,
+		Action:   ActionAcquired,
+		Instance: l.Instance,
+	}
+	if previous != nil {
+		change.Previous = previous.Instance
+		if previous.Session.SessionID != "" {
+			resume = &previous.Session
+			change.Resumed = true
+		}
+
+		l.publish(AdminShardsSubject, &OwnershipChange{
+			Shard:    shard,
+			Action:   ActionExpired,
+			Instance: previous.Instance,
+			Time:     time.Now(),
+		})
+	}
+
+	if err := l.shards.StartShard(shard, resume); err != nil {
+		log.Errorf("Cannot take over shard %d: %s", shard, err)
+		return
+	}
+
+	l.Lock()
+	l.owned[shard] = time.Now()
+	delete(l.leases, shard)
+	l.Unlock()
+
+	log.Infof("Took over shard %d (resumed: %t)", shard, change.Resumed)
+
+	change.Time = time.Now()
+	l.publish(AdminShardsSubject, change)
+	l.heartbeat(false)
+}
+
+func (l *Leaser) release(shard int) {
+	if err := l.shards.StopShard(shard); err != nil {
+		log.Errorf("Error closing shard %d: %s", shard, err)
+	}
+
+	l.Lock()
+	delete(l.owned, shard)
+	l.Unlock()
+
+	l.publish(AdminShardsSubject, &OwnershipChange{
+		Shard:    shard,
+		Action:   ActionReleased,
+		Instance: l.Instance,
+		Time:     time.Now(),
+	})
+}
+
+func (l *Leaser) publish(subject string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Cannot encode %s message: %s", subject, err)
+		return
+	}
+
+	if err := l.nc.Publish(subject, data); err != nil {
+		log.Errorf("Cannot publish on %s: %s", subject, err)
+	}
+}
+
+// waitStopped waits for the shards to be closed on shutdown, for at most timeout.
+func waitStopped(shards Shards, timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-shards.Stopped():
+	case <-t.C:
+	}
+}
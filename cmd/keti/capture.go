@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/codechimp-io/keti/capture"
+	"github.com/codechimp-io/keti/codec"
+	"github.com/codechimp-io/keti/discord"
+)
+
+const recordUsage = `Usage: keti record [flags] <file>
+
+Records the events published on the broker to a gzip compressed newline delimited JSON file,
+until interrupted.
+`
+
+// runRecord runs the record subcommand and returns the exit code.
+func runRecord(args []string) int {
+	fs := newFlagSet("record", recordUsage)
+	url := fs.String("url", defaultURL, "broker URL")
+	subject := fs.String("subject", discord.EventsSubject, "subject to record, wildcards allowed")
+	encoding := fs.String("encoding", codec.JSON, "encoding of the events, as KETI_BROKER_ENCODING")
+	anonymize := fs.Bool("anonymize", false, "replace IDs and redact personal data in the payloads")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	nc, err := connect(*url, "record")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer nc.Close()
+
+	r, err := capture.Create(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *anonymize {
+		r.Anonymizer = capture.NewAnonymizer()
+	}
+
+	sub, err := r.Subscribe(nc, *subject, *encoding)
+	if err != nil {
+		r.Close()
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Recording %s to %s, interrupt to stop\n", *subject, fs.Arg(0))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+
+	sub.Unsubscribe()
+	nc.Flush()
+	if err := r.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Recorded %d events\n", r.Count())
+
+	return 0
+}
+
+const replayUsage = `Usage: keti replay [flags] <file>
+
+Publishes the events of a capture on the broker, spaced as they were recorded.
+`
+
+// runReplay runs the replay subcommand and returns the exit code.
+func runReplay(args []string) int {
+	fs := newFlagSet("replay", replayUsage)
+	url := fs.String("url", defaultURL, "broker URL")
+	subject := fs.String("subject", "", "publish on this subject instead of the recorded ones")
+	encoding := fs.String("encoding", codec.JSON, "encoding to publish with, as KETI_BROKER_ENCODING")
+	speed := fs.Float64("speed", 1, "speed relative to the capture, 0 to publish as fast as possible")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || *speed < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	nc, err := connect(*url, "replay")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer nc.Close()
+
+	p, err := capture.NewReplayer(nc, *encoding)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	p.Speed = *speed
+	p.Subject = *subject
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+		cancel()
+	}()
+
+	n, err := p.ReplayFile(ctx, fs.Arg(0))
+	fmt.Fprintf(os.Stderr, "Replayed %d events\n", n)
+	if err != nil && err != context.Canceled {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nats-io/go-nats"
+)
+
+// URL of the broker of a keti instance running on this host
+const defaultURL = "nats://127.0.0.1:4222"
+
+// newFlagSet creates the flags of a subcommand, printing usage and the flags on -h.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet("keti "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+// connect opens a connection to the broker for a subcommand.
+func connect(url, name string) (*nats.Conn, error) {
+	nc, err := nats.Connect(url, nats.Name("keti "+name))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to %s: %s", url, err)
+	}
+
+	return nc, nil
+}
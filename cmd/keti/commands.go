@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/codechimp-io/keti/commands"
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/discord"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const commandsUsage = `Usage: keti commands sync [-dry-run] <file>
+
+Syncs the application commands registered on Discord with a YAML or JSON definition file.
+`
+
+// runCommands runs the commands subcommand and returns the exit code.
+func runCommands(args []string) int {
+	if len(args) == 0 || args[0] != "sync" {
+		fmt.Fprint(os.Stderr, commandsUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("keti commands sync", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, commandsUsage)
+		fs.PrintDefaults()
+	}
+	dryRun := fs.Bool("dry-run", false, "print the planned changes without applying them")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := commands.Load(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	s, err := discordgo.New(config.Options.Discord.BotToken())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	discord.ConfiguredEndpoints().Apply(s)
+
+	changes, err := commands.Sync(s, f, *dryRun)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(changes) == 0 {
+		fmt.Println("Commands already in sync")
+	}
+
+	return 0
+}
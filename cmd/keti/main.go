@@ -3,14 +3,29 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/codechimp-io/keti/broker"
+	"github.com/codechimp-io/keti/capture"
+	"github.com/codechimp-io/keti/cluster"
+	"github.com/codechimp-io/keti/commands"
+	"github.com/codechimp-io/keti/config"
 	"github.com/codechimp-io/keti/discord"
+	"github.com/codechimp-io/keti/interactions"
 	"github.com/codechimp-io/keti/log"
+	"github.com/codechimp-io/keti/metrics"
+	"github.com/codechimp-io/keti/proxy"
+	"github.com/codechimp-io/keti/ratelimit"
+	"github.com/codechimp-io/keti/resp"
+	"github.com/codechimp-io/keti/state"
 	"github.com/codechimp-io/keti/version"
 )
 
@@ -21,37 +36,185 @@ var (
 	err    error
 )
 
+const usage = `Usage: keti [command] [flags]
+
+Commands:
+  run        connect the shards and forward their events, the default
+  version    print the version
+  status     query the running instances
+  shards     compute shard layouts, see keti shards calc -h
+  tap        print the events published on the broker
+  record     record the events published on the broker to a file
+  replay     publish recorded events on the broker
+  commands   sync application commands, see keti commands -h
+
+Run keti <command> -h for the flags of a command.
+`
+
 func main() {
-	// Set producer name in logs
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "run":
+		run(args)
+	case "version":
+		fmt.Println(version.Print())
+	case "status":
+		os.Exit(runStatus(args))
+	case "shards":
+		os.Exit(runShards(args))
+	case "tap":
+		os.Exit(runTap(args))
+	case "record":
+		os.Exit(runRecord(args))
+	case "replay":
+		os.Exit(runReplay(args))
+	case "commands":
+		loadConfig(config.Load())
+		os.Exit(runCommands(args))
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+// run starts keti with the command line flags in args.
+func run(args []string) {
+	loadConfig(config.LoadArgs(args))
+	started := time.Now()
+
+	// Set producer name and level in logs
 	log.WithCaller(version.Name)
+	log.SetDebug(config.Options.Debug)
 	// Init sync.WaitGroup and Context
 	wg = &sync.WaitGroup{}
 	ctx, cancel = context.WithCancel(context.Background())
 	defer cancel()
 
 	log.Infof("Starting %s", version.Info())
+	for _, src := range config.Options.SortedSources() {
+		log.Debugf("Config: %s", src)
+	}
+
+	// Serve Prometheus metrics
+	metricsServer := metrics.Run(ctx, wg, config.Options.Metrics.Addr)
+
+	// Run the embeded broker and obtain connection, the broker is stopped last by shutdown
+	brokerCtx, stopBroker := context.WithCancel(context.Background())
+	brokerWg := &sync.WaitGroup{}
+	nc := broker.RunAndConnect(brokerCtx, brokerWg)
+	// Apply the backpressure policy to the published events, the spool is closed with the broker
+	publisher := broker.RunPublisher(brokerCtx, brokerWg, nc)
+
+	// Join the other instances sharing the broker
+	member := cluster.Join(nc.Conn)
+
+	var opts []func(*discord.Manager)
+	if member != nil {
+		opts = append(opts, member.Configure)
+	}
+
+	// Build the state caches from the forwarded dispatches
+	var sinks []discord.StateSink
+	if cache := state.Run(ctx, nc.Conn); cache != nil {
+		sinks = append(sinks, cache)
+	}
+	if sink := resp.Run(ctx, wg); sink != nil {
+		sinks = append(sinks, sink)
+	}
+	// Acknowledge interactions before forwarding them
+	deferrer, endpoint := interactions.Run(ctx, wg, publisher)
+	// Share the REST rate limits with the other instances and clients
+	limiter := ratelimit.Run(ctx, nc.Conn)
+	// Serve the REST API to the services speaking HTTP
+	proxy.Run(ctx, wg, limiter)
+	// Record the published events
+	recorder := capture.Run(ctx, wg)
+
+	opts = append(opts, func(m *discord.Manager) {
+		m.Publisher = publisher
+		m.StateSinks = sinks
+		// Gateway interactions are only parsed when there are rules to apply
+		if len(deferrer.Rules()) > 0 {
+			m.Interactions = deferrer
+		}
+		if recorder != nil {
+			m.Taps = append(m.Taps, recorder)
+		}
+		if limiter != nil {
+			m.Client = &http.Client{Timeout: 20 * time.Second, Transport: &ratelimit.Transport{Limiter: limiter}}
+		}
+	})
 
-	// Run the embeded broker and obtain connection
-	nc := broker.RunAndConnect(ctx, wg)
+	// Register the declared application commands
+	commands.Run()
 
 	// Run discord manager
-	discord.Run(ctx, wg, nc)
+	mgr := discord.Run(ctx, wg, nc, opts...)
+	if member != nil {
+		member.Start(ctx, wg, mgr)
+	}
+
+	// Apply config changes on SIGHUP and admin requests
+	r := &reloader{
+		args:     args,
+		mgr:      mgr,
+		deferrer: deferrer,
+		endpoint: endpoint,
+		limiter:  limiter,
+		metrics:  metricsServer,
+	}
+	if err := r.serve(nc.Conn); err != nil {
+		log.Errorf("Cannot subscribe to %s: %s", reloadSubject, err)
+	}
+	// Answer keti status
+	if err := serveStatus(nc.Conn, mgr, started); err != nil {
+		log.Errorf("Cannot subscribe to %s: %s", statusSubject, err)
+	}
 
 	// Spawn OS Signal watcher
-	signalWatcher()
+	signalWatcher(r)
+
+	// Wait for all processes to finish, then stop the broker
+	shutdown(nc, stopBroker, brokerWg)
+}
+
+// loadConfig sets the loaded config in use, or exits reporting every problem.
+func loadConfig(cfg config.Config, err error) {
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if errs, ok := err.(config.Errors); ok {
+		fmt.Fprintf(os.Stderr, "Invalid configuration, %d problems:\n", len(errs))
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "  - %s\n", e)
+		}
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %s\n", err)
+		os.Exit(2)
+	}
 
-	// Wait for all processes to finish
-	wg.Wait()
+	config.Options = cfg
 }
 
-func signalWatcher() {
+func signalWatcher(r *reloader) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
 
 	for {
 		select {
 		case sig := <-sigs:
 			switch sig {
+			case syscall.SIGHUP:
+				log.Info("Config reload requested with SIGHUP")
+				r.reload()
 			case syscall.SIGINT:
 				log.Info("Shutdown requested with CTRL+C!")
 				cancel()
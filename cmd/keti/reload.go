@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/discord"
+	"github.com/codechimp-io/keti/interactions"
+	"github.com/codechimp-io/keti/log"
+	"github.com/codechimp-io/keti/metrics"
+	"github.com/codechimp-io/keti/ratelimit"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Requests on this subject reload the config, the reply is the JSON list of the changes
+const reloadSubject = "keti.admin.reload"
+
+// reloader applies the settings that can change while running to the running components
+type reloader struct {
+	// Held while reloading, SIGHUP and admin requests may come together
+	sync.Mutex
+
+	args []string
+
+	mgr      *discord.Manager
+	deferrer *interactions.Deferrer
+	endpoint *interactions.Handler
+	limiter  *ratelimit.Limiter
+	metrics  *metrics.Server
+}
+
+// reload reads the config again the way it was loaded at startup, applies the live
+// settings and logs every change.
+func (r *reloader) reload() ([]config.Change, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	cfg, err := config.LoadArgs(r.args)
+	if err != nil {
+		log.Errorf("Cannot reload config, keeping the current one:\n%s", err)
+		return nil, err
+	}
+
+	changes := config.ReloadOptions(cfg)
+	if len(changes) == 0 {
+		log.Info("Config reloaded, nothing changed")
+		return changes, nil
+	}
+	o := config.Current()
+	for _, c := range changes {
+		log.Infof("Config reloaded: %s", c)
+
+		switch c.Setting {
+		case "KETI_DISCORD_LOG_CHANNEL":
+			// Only when changed, an empty channel at startup means the default one
+			r.mgr.SetLogChannel(o.Discord.LogChan)
+		case "KETI_DISCORD_STATUS_CHANNEL":
+			r.mgr.SetStatusChannel(o.Discord.StatusChan)
+		}
+	}
+
+	log.SetDebug(o.Debug)
+	r.mgr.SetRouting(discord.ConfiguredRouting())
+	if r.endpoint != nil {
+		r.endpoint.SetSubject(o.Broker.EventsSubject)
+	}
+	r.metrics.SetAddr(o.Metrics.Addr)
+	if rules, err := interactions.ParseRules(o.Interactions.Defer); err != nil {
+		log.Errorf("Invalid KETI_INTERACTIONS_DEFER, keeping the current rules: %s", err)
+	} else {
+		r.deferrer.SetRules(rules)
+		if len(rules) > 0 && r.mgr.Interactions == nil {
+			log.Warn("Gateway interactions are deferred after a restart, keti started without KETI_INTERACTIONS_DEFER rules")
+		}
+	}
+	if r.limiter != nil {
+		r.limiter.SetGlobalLimit(o.RateLimit.GlobalLimit)
+	}
+
+	return changes, nil
+}
+
+// serve reloads the config on requests received over nc.
+func (r *reloader) serve(nc *nats.Conn) error {
+	_, err := nc.Subscribe(reloadSubject, func(msg *nats.Msg) {
+		changes, err := r.reload()
+
+		if msg.Reply == "" {
+			return
+		}
+		var reply interface{} = changes
+		if err != nil {
+			reply = map[string]string{"error": err.Error()}
+		}
+		data, _ := json.Marshal(reply)
+		nc.Publish(msg.Reply, data)
+	})
+
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const shardsUsage = `Usage: keti shards calc --guilds N [flags]
+
+Computes the shard total for a number of guilds and splits the shards between hosts,
+printing the settings of every host.
+`
+
+// runShards runs the shards subcommand and returns the exit code.
+func runShards(args []string) int {
+	if len(args) == 0 || args[0] != "calc" {
+		fmt.Fprint(os.Stderr, shardsUsage)
+		return 2
+	}
+
+	fs := newFlagSet("shards calc", shardsUsage)
+	guilds := fs.Int("guilds", 0, "number of guilds of the bot")
+	perShard := fs.Int("per-shard", 1000, "guilds per shard to plan for, Discord allows up to 2500")
+	hosts := fs.Int("hosts", 1, "number of hosts running the shards")
+	concurrency := fs.Int("concurrency", 1, "max_concurrency of the bot, the total is rounded up to a multiple of it")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *guilds < 0 || *perShard < 1 || *perShard > 2500 || *hosts < 1 || *concurrency < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	total := (*guilds + *perShard - 1) / *perShard
+	if total < 1 {
+		total = 1
+	}
+	if rem := total % *concurrency; rem != 0 {
+		total += *concurrency - rem
+	}
+
+	fmt.Printf("%d guilds, %d shards, about %d guilds per shard\n\n", *guilds, total, *guilds/total)
+
+	for host, start := 0, 0; host < *hosts; host++ {
+		// Spread the remainder over the first hosts
+		n := total / *hosts
+		if host < total%*hosts {
+			n++
+		}
+		if n == 0 {
+			fmt.Printf("host %d: no shards\n", host+1)
+			continue
+		}
+
+		fmt.Printf("host %d: shards %d to %d\n", host+1, start, start+n-1)
+		fmt.Printf("  KETI_DISCORD_SHARD_TOTAL=%d KETI_DISCORD_SHARD_OFFSET=%d KETI_DISCORD_SHARD_COUNT=%d\n", total, start, start+n)
+		start += n
+	}
+
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// shutdown stops keti in order once ctx is done, within KETI_SHUTDOWN_TIMEOUT: the components stop,
+// the manager forwarding its last dispatches and closing its shards resumable on its own, then the
+// connection to the broker is drained and the broker stopped.
+func shutdown(nc *nats.EncodedConn, stopBroker func(), brokerWg *sync.WaitGroup) {
+	deadline := time.Now().Add(config.Current().Shutdown.Timeout)
+
+	if !waitUntil(wg, deadline) {
+		log.Warn("Shutdown timeout reached, not waiting for the remaining components")
+	}
+
+	// Delivers what is still buffered and lets the subscriptions handle their pending messages
+	if err := nc.Drain(); err != nil {
+		log.Errorf("Cannot drain the broker connection: %s", err)
+	}
+	for !nc.Conn.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	nc.Close()
+
+	stopBroker()
+	if !waitUntil(brokerWg, deadline) {
+		log.Warn("Shutdown timeout reached, not waiting for the broker")
+	}
+}
+
+// waitUntil waits for wg, it returns false if the deadline passed first.
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/discord"
+	"github.com/codechimp-io/keti/version"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Every instance answers requests on this subject with its status
+const statusSubject = "keti.admin.status"
+
+// instanceStatus is the reply of an instance to a status request
+type instanceStatus struct {
+	Instance   string                `json:"instance"`
+	Version    string                `json:"version"`
+	Started    time.Time             `json:"started"`
+	ShardTotal int                   `json:"shard_total"`
+	Shards     []discord.ShardStatus `json:"shards"`
+}
+
+// serveStatus answers status requests received over nc.
+func serveStatus(nc *nats.Conn, mgr *discord.Manager, started time.Time) error {
+	instance := config.Current().Cluster.Instance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+
+	_, err := nc.Subscribe(statusSubject, func(msg *nats.Msg) {
+		if msg.Reply == "" {
+			return
+		}
+
+		data, _ := json.Marshal(&instanceStatus{
+			Instance:   instance,
+			Version:    version.Version,
+			Started:    started,
+			ShardTotal: mgr.GetShardsTotal(),
+			Shards:     mgr.Status(),
+		})
+		nc.Publish(msg.Reply, data)
+	})
+
+	return err
+}
+
+const statusUsage = `Usage: keti status [flags]
+
+Prints the shards of every instance reachable over the broker.
+`
+
+// runStatus runs the status subcommand and returns the exit code.
+func runStatus(args []string) int {
+	fs := newFlagSet("status", statusUsage)
+	url := fs.String("url", defaultURL, "broker URL")
+	wait := fs.Duration("wait", time.Second, "how long to wait for the instances to answer")
+	asJSON := fs.Bool("json", false, "print the replies as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	nc, err := connect(*url, "status")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer nc.Close()
+
+	inbox := nats.NewInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := nc.PublishRequest(statusSubject, inbox, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var replies []instanceStatus
+	deadline := time.Now().Add(*wait)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			break
+		}
+		var st instanceStatus
+		if err := json.Unmarshal(msg.Data, &st); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid status reply: %s\n", err)
+			continue
+		}
+		replies = append(replies, st)
+	}
+	sort.Slice(replies, func(i, j int) bool { return replies[i].Instance < replies[j].Instance })
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(replies)
+		return 0
+	}
+
+	if len(replies) == 0 {
+		fmt.Fprintf(os.Stderr, "No instance answered within %s\n", *wait)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tVERSION\tUPTIME\tSHARD\tGUILDS\tUNAVAILABLE\tSTATE")
+	for _, st := range replies {
+		uptime := time.Since(st.Started).Round(time.Second)
+		if len(st.Shards) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\tno shards\n", st.Instance, st.Version, uptime)
+		}
+		for _, sh := range st.Shards {
+			state := "ready"
+			if sh.Loading {
+				state = "loading guilds"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d/%d\t%d\t%d\t%s\n", st.Instance, st.Version, uptime, sh.Shard, st.ShardTotal, sh.Guilds, sh.Unavailable, state)
+		}
+	}
+	w.Flush()
+
+	return 0
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/codechimp-io/keti/codec"
+	"github.com/codechimp-io/keti/discord"
+
+	"github.com/nats-io/go-nats"
+)
+
+const tapUsage = `Usage: keti tap [flags]
+
+Prints the events published on the broker as they arrive, until interrupted.
+`
+
+// runTap runs the tap subcommand and returns the exit code.
+func runTap(args []string) int {
+	fs := newFlagSet("tap", tapUsage)
+	url := fs.String("url", defaultURL, "broker URL")
+	subject := fs.String("subject", discord.EventsSubject, "subject to subscribe to, wildcards allowed")
+	encoding := fs.String("encoding", codec.JSON, "encoding of the events, as KETI_BROKER_ENCODING")
+	types := fs.String("type", "", "comma separated event types to print, e.g. MESSAGE_CREATE,GUILD_CREATE")
+	guild := fs.String("guild", "", "only print the events of this guild")
+	shard := fs.Int("shard", -1, "only print the events of this shard")
+	data := fs.Bool("data", false, "print the event payloads, indented")
+	asJSON := fs.Bool("json", false, "print the events as JSON lines")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if _, err := codec.Encoder(*encoding); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	only := make(map[string]bool)
+	for _, t := range strings.Split(*types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			only[strings.ToUpper(t)] = true
+		}
+	}
+
+	nc, err := connect(*url, "tap")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer nc.Close()
+
+	out := json.NewEncoder(os.Stdout)
+	_, err = nc.Subscribe(*subject, func(msg *nats.Msg) {
+		var e codec.GatewayEvent
+		if err := codec.Decode(*encoding, msg.Subject, msg.Data, &e); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot decode event on %s: %s\n", msg.Subject, err)
+			return
+		}
+
+		if len(only) > 0 && !only[e.Type] {
+			return
+		}
+		if *guild != "" && e.GuildID != *guild {
+			return
+		}
+		if *shard >= 0 && e.Shard != *shard {
+			return
+		}
+
+		if *asJSON {
+			out.Encode(&e)
+			return
+		}
+
+		line := fmt.Sprintf("%s %s shard %d/%d %s", e.ReceivedAt.Format("15:04:05.000"), msg.Subject, e.Shard, e.ShardTotal, e.Type)
+		if e.GuildID != "" {
+			line += " guild " + e.GuildID
+		}
+		if e.Deferred {
+			line += " deferred"
+		}
+		fmt.Printf("%s (%d bytes)\n", line, len(e.Data))
+
+		if *data {
+			var buf bytes.Buffer
+			if json.Indent(&buf, e.Data, "  ", "  ") == nil {
+				fmt.Printf("  %s\n", buf.String())
+			}
+		}
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Tapping %s on %s, interrupt to stop\n", *subject, *url)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+
+	return 0
+}
@@ -0,0 +1,71 @@
+// Package codec provides the GatewayEvent envelope published on the broker,
+// its wire encodings and the helpers consumers need to decode them.
+//
+// Importing the package registers every encoding with go-nats, so consumers
+// can use nats.NewEncodedConn(nc, codec.MsgPack) like any builtin encoder.
+//
+// The envelope is versioned by SchemaVersion, gateway_event.schema.json
+// documents its JSON form and gateway.proto its Protobuf form.
+package codec
+
+import (
+	"fmt"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Names of the supported encodings
+const (
+	// JSON is the builtin go-nats JSON encoder, the dispatch payload is embedded as is.
+	JSON = nats.JSON_ENCODER
+
+	// MsgPack encodes the event as MessagePack, the dispatch payload is kept as raw JSON bytes.
+	MsgPack = "msgpack"
+
+	// Protobuf encodes the event with the keti.codec.v1.GatewayEvent schema in gateway.proto.
+	Protobuf = "protobuf"
+
+	// Raw publishes the dispatch payload untouched, prefixed by a small binary envelope.
+	Raw = "raw"
+)
+
+func init() {
+	nats.RegisterEncoder(MsgPack, &MsgPackEncoder{})
+	nats.RegisterEncoder(Protobuf, &ProtobufEncoder{})
+	nats.RegisterEncoder(Raw, &RawEncoder{})
+}
+
+// Encoder returns the registered nats.Encoder for the given encoding name.
+func Encoder(encoding string) (nats.Encoder, error) {
+	enc := nats.EncoderForType(encoding)
+	if enc == nil {
+		return nil, fmt.Errorf("Unknown encoding %q", encoding)
+	}
+
+	return enc, nil
+}
+
+// Encode marshals a gateway event with the given encoding.
+func Encode(encoding, subject string, e *GatewayEvent) ([]byte, error) {
+	enc, err := Encoder(encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.Encode(subject, e)
+}
+
+// Decode unmarshals a gateway event published with the given encoding
+// and checks that its schema version is supported.
+func Decode(encoding, subject string, data []byte, e *GatewayEvent) error {
+	enc, err := Encoder(encoding)
+	if err != nil {
+		return err
+	}
+
+	if err := enc.Decode(subject, data, e); err != nil {
+		return err
+	}
+
+	return e.Check()
+}
@@ -0,0 +1,272 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenEvent is the event encoded in testdata, changing it requires regenerating the files with -update
+func goldenEvent() *GatewayEvent {
+	return &GatewayEvent{
+		Version:    SchemaVersion,
+		BotID:      "80351110224678912",
+		Shard:      3,
+		ShardTotal: 16,
+		Type:       "INTERACTION_CREATE",
+		Sequence:   42,
+		ID:         "ZxtVGKIQ3uxGwbVF2hqDmq",
+		GuildID:    "41771983423143937",
+		ReceivedAt: time.Date(2022, 11, 29, 20, 35, 12, 454000000, time.UTC),
+		Deferred:   true,
+		Data:       json.RawMessage(`{"id":"1047566290853937192","guild_id":"41771983423143937","type":2}`),
+	}
+}
+
+var goldenFiles = map[string]string{
+	JSON:     "event.json",
+	MsgPack:  "event.msgpack",
+	Protobuf: "event.pb",
+	Raw:      "event.raw",
+}
+
+// TestGolden checks every encoding still produces and decodes the payloads published by previous builds.
+func TestGolden(t *testing.T) {
+	for encoding, file := range goldenFiles {
+		t.Run(encoding, func(t *testing.T) {
+			path := filepath.Join("testdata", file)
+
+			data, err := Encode(encoding, "gateway:exchange", goldenEvent())
+			if err != nil {
+				t.Fatalf("Encode: %s", err)
+			}
+			if *update {
+				if err := ioutil.WriteFile(path, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			golden, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, golden) {
+				t.Errorf("Encoding changed, got:\n%q\nwant:\n%q", data, golden)
+			}
+
+			var e GatewayEvent
+			if err := Decode(encoding, "gateway:exchange", golden, &e); err != nil {
+				t.Fatalf("Decode: %s", err)
+			}
+			checkEvent(t, &e, goldenEvent())
+		})
+	}
+}
+
+func checkEvent(t *testing.T, got, want *GatewayEvent) {
+	t.Helper()
+
+	if !got.ReceivedAt.Equal(want.ReceivedAt) {
+		t.Errorf("ReceivedAt = %s, want %s", got.ReceivedAt, want.ReceivedAt)
+	}
+	if !bytes.Equal(compactJSON(t, got.Data), compactJSON(t, want.Data)) {
+		t.Errorf("Data = %s, want %s", got.Data, want.Data)
+	}
+
+	g, w := *got, *want
+	g.ReceivedAt, w.ReceivedAt = time.Time{}, time.Time{}
+	g.Data, w.Data = nil, nil
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("Decoded %+v, want %+v", g, w)
+	}
+}
+
+func compactJSON(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	if err := json.Compact(&b, data); err != nil {
+		t.Fatalf("Invalid JSON payload %q: %s", data, err)
+	}
+
+	return b.Bytes()
+}
+
+// TestSchema checks the JSON encoding against gateway_event.schema.json: the required members are
+// present with the declared types, and every member published is documented.
+func TestSchema(t *testing.T) {
+	var schema struct {
+		Required   []string `json:"required"`
+		Properties map[string]struct {
+			Type  string      `json:"type"`
+			Const interface{} `json:"const"`
+		} `json:"properties"`
+	}
+	data, err := ioutil.ReadFile("gateway_event.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("Invalid schema: %s", err)
+	}
+
+	data, err = Encode(JSON, "gateway:exchange", goldenEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range schema.Required {
+		if _, ok := event[name]; !ok {
+			t.Errorf("Required member %q is missing", name)
+		}
+	}
+
+	for name, v := range event {
+		prop, ok := schema.Properties[name]
+		if !ok {
+			t.Errorf("Member %q is not documented in the schema", name)
+			continue
+		}
+		if prop.Const != nil && v != prop.Const {
+			t.Errorf("Member %q = %v, want %v", name, v, prop.Const)
+		}
+		if prop.Type != "" && jsonType(v) != prop.Type && !(prop.Type == "number" && jsonType(v) == "integer") {
+			t.Errorf("Member %q is a %s, want %s", name, jsonType(v), prop.Type)
+		}
+		if name == "received_at" {
+			if _, err := time.Parse(time.RFC3339Nano, v.(string)); err != nil {
+				t.Errorf("Member received_at is not a date-time: %s", err)
+			}
+		}
+	}
+
+	// Every field of the envelope must be documented, including the ones omitted when empty
+	typ := reflect.TypeOf(GatewayEvent{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if _, ok := schema.Properties[name]; !ok {
+			t.Errorf("Field %s (%q) is not documented in the schema", typ.Field(i).Name, name)
+		}
+	}
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	}
+
+	return "object"
+}
+
+func TestCheck(t *testing.T) {
+	e := goldenEvent()
+	if err := e.Check(); err != nil {
+		t.Errorf("Current version: %s", err)
+	}
+
+	e.Version = 0
+	if err := e.Check(); err != ErrNoVersion {
+		t.Errorf("Version 0: got %v, want ErrNoVersion", err)
+	}
+
+	e.Version = SchemaVersion + 1
+	if err := e.Check(); err == nil {
+		t.Error("Future version: got no error")
+	}
+
+	// Decode rejects the envelopes it cannot handle
+	for encoding := range goldenFiles {
+		data, err := Encode(encoding, "gateway:exchange", e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Decode(encoding, "gateway:exchange", data, &GatewayEvent{}); err == nil {
+			t.Errorf("%s: decoded a future version without error", encoding)
+		}
+	}
+}
+
+// TestRawUnversioned checks the raw layout published before the versioned envelope is still decoded,
+// and reported as such.
+func TestRawUnversioned(t *testing.T) {
+	data := []byte{1}
+	data = binary.AppendUvarint(data, 3)
+	data = binary.AppendUvarint(data, 42)
+	data = binary.AppendVarint(data, goldenEvent().ReceivedAt.UnixNano())
+	for _, s := range []string{"INTERACTION_CREATE", "80351110224678912"} {
+		data = binary.AppendUvarint(data, uint64(len(s)))
+		data = append(data, s...)
+	}
+	data = append(data, goldenEvent().Data...)
+
+	var e GatewayEvent
+	if err := (&RawEncoder{}).Decode("gateway:exchange", data, &e); err != nil {
+		t.Fatalf("Decode: %s", err)
+	}
+	want := goldenEvent()
+	want.Version, want.ShardTotal, want.ID, want.GuildID, want.Deferred = 0, 0, "", "", false
+	checkEvent(t, &e, want)
+
+	if err := Decode(Raw, "gateway:exchange", data, &GatewayEvent{}); err != ErrNoVersion {
+		t.Errorf("Decode: got %v, want ErrNoVersion", err)
+	}
+
+	// Layout 2 was never published
+	data[0] = 2
+	if err := Decode(Raw, "gateway:exchange", data, &GatewayEvent{}); err == nil {
+		t.Error("Decoded layout 2 without error")
+	}
+}
+
+// TestDecodeReused checks decoding into a reused event does not keep fields of the previous one.
+func TestDecodeReused(t *testing.T) {
+	next := &GatewayEvent{
+		Version:    SchemaVersion,
+		Shard:      1,
+		ShardTotal: 16,
+		Type:       "MESSAGE_CREATE",
+		Sequence:   43,
+		ReceivedAt: goldenEvent().ReceivedAt,
+		Data:       json.RawMessage(`{"id":"1047566290853937193"}`),
+	}
+
+	for _, encoding := range []string{MsgPack, Protobuf, Raw} {
+		data, err := Encode(encoding, "gateway:exchange", next)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := goldenEvent()
+		if err := Decode(encoding, "gateway:exchange", data, e); err != nil {
+			t.Fatalf("%s: %s", encoding, err)
+		}
+		if e.Deferred || e.GuildID != "" || e.ID != "" || e.BotID != "" {
+			t.Errorf("%s: fields of the previous event kept: %+v", encoding, e)
+		}
+	}
+}
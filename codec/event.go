@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion is the version of the GatewayEvent envelope published by this build.
+// It is only bumped on breaking changes, new optional fields keep the version.
+const SchemaVersion = 1
+
+// GatewayEvent is the envelope published on the broker for every gateway dispatch,
+// its JSON form is described by gateway_event.schema.json.
+type GatewayEvent struct {
+	// Envelope schema version
+	Version int `json:"v" msgpack:"v"`
+
+	// ID of the bot user that received the event
+	BotID string `json:"bot_id" msgpack:"bot_id"`
+
+	// Shard that received the event and total number of shards of the bot
+	Shard      int `json:"shard" msgpack:"shard"`
+	ShardTotal int `json:"shard_total" msgpack:"shard_total"`
+
+	// Dispatch event name, e.g. MESSAGE_CREATE
+	Type string `json:"t" msgpack:"t"`
+
+	// Discord sequence number of the dispatch within the shard session
+	Sequence int64 `json:"s" msgpack:"s"`
+
+	// Unique ID assigned by keti
+	ID string `json:"id" msgpack:"id"`
+
+	// Guild the event belongs to, empty when there is none
+	GuildID string `json:"guild_id,omitempty" msgpack:"guild_id,omitempty"`
+
+	// When keti received the event
+	ReceivedAt time.Time `json:"received_at" msgpack:"received_at"`
+
+	// Set on interactions keti already acknowledged with a deferred response
+	Deferred bool `json:"deferred,omitempty" msgpack:"deferred,omitempty"`
+
+	// Raw JSON payload of the dispatch ("d")
+	Data json.RawMessage `json:"d" msgpack:"d"`
+}
+
+// ErrNoVersion is returned by Check when the envelope does not carry a schema version.
+var ErrNoVersion = errors.New("codec: gateway event has no schema version")
+
+// Check reports whether the envelope can be handled by this version of the package.
+func (e *GatewayEvent) Check() error {
+	switch {
+	case e.Version == 0:
+		return ErrNoVersion
+	case e.Version > SchemaVersion:
+		return fmt.Errorf("codec: unsupported gateway event schema version %d, want <= %d", e.Version, SchemaVersion)
+	}
+
+	return nil
+}
+
+// Unmarshal decodes the dispatch payload into v, usually the matching discordgo event struct.
+func (e *GatewayEvent) Unmarshal(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// eventPtr resolves the pointer handed to a nats.Encoder Encode or Decode call.
+func eventPtr(vPtr interface{}) (*GatewayEvent, error) {
+	switch v := vPtr.(type) {
+	case *GatewayEvent:
+		return v, nil
+	case **GatewayEvent:
+		if *v == nil {
+			*v = &GatewayEvent{}
+		}
+		return *v, nil
+	}
+
+	return nil, errors.New("codec: can only encode and decode *GatewayEvent")
+}
@@ -0,0 +1,32 @@
+package codec
+
+import (
+	"github.com/vmihailenco/msgpack"
+)
+
+// MsgPackEncoder is a nats.Encoder for MessagePack encoded gateway events,
+// the dispatch payload is carried as raw JSON bytes.
+type MsgPackEncoder struct{}
+
+// Encode marshals a *GatewayEvent.
+func (me *MsgPackEncoder) Encode(subject string, v interface{}) ([]byte, error) {
+	e, err := eventPtr(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return msgpack.Marshal(e)
+}
+
+// Decode unmarshals into a *GatewayEvent.
+func (me *MsgPackEncoder) Decode(subject string, data []byte, vPtr interface{}) error {
+	e, err := eventPtr(vPtr)
+	if err != nil {
+		return err
+	}
+
+	// Fields missing from data must not keep the values of a previously decoded event
+	*e = GatewayEvent{}
+
+	return msgpack.Unmarshal(data, e)
+}
@@ -0,0 +1,144 @@
+package codec
+
+import (
+	"errors"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtobufEncoder is a nats.Encoder for gateway events using the
+// keti.codec.v1.GatewayEvent message defined in gateway.proto.
+type ProtobufEncoder struct{}
+
+// Field numbers of keti.codec.v1.GatewayEvent
+const (
+	pbShard              protowire.Number = 1
+	pbBotID              protowire.Number = 2
+	pbSequence           protowire.Number = 4
+	pbType               protowire.Number = 5
+	pbData               protowire.Number = 6
+	pbReceivedAtUnixNano protowire.Number = 7
+	pbShardTotal         protowire.Number = 8
+	pbID                 protowire.Number = 9
+	pbGuildID            protowire.Number = 10
+	pbVersion            protowire.Number = 11
+	pbDeferred           protowire.Number = 12
+)
+
+var errProtobufMalformed = errors.New("codec: malformed protobuf GatewayEvent")
+
+// Encode marshals a *GatewayEvent.
+func (pe *ProtobufEncoder) Encode(subject string, v interface{}) ([]byte, error) {
+	e, err := eventPtr(v)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, len(e.Data)+128)
+	b = appendVarint(b, pbShard, uint64(e.Shard))
+	b = appendString(b, pbBotID, e.BotID)
+	b = appendVarint(b, pbSequence, uint64(e.Sequence))
+	b = appendString(b, pbType, e.Type)
+	if len(e.Data) > 0 {
+		b = protowire.AppendTag(b, pbData, protowire.BytesType)
+		b = protowire.AppendBytes(b, e.Data)
+	}
+	if !e.ReceivedAt.IsZero() {
+		b = appendVarint(b, pbReceivedAtUnixNano, uint64(e.ReceivedAt.UnixNano()))
+	}
+	b = appendVarint(b, pbShardTotal, uint64(e.ShardTotal))
+	b = appendString(b, pbID, e.ID)
+	b = appendString(b, pbGuildID, e.GuildID)
+	b = appendVarint(b, pbVersion, uint64(e.Version))
+	if e.Deferred {
+		b = appendVarint(b, pbDeferred, 1)
+	}
+
+	return b, nil
+}
+
+// Decode unmarshals into a *GatewayEvent, unknown fields are skipped.
+func (pe *ProtobufEncoder) Decode(subject string, data []byte, vPtr interface{}) error {
+	e, err := eventPtr(vPtr)
+	if err != nil {
+		return err
+	}
+
+	*e = GatewayEvent{}
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errProtobufMalformed
+		}
+		data = data[n:]
+
+		switch typ {
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return errProtobufMalformed
+			}
+			data = data[n:]
+
+			switch num {
+			case pbShard:
+				e.Shard = int(int32(v))
+			case pbShardTotal:
+				e.ShardTotal = int(int32(v))
+			case pbSequence:
+				e.Sequence = int64(v)
+			case pbReceivedAtUnixNano:
+				e.ReceivedAt = time.Unix(0, int64(v))
+			case pbVersion:
+				e.Version = int(int32(v))
+			case pbDeferred:
+				e.Deferred = v != 0
+			}
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return errProtobufMalformed
+			}
+			data = data[n:]
+
+			switch num {
+			case pbBotID:
+				e.BotID = string(v)
+			case pbType:
+				e.Type = string(v)
+			case pbID:
+				e.ID = string(v)
+			case pbGuildID:
+				e.GuildID = string(v)
+			case pbData:
+				e.Data = append([]byte(nil), v...)
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return errProtobufMalformed
+			}
+			data = data[n:]
+		}
+	}
+
+	return nil
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
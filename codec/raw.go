@@ -0,0 +1,182 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// RawEncoder is a nats.Encoder that publishes the dispatch payload exactly as it was
+// received from the gateway, prefixed by a small binary envelope carrying the metadata:
+//
+//	layout       byte     envelope layout, currently 3
+//	v            uvarint  schema version
+//	shard        uvarint
+//	shard_total  uvarint
+//	s            uvarint  sequence
+//	received_at  varint   unix nanoseconds, 0 when unknown
+//	t            uvarint length + bytes
+//	bot_id       uvarint length + bytes
+//	id           uvarint length + bytes
+//	guild_id     uvarint length + bytes
+//	flags        uvarint  bit 0: deferred
+//	d            remaining bytes, raw JSON payload
+//
+// Layout 1, published before the versioned envelope, is still decoded:
+//
+//	layout       byte     1
+//	shard        uvarint
+//	s            uvarint  sequence
+//	received_at  varint   unix nanoseconds, 0 when unknown
+//	t            uvarint length + bytes
+//	bot_id       uvarint length + bytes
+//	d            remaining bytes, raw JSON payload
+type RawEncoder struct{}
+
+// rawLayout is the layout of the binary prefix
+const rawLayout = 3
+
+// rawLayoutUnversioned is the layout published before the versioned envelope, decoded without a schema
+// version so that Check reports ErrNoVersion
+const rawLayoutUnversioned = 1
+
+const rawFlagDeferred = 1 << 0
+
+var errRawMalformed = errors.New("codec: malformed raw envelope")
+
+// Encode marshals a *GatewayEvent, the dispatch payload is copied untouched.
+func (re *RawEncoder) Encode(subject string, v interface{}) ([]byte, error) {
+	e, err := eventPtr(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var t int64
+	if !e.ReceivedAt.IsZero() {
+		t = e.ReceivedAt.UnixNano()
+	}
+
+	var flags uint64
+	if e.Deferred {
+		flags |= rawFlagDeferred
+	}
+
+	n := 1 + 10*binary.MaxVarintLen64 + len(e.Type) + len(e.BotID) + len(e.ID) + len(e.GuildID) + len(e.Data)
+	b := make([]byte, 0, n)
+	b = append(b, rawLayout)
+	b = binary.AppendUvarint(b, uint64(e.Version))
+	b = binary.AppendUvarint(b, uint64(e.Shard))
+	b = binary.AppendUvarint(b, uint64(e.ShardTotal))
+	b = binary.AppendUvarint(b, uint64(e.Sequence))
+	b = binary.AppendVarint(b, t)
+	for _, s := range []string{e.Type, e.BotID, e.ID, e.GuildID} {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	b = binary.AppendUvarint(b, flags)
+	b = append(b, e.Data...)
+
+	return b, nil
+}
+
+// Decode unmarshals into a *GatewayEvent, Data aliases the message data.
+func (re *RawEncoder) Decode(subject string, data []byte, vPtr interface{}) error {
+	e, err := eventPtr(vPtr)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return errRawMalformed
+	}
+	r := rawReader{data: data[1:]}
+	switch data[0] {
+	case rawLayout:
+	case rawLayoutUnversioned:
+		*e = GatewayEvent{
+			Shard:    int(r.uvarint()),
+			Sequence: int64(r.uvarint()),
+		}
+		if t := r.varint(); t != 0 {
+			e.ReceivedAt = time.Unix(0, t)
+		}
+		e.Type = r.string()
+		e.BotID = r.string()
+		e.Data = r.data
+
+		return r.err
+	default:
+		return fmt.Errorf("codec: unsupported raw envelope layout %d", data[0])
+	}
+
+	*e = GatewayEvent{
+		Version:    int(r.uvarint()),
+		Shard:      int(r.uvarint()),
+		ShardTotal: int(r.uvarint()),
+		Sequence:   int64(r.uvarint()),
+	}
+	if t := r.varint(); t != 0 {
+		e.ReceivedAt = time.Unix(0, t)
+	}
+	e.Type = r.string()
+	e.BotID = r.string()
+	e.ID = r.string()
+	e.GuildID = r.string()
+	e.Deferred = r.uvarint()&rawFlagDeferred != 0
+	e.Data = r.data
+
+	return r.err
+}
+
+// rawReader consumes the binary prefix, after the first error every read returns a zero value.
+type rawReader struct {
+	data []byte
+	err  error
+}
+
+func (r *rawReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errRawMalformed
+		return 0
+	}
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *rawReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errRawMalformed
+		return 0
+	}
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *rawReader) string() string {
+	l := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(len(r.data)) < l {
+		r.err = errRawMalformed
+		return ""
+	}
+
+	s := string(r.data[:l])
+	r.data = r.data[l:]
+
+	return s
+}
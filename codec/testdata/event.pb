@@ -0,0 +1 @@
+80351110224678912 **INTERACTION_CREATE2D{"id":"1047566290853937192","guild_id":"41771983423143937","type":2}8ː@JZxtVGKIQ3uxGwbVF2hqDmqR41771983423143937X`
\ No newline at end of file
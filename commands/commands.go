@@ -0,0 +1,122 @@
+// Package commands keeps the application commands registered on Discord in sync
+// with a declarative definition file.
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"gopkg.in/yaml.v2"
+)
+
+// File declares the global commands and the commands of each guild, keyed by guild ID.
+// Commands use the same fields as the Discord API, e.g. default_member_permissions as a string.
+type File struct {
+	Global []*discordgo.ApplicationCommand            `json:"global"`
+	Guilds map[string][]*discordgo.ApplicationCommand `json:"guilds"`
+}
+
+// Load reads a definition file, as YAML if its extension is .yaml or .yml and as JSON otherwise.
+func Load(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("Invalid command file %s: %s", path, err)
+		}
+	}
+
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("Invalid command file %s: %s", path, err)
+	}
+
+	scopes := map[string][]*discordgo.ApplicationCommand{"": f.Global}
+	for guildID, cmds := range f.Guilds {
+		scopes[guildID] = cmds
+	}
+	for guildID, cmds := range scopes {
+		seen := make(map[string]bool, len(cmds))
+		for _, cmd := range cmds {
+			k := key(cmd)
+			if seen[k] {
+				return nil, fmt.Errorf("Command %s is declared twice in %s", describe(guildID, cmd), path)
+			}
+			seen[k] = true
+		}
+	}
+
+	return &f, nil
+}
+
+// yamlToJSON converts YAML to JSON so the definitions decode with the API field names.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	v, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// jsonValue turns the map[interface{}]interface{} YAML decodes to into string keyed maps.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			e, err := jsonValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = e
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			e, err := jsonValue(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = e
+		}
+	}
+
+	return v, nil
+}
+
+// key identifies a command within its scope, names being unique per command type
+func key(cmd *discordgo.ApplicationCommand) string {
+	typ := cmd.Type
+	if typ == 0 {
+		typ = discordgo.ChatApplicationCommand
+	}
+
+	return fmt.Sprintf("%d:%s", typ, cmd.Name)
+}
+
+// describe names a command and its scope for messages
+func describe(guildID string, cmd *discordgo.ApplicationCommand) string {
+	name := cmd.Name
+	if cmd.Type == 0 || cmd.Type == discordgo.ChatApplicationCommand {
+		name = "/" + name
+	}
+	if guildID == "" {
+		return "global " + name
+	}
+
+	return fmt.Sprintf("%s in guild %s", name, guildID)
+}
@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/discord"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Run syncs the registered commands with the definition file set in config, if any.
+// Failures are logged, the gateway does not depend on the commands being in sync.
+func Run() {
+	cc := config.Options.Commands
+	if cc.File == "" {
+		return
+	}
+
+	f, err := Load(cc.File)
+	if err != nil {
+		log.Errorf("Cannot sync commands: %s", err)
+		return
+	}
+
+	s, err := discordgo.New(config.Options.Discord.BotToken())
+	if err != nil {
+		log.Errorf("Cannot sync commands: %s", err)
+		return
+	}
+	discord.ConfiguredEndpoints().Apply(s)
+
+	changes, err := Sync(s, f, cc.DryRun)
+	for _, c := range changes {
+		if cc.DryRun {
+			log.Infof("Planned command change: %s", c)
+		} else {
+			log.Infof("Command change: %s", c)
+		}
+	}
+	if err != nil {
+		log.Errorf("Cannot sync commands: %s", err)
+		return
+	}
+
+	log.Infof("Commands in sync with %s, %d changes", cc.File, len(changes))
+}
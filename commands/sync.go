@@ -0,0 +1,197 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Actions a change applies
+const (
+	Create = "create"
+	Update = "update"
+	Delete = "delete"
+)
+
+// Change is a create, update or delete of a registered command
+type Change struct {
+	Action  string
+	GuildID string
+
+	// Declared command, or the registered one for deletes
+	Command *discordgo.ApplicationCommand
+
+	// ID of the registered command for updates and deletes
+	ID string
+}
+
+func (c *Change) String() string {
+	return c.Action + " " + describe(c.GuildID, c.Command)
+}
+
+// Plan compares the declared commands with the ones registered for the application, globally
+// and in the guilds of the file. Guilds absent from the file are left untouched.
+func Plan(s *discordgo.Session, appID string, f *File) ([]*Change, error) {
+	guilds := make([]string, 0, len(f.Guilds))
+	for guildID := range f.Guilds {
+		guilds = append(guilds, guildID)
+	}
+	sort.Strings(guilds)
+
+	registered, err := s.ApplicationCommands(appID, "")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot list global commands: %s", err)
+	}
+	changes := Diff("", f.Global, registered)
+
+	for _, guildID := range guilds {
+		registered, err := s.ApplicationCommands(appID, guildID)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot list commands of guild %s: %s", guildID, err)
+		}
+		changes = append(changes, Diff(guildID, f.Guilds[guildID], registered)...)
+	}
+
+	return changes, nil
+}
+
+// Diff returns the changes turning the registered commands of a scope into the declared ones.
+func Diff(guildID string, declared, registered []*discordgo.ApplicationCommand) []*Change {
+	existing := make(map[string]*discordgo.ApplicationCommand, len(registered))
+	for _, cmd := range registered {
+		existing[key(cmd)] = cmd
+	}
+
+	var changes []*Change
+	for _, cmd := range declared {
+		k := key(cmd)
+		reg, ok := existing[k]
+		if !ok {
+			changes = append(changes, &Change{Action: Create, GuildID: guildID, Command: cmd})
+			continue
+		}
+		delete(existing, k)
+
+		if !equal(guildID, cmd, reg) {
+			changes = append(changes, &Change{Action: Update, GuildID: guildID, Command: cmd, ID: reg.ID})
+		}
+	}
+
+	// Keep the registration order for deletes
+	for _, cmd := range registered {
+		if _, ok := existing[key(cmd)]; ok {
+			changes = append(changes, &Change{Action: Delete, GuildID: guildID, Command: cmd, ID: cmd.ID})
+		}
+	}
+
+	return changes
+}
+
+// Apply performs the changes in order, stopping at the first failure.
+func Apply(s *discordgo.Session, appID string, changes []*Change) error {
+	for _, c := range changes {
+		var err error
+		switch c.Action {
+		case Create:
+			_, err = s.ApplicationCommandCreate(appID, c.GuildID, c.Command)
+		case Update:
+			_, err = s.ApplicationCommandEdit(appID, c.GuildID, c.ID, c.Command)
+		case Delete:
+			err = s.ApplicationCommandDelete(appID, c.GuildID, c.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("Cannot %s: %s", c, err)
+		}
+	}
+
+	return nil
+}
+
+// Sync plans the changes for the file and applies them unless dryRun is set.
+// The application is the one of the session token.
+func Sync(s *discordgo.Session, f *File, dryRun bool) ([]*Change, error) {
+	app, err := s.Application("@me")
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get the application: %s", err)
+	}
+
+	changes, err := Plan(s, app.ID, f)
+	if err != nil || dryRun {
+		return changes, err
+	}
+
+	return changes, Apply(s, app.ID, changes)
+}
+
+// equal reports whether a declared command matches its registered counterpart,
+// ignoring the fields Discord assigns and the defaults it fills in.
+func equal(guildID string, declared, registered *discordgo.ApplicationCommand) bool {
+	a, err := json.Marshal(normalize(guildID, declared))
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(normalize(guildID, registered))
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(a, b)
+}
+
+func normalize(guildID string, cmd *discordgo.ApplicationCommand) *discordgo.ApplicationCommand {
+	n := &discordgo.ApplicationCommand{
+		Type:                     cmd.Type,
+		Name:                     cmd.Name,
+		NameLocalizations:        cmd.NameLocalizations,
+		DefaultMemberPermissions: cmd.DefaultMemberPermissions,
+		NSFW:                     cmd.NSFW,
+		Description:              cmd.Description,
+		DescriptionLocalizations: cmd.DescriptionLocalizations,
+		Options:                  normalizeOptions(cmd.Options),
+	}
+	if n.Type == 0 {
+		n.Type = discordgo.ChatApplicationCommand
+	}
+	if n.NameLocalizations != nil && len(*n.NameLocalizations) == 0 {
+		n.NameLocalizations = nil
+	}
+	if n.DescriptionLocalizations != nil && len(*n.DescriptionLocalizations) == 0 {
+		n.DescriptionLocalizations = nil
+	}
+	if n.NSFW != nil && !*n.NSFW {
+		n.NSFW = nil
+	}
+
+	// DMs only apply to global commands, where they are allowed by default
+	if guildID == "" && (cmd.DMPermission == nil || *cmd.DMPermission) {
+		n.DMPermission = nil
+	} else if guildID == "" {
+		n.DMPermission = cmd.DMPermission
+	}
+
+	return n
+}
+
+func normalizeOptions(opts []*discordgo.ApplicationCommandOption) []*discordgo.ApplicationCommandOption {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	norm := make([]*discordgo.ApplicationCommandOption, len(opts))
+	for i, opt := range opts {
+		o := *opt
+		if len(o.ChannelTypes) == 0 {
+			o.ChannelTypes = nil
+		}
+		if len(o.Choices) == 0 {
+			o.Choices = nil
+		}
+		o.Options = normalizeOptions(o.Options)
+		norm[i] = &o
+	}
+
+	return norm
+}
@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func registered(id, name string) *discordgo.ApplicationCommand {
+	return &discordgo.ApplicationCommand{
+		ID:            id,
+		ApplicationID: "1",
+		Version:       "1",
+		Type:          discordgo.ChatApplicationCommand,
+		Name:          name,
+		Description:   name,
+		DMPermission:  boolPtr(true),
+		NSFW:          boolPtr(false),
+	}
+}
+
+func TestDiff(t *testing.T) {
+	declared := []*discordgo.ApplicationCommand{
+		{Name: "ping", Description: "ping"},
+		{Name: "echo", Description: "Repeats a message"},
+		{Name: "new", Description: "new"},
+		{Type: discordgo.UserApplicationCommand, Name: "ping"},
+	}
+	reg := []*discordgo.ApplicationCommand{
+		registered("10", "old"),
+		registered("11", "ping"),
+		registered("12", "echo"),
+		registered("13", "older"),
+	}
+
+	want := []Change{
+		{Action: Update, ID: "12", Command: declared[1]},
+		{Action: Create, Command: declared[2]},
+		{Action: Create, Command: declared[3]},
+		{Action: Delete, ID: "10", Command: reg[0]},
+		{Action: Delete, ID: "13", Command: reg[3]},
+	}
+
+	changes := Diff("", declared, reg)
+	if len(changes) != len(want) {
+		t.Fatalf("%d changes %v, want %d", len(changes), changes, len(want))
+	}
+	for i, c := range changes {
+		if c.Action != want[i].Action || c.ID != want[i].ID || c.Command != want[i].Command || c.GuildID != "" {
+			t.Errorf("Change %d is %s %q, want %s %q", i, c, c.ID, &want[i], want[i].ID)
+		}
+	}
+
+	if changes := Diff("", nil, nil); len(changes) != 0 {
+		t.Errorf("Changes %v without commands", changes)
+	}
+	if changes := Diff("", declared[:1], reg[1:2]); len(changes) != 0 {
+		t.Errorf("Changes %v for a registered command", changes)
+	}
+	if changes := Diff("123", declared[2:3], nil); len(changes) != 1 || changes[0].GuildID != "123" {
+		t.Errorf("Changes %v in a guild", changes)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	empty := map[discordgo.Locale]string{}
+	names := map[discordgo.Locale]string{discordgo.French: "bonjour"}
+
+	tests := []struct {
+		name       string
+		guildID    string
+		declared   *discordgo.ApplicationCommand
+		registered *discordgo.ApplicationCommand
+		equal      bool
+	}{
+		{
+			"default type",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping"},
+			&discordgo.ApplicationCommand{ID: "1", Version: "2", Type: discordgo.ChatApplicationCommand, Name: "ping"},
+			true,
+		},
+		{
+			"DMs allowed by default",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping"},
+			&discordgo.ApplicationCommand{Name: "ping", DMPermission: boolPtr(true)},
+			true,
+		},
+		{
+			"DMs denied",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping", DMPermission: boolPtr(false)},
+			&discordgo.ApplicationCommand{Name: "ping", DMPermission: boolPtr(true)},
+			false,
+		},
+		{
+			"DMs ignored in guilds",
+			"123",
+			&discordgo.ApplicationCommand{Name: "ping", DMPermission: boolPtr(false)},
+			&discordgo.ApplicationCommand{Name: "ping"},
+			true,
+		},
+		{
+			"not NSFW by default",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping"},
+			&discordgo.ApplicationCommand{Name: "ping", NSFW: boolPtr(false)},
+			true,
+		},
+		{
+			"NSFW",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping", NSFW: boolPtr(true)},
+			&discordgo.ApplicationCommand{Name: "ping", NSFW: boolPtr(false)},
+			false,
+		},
+		{
+			"empty localizations",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping"},
+			&discordgo.ApplicationCommand{Name: "ping", NameLocalizations: &empty, DescriptionLocalizations: &empty},
+			true,
+		},
+		{
+			"localizations",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping", NameLocalizations: &names},
+			&discordgo.ApplicationCommand{Name: "ping", NameLocalizations: &empty},
+			false,
+		},
+		{
+			"option defaults",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping", Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "sub", Options: []*discordgo.ApplicationCommandOption{
+					{Type: discordgo.ApplicationCommandOptionChannel, Name: "where"},
+				}},
+			}},
+			&discordgo.ApplicationCommand{Name: "ping", Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionSubCommand, Name: "sub", Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:         discordgo.ApplicationCommandOptionChannel,
+						Name:         "where",
+						ChannelTypes: []discordgo.ChannelType{},
+						Choices:      []*discordgo.ApplicationCommandOptionChoice{},
+					},
+				}, Choices: []*discordgo.ApplicationCommandOptionChoice{}},
+			}},
+			true,
+		},
+		{
+			"no options",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping"},
+			&discordgo.ApplicationCommand{Name: "ping", Options: []*discordgo.ApplicationCommandOption{}},
+			true,
+		},
+		{
+			"option changed",
+			"",
+			&discordgo.ApplicationCommand{Name: "ping", Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionString, Name: "what", Required: true},
+			}},
+			&discordgo.ApplicationCommand{Name: "ping", Options: []*discordgo.ApplicationCommandOption{
+				{Type: discordgo.ApplicationCommandOptionString, Name: "what"},
+			}},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := equal(tt.guildID, tt.declared, tt.registered); got != tt.equal {
+			t.Errorf("%s: equal is %v, want %v", tt.name, got, tt.equal)
+		}
+	}
+}
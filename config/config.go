@@ -2,39 +2,188 @@ package config
 
 import (
 	"fmt"
+	"sync"
+	"time"
+)
 
-	"github.com/codechimp-io/keti/log"
+// Config is the configuration of keti, see Load
+type Config struct {
+	Debug   bool `envconfig:"KETI_DEBUG" default:"false" required:"true" reload:"live"`
+	Broker  broker
+	Cluster cluster
+	Discord discord
+	Metrics metrics
+	State   state
 
-	"github.com/kelseyhightower/envconfig"
-)
+	Interactions interactions
+	Commands     commands
+	RateLimit    ratelimit
+	Proxy        proxy
+	Capture      capture
+	Shutdown     shutdown
 
-func init() {
-	err := envconfig.Process("", &Options)
-	if err != nil {
-		log.Fatalf("Error loading config: %s", err)
-	}
+	// Where the value of every setting came from, by environment variable name
+	Sources map[string]string
 }
 
-type EnvConfig struct {
-	Debug   bool `envconfig:"KETI_DEBUG" default:"false" required:"true"`
-	Discord discord
+type cluster struct {
+	Enabled   bool          `envconfig:"KETI_CLUSTER_ENABLED" default:"false"`
+	Instance  string        `envconfig:"KETI_CLUSTER_INSTANCE" default:""`
+	Standby   bool          `envconfig:"KETI_CLUSTER_STANDBY" default:"false"`
+	LeaseTTL  time.Duration `envconfig:"KETI_CLUSTER_LEASE_TTL" default:"15s"`
+	Heartbeat time.Duration `envconfig:"KETI_CLUSTER_HEARTBEAT" default:"5s"`
+
+	// Coordinator mode, shards are assigned by the leader instead of configured
+	Coordinator bool `envconfig:"KETI_CLUSTER_COORDINATOR" default:"false"`
+	Capacity    int  `envconfig:"KETI_CLUSTER_CAPACITY" default:"16"`
+}
+
+type metrics struct {
+	Addr string `envconfig:"KETI_METRICS_ADDR" default:"" reload:"live"`
+}
+
+type interactions struct {
+	// Rules deferring interactions, command names or custom IDs, optionally followed by :ephemeral
+	Defer []string `envconfig:"KETI_INTERACTIONS_DEFER" default:"" reload:"live"`
+
+	// HTTP interactions endpoint, disabled when empty
+	Addr      string `envconfig:"KETI_INTERACTIONS_ADDR" default:""`
+	PublicKey string `envconfig:"KETI_INTERACTIONS_PUBLIC_KEY" default:""`
+}
+
+type ratelimit struct {
+	// Shared REST rate limiter, also used by the sessions of this instance
+	Enabled     bool `envconfig:"KETI_RATELIMIT_ENABLED" default:"false"`
+	GlobalLimit int  `envconfig:"KETI_RATELIMIT_GLOBAL_LIMIT" default:"50" reload:"live"`
+}
+
+type proxy struct {
+	// HTTP REST proxy, disabled when empty. It calls Discord with the bot token, so it
+	// requires Secret from its clients unless it only listens on a loopback address.
+	Addr     string        `envconfig:"KETI_PROXY_ADDR" default:""`
+	Secret   string        `envconfig:"KETI_PROXY_SECRET" default:""`
+	Upstream string        `envconfig:"KETI_PROXY_UPSTREAM" default:"https://discord.com"`
+	Retries  int           `envconfig:"KETI_PROXY_RETRIES" default:"3"`
+	Backoff  time.Duration `envconfig:"KETI_PROXY_BACKOFF" default:"500ms"`
+}
+
+type shutdown struct {
+	// Deadline of the whole shutdown, from draining the shards to stopping the broker
+	Timeout time.Duration `envconfig:"KETI_SHUTDOWN_TIMEOUT" default:"10s"`
+
+	// Raw shard sessions are saved to this file on shutdown and resumed from it on start, disabled when empty
+	SessionsFile string `envconfig:"KETI_SHUTDOWN_SESSIONS_FILE" default:""`
+}
+
+type capture struct {
+	// Gzip compressed newline delimited JSON file the published events are recorded to, disabled when empty
+	File      string `envconfig:"KETI_CAPTURE_FILE" default:""`
+	Anonymize bool   `envconfig:"KETI_CAPTURE_ANONYMIZE" default:"false"`
+}
+
+type commands struct {
+	// Command definition file synced at startup, disabled when empty
+	File   string `envconfig:"KETI_COMMANDS_FILE" default:""`
+	DryRun bool   `envconfig:"KETI_COMMANDS_DRY_RUN" default:"false"`
+}
+
+type state struct {
+	Enabled  bool     `envconfig:"KETI_STATE_ENABLED" default:"false"`
+	Entities []string `envconfig:"KETI_STATE_ENTITIES" default:"guilds,channels,roles"`
+
+	// Redis protocol compatible store the state is also written to
+	RedisAddr     string `envconfig:"KETI_STATE_REDIS_ADDR" default:""`
+	RedisPassword string `envconfig:"KETI_STATE_REDIS_PASSWORD" default:"" secret:"true"`
+	RedisDB       int    `envconfig:"KETI_STATE_REDIS_DB" default:"0"`
+	RedisPrefix   string `envconfig:"KETI_STATE_REDIS_PREFIX" default:"keti:"`
+	RedisQueue    int    `envconfig:"KETI_STATE_REDIS_QUEUE" default:"10000"`
+}
+
+type broker struct {
+	Encoding string   `envconfig:"KETI_BROKER_ENCODING" default:"json"`
+	Routes   []string `envconfig:"KETI_BROKER_ROUTES" default:""`
+
+	// Subject gateway events are published on, and the ones guild lifecycle events are also published on
+	EventsSubject           string `envconfig:"KETI_BROKER_EVENTS_SUBJECT" default:"gateway:exchange" reload:"live"`
+	GuildJoinedSubject      string `envconfig:"KETI_BROKER_GUILD_JOINED_SUBJECT" default:"guild.joined" reload:"live"`
+	GuildAvailableSubject   string `envconfig:"KETI_BROKER_GUILD_AVAILABLE_SUBJECT" default:"guild.available" reload:"live"`
+	GuildLeftSubject        string `envconfig:"KETI_BROKER_GUILD_LEFT_SUBJECT" default:"guild.left" reload:"live"`
+	GuildUnavailableSubject string `envconfig:"KETI_BROKER_GUILD_UNAVAILABLE_SUBJECT" default:"guild.unavailable" reload:"live"`
+
+	// What to do with the events which cannot be published right away: drop, disk or block
+	Backpressure string `envconfig:"KETI_BROKER_BACKPRESSURE" default:"drop"`
+
+	// Bytes waiting to be written to the broker above which the backpressure policy applies, 0 for no limit.
+	// Limits below the 32KiB the client buffers while connected apply during bursts, larger ones only
+	// while it reconnects. Without one, publishing fails once the reconnect buffer is full.
+	MaxPendingBytes int `envconfig:"KETI_BROKER_MAX_PENDING_BYTES" default:"0"`
+
+	// File the events are spooled to with the disk policy
+	SpoolFile string `envconfig:"KETI_BROKER_SPOOL_FILE" default:"keti.spool"`
+
+	// Longest a shard blocks on an event with the block policy, the event is dropped after.
+	// Blocked events are dropped by the shutdown deadline whatever the timeout.
+	BlockTimeout time.Duration `envconfig:"KETI_BROKER_BLOCK_TIMEOUT" default:"30s"`
+
+	// Bytes pending to a client above which it is reported as a slow consumer
+	SlowConsumerPending int `envconfig:"KETI_BROKER_SLOW_CONSUMER_PENDING" default:"1048576"`
 }
 
 type discord struct {
-	Token       string `envconfig:"KETI_DISCORD_TOKEN" default:""`
-	ShardCount  int    `envconfig:"KETI_DISCORD_SHARD_COUNT" default:"1"`
-	ShardOffset int    `envconfig:"KETI_DISCORD_SHARD_OFFSET" default:"1"`
-	ShardTotal  int    `envconfig:"KETI_DISCORD_SHARD_TOTAL" default:""`
-	StatusChan  string `envconfig:"KETI_DISCORD_STATUS_CHANNEL" default:""`
-	LogChan     string `envconfig:"KETI_DISCORD_LOG_CHANNEL" default:""`
+	Token string `envconfig:"KETI_DISCORD_TOKEN" default:"" secret:"true"`
+
+	// Shards run by this instance, from the offset up to the count excluded, out of the total
+	ShardCount  int `envconfig:"KETI_DISCORD_SHARD_COUNT" default:"1"`
+	ShardOffset int `envconfig:"KETI_DISCORD_SHARD_OFFSET" default:"0"`
+	ShardTotal  int `envconfig:"KETI_DISCORD_SHARD_TOTAL" default:""`
+
+	StatusChan  string `envconfig:"KETI_DISCORD_STATUS_CHANNEL" default:"" reload:"live"`
+	LogChan     string `envconfig:"KETI_DISCORD_LOG_CHANNEL" default:"" reload:"live"`
+	RawDispatch bool   `envconfig:"KETI_DISCORD_RAW_DISPATCH" default:"false"`
+
+	// Dispatch types not forwarded to the broker
+	IgnoredEvents []string `envconfig:"KETI_DISCORD_IGNORED_EVENTS" default:"CHANNEL_PINS_UPDATE,GUILD_EMOJIS_UPDATE,MESSAGE_UPDATE,TYPING_START" reload:"live"`
+
+	// REST API base URL without the version and gateway URL used instead of Discord's, e.g. to go
+	// through a gateway cache or a local stand-in. The gateway is asked to the API when empty.
+	APIURL     string `envconfig:"KETI_DISCORD_API_URL" default:""`
+	APIVersion string `envconfig:"KETI_DISCORD_API_VERSION" default:""`
+	GatewayURL string `envconfig:"KETI_DISCORD_GATEWAY_URL" default:""`
+
+	// Gateway intent names, e.g. GUILDS,GUILD_MESSAGES,MESSAGE_CONTENT
+	Intents []string `envconfig:"KETI_DISCORD_INTENTS" default:""`
+
+	Compress           bool `envconfig:"KETI_DISCORD_COMPRESS" default:"true"`
+	LargeThreshold     int  `envconfig:"KETI_DISCORD_LARGE_THRESHOLD" default:"250"`
+	GuildSubscriptions bool `envconfig:"KETI_DISCORD_GUILD_SUBSCRIPTIONS" default:"true"`
+
+	GuildsLoadTimeout time.Duration `envconfig:"KETI_DISCORD_GUILDS_LOAD_TIMEOUT" default:"1m"`
+	Dedup             dedup
 }
 
-func (d *discord) BotToken() string {
-	if d.Token == "" {
-		log.Fatal("Discord Bot token cannot be left blank")
-	}
+type dedup struct {
+	Enabled bool          `envconfig:"KETI_DISCORD_DEDUP" default:"false"`
+	Window  time.Duration `envconfig:"KETI_DISCORD_DEDUP_WINDOW" default:"5m"`
+	Size    int           `envconfig:"KETI_DISCORD_DEDUP_SIZE" default:"100000"`
+	Shared  bool          `envconfig:"KETI_DISCORD_DEDUP_SHARED" default:"false"`
+}
 
+// BotToken returns the Authorization header value of the bot, the token is checked by Validate.
+func (d *discord) BotToken() string {
 	return fmt.Sprintf("Bot %s", d.Token)
 }
 
-var Options EnvConfig
+// Options is the configuration in use, set by main once loaded. It is read directly while starting,
+// once reloads are served the goroutines running read it with Current.
+var Options Config
+
+// Guards Options against reloads
+var optionsMu sync.RWMutex
+
+// Current returns a copy of the configuration in use.
+func Current() Config {
+	optionsMu.RLock()
+	defer optionsMu.RUnlock()
+
+	return Options
+}
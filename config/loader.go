@@ -0,0 +1,320 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Sources of a setting, from the lowest to the highest precedence
+const (
+	SourceDefault = "default"
+	SourceFile    = "file"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// ConfigEnv is the environment variable naming the config file when --config is not given
+const ConfigEnv = "KETI_CONFIG"
+
+// setting is a config field with the ways to set it
+type setting struct {
+	env      string
+	key      string
+	flag     string
+	def      string
+	required bool
+	live     bool
+	secret   bool
+
+	field reflect.Value
+}
+
+// Load builds the config from the defaults, then the config file named by KETI_CONFIG,
+// then the environment, and validates it. Errors are reported together as Errors.
+func Load() (Config, error) {
+	return LoadArgs(nil)
+}
+
+// LoadArgs is Load with the command line flags in args applied last. The config file can also be
+// given by --config. YAML and TOML files are supported, with the sections and keys named after
+// the fields, e.g. discord.shard_count. Flags are named after the environment variables,
+// e.g. --discord-shard-count for KETI_DISCORD_SHARD_COUNT.
+func LoadArgs(args []string) (Config, error) {
+	var opts Config
+	settings := collect(reflect.ValueOf(&opts).Elem(), "", nil)
+	values := make(map[string]string, len(settings))
+	sources := make(map[string]string, len(settings))
+	var errs Errors
+
+	for _, s := range settings {
+		if s.def != "" {
+			values[s.env], sources[s.env] = s.def, SourceDefault
+		}
+	}
+
+	// Flags are parsed first for --config, and applied last
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(ConfigEnv), "config file, YAML or TOML")
+	flags := make(map[string]*flagValue, len(settings))
+	for _, s := range settings {
+		fv := &flagValue{bool: s.field.Kind() == reflect.Bool}
+		flags[s.env] = fv
+		fs.Var(fv, s.flag, "sets "+s.env)
+	}
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if fs.NArg() > 0 {
+		errs = append(errs, fmt.Errorf("Unexpected argument %q", fs.Arg(0)))
+	}
+
+	if *path != "" {
+		file, err := readFile(*path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		byKey := make(map[string]*setting, len(settings))
+		for _, s := range settings {
+			byKey[s.key] = s
+		}
+		flat := flatten(file, "")
+		keys := make([]string, 0, len(flat))
+		for key := range flat {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			v := flat[key]
+			s, ok := byKey[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("Unknown setting %s in %s", key, *path))
+				continue
+			}
+			values[s.env], sources[s.env] = v, SourceFile
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			values[s.env], sources[s.env] = v, SourceEnv
+		}
+		if fv := flags[s.env]; fv.set {
+			values[s.env], sources[s.env] = fv.value, SourceFlag
+		}
+	}
+
+	for _, s := range settings {
+		v, ok := values[s.env]
+		if !ok {
+			if s.required {
+				errs = append(errs, &FieldError{Setting: s.env, Err: errors.New("Required")})
+			}
+			continue
+		}
+		if err := assign(s.field, v); err != nil {
+			errs = append(errs, &FieldError{Setting: s.env, Source: sources[s.env], Err: err})
+		}
+	}
+
+	opts.Sources = sources
+	if len(errs) == 0 {
+		// Values that did not parse would only add noise
+		errs = opts.Validate()
+	}
+	if len(errs) > 0 {
+		return opts, errs
+	}
+
+	return opts, nil
+}
+
+// collect lists the settings of the struct v, naming file keys after the field names.
+func collect(v reflect.Value, prefix string, settings []*setting) []*setting {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + snakeCase(f.Name)
+
+		env, ok := f.Tag.Lookup("envconfig")
+		if !ok {
+			if f.Type.Kind() == reflect.Struct {
+				settings = collect(v.Field(i), key+".", settings)
+			}
+			continue
+		}
+
+		settings = append(settings, &setting{
+			env:      env,
+			key:      key,
+			flag:     strings.Replace(strings.ToLower(strings.TrimPrefix(env, "KETI_")), "_", "-", -1),
+			def:      f.Tag.Get("default"),
+			required: f.Tag.Get("required") == "true",
+			live:     f.Tag.Get("reload") == "live",
+			secret:   f.Tag.Get("secret") == "true",
+			field:    v.Field(i),
+		})
+	}
+
+	return settings
+}
+
+// snakeCase turns a field name into a file key, e.g. LeaseTTL into lease_ttl.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return b.String()
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		_, err = toml.Decode(string(data), &file)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		return nil, fmt.Errorf("Unknown config file format %s, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %s", path, err)
+	}
+
+	return file, nil
+}
+
+// flatten turns the nested sections of a config file into dotted keys,
+// with values in the same text form as the environment.
+func flatten(m map[string]interface{}, prefix string) map[string]string {
+	flat := make(map[string]string)
+	for k, v := range m {
+		key := prefix + k
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for fk, fv := range flatten(v, key+".") {
+				flat[fk] = fv
+			}
+		case map[interface{}]interface{}:
+			sm := make(map[string]interface{}, len(v))
+			for mk, mv := range v {
+				sm[fmt.Sprint(mk)] = mv
+			}
+			for fk, fv := range flatten(sm, key+".") {
+				flat[fk] = fv
+			}
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			flat[key] = strings.Join(items, ",")
+		case nil:
+			flat[key] = ""
+		default:
+			flat[key] = fmt.Sprint(v)
+		}
+	}
+
+	return flat
+}
+
+// assign parses v into the field, the way envconfig does.
+func assign(field reflect.Value, v string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(v)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		if v == "" {
+			field.SetInt(0)
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		if v == "" {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		field.Set(reflect.ValueOf(strings.Split(v, ",")))
+	default:
+		return fmt.Errorf("Unsupported setting type %s", field.Type())
+	}
+
+	return nil
+}
+
+// flagValue records a flag given on the command line
+type flagValue struct {
+	value string
+	set   bool
+	bool  bool
+}
+
+func (f *flagValue) String() string   { return f.value }
+func (f *flagValue) IsBoolFlag() bool { return f.bool }
+
+func (f *flagValue) Set(v string) error {
+	f.value, f.set = v, true
+	return nil
+}
+
+// SortedSources lists the settings not left to their default, with their source, for logging.
+func (c *Config) SortedSources() []string {
+	var lines []string
+	for env, src := range c.Sources {
+		if src != SourceDefault {
+			lines = append(lines, env+" from "+src)
+		}
+	}
+	sort.Strings(lines)
+
+	return lines
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Change is a setting that differs between the config in use and a reloaded one
+type Change struct {
+	Setting string `json:"setting"`
+	Old     string `json:"old"`
+	New     string `json:"new"`
+
+	// Applied while running, otherwise it takes effect on restart
+	Live bool `json:"live"`
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%s changed from %q to %q", c.Setting, c.Old, c.New)
+	if !c.Live {
+		s += ", requires a restart"
+	}
+
+	return s
+}
+
+// ReloadOptions applies the live settings of n to Options, see Reload. Options is replaced by an updated
+// copy, so that the copies returned by Current are left untouched.
+func ReloadOptions(n Config) []Change {
+	optionsMu.Lock()
+	defer optionsMu.Unlock()
+
+	c := Options
+	c.Sources = make(map[string]string, len(Options.Sources))
+	for env, src := range Options.Sources {
+		c.Sources[env] = src
+	}
+	changes := c.Reload(n)
+	Options = c
+
+	return changes
+}
+
+// Reload copies the settings of n that can change while running, the ones tagged reload:"live",
+// into c. It returns every setting that differs, secrets hidden.
+func (c *Config) Reload(n Config) []Change {
+	cur := collect(reflect.ValueOf(c).Elem(), "", nil)
+	next := collect(reflect.ValueOf(&n).Elem(), "", nil)
+
+	var changes []Change
+	for i, s := range cur {
+		if reflect.DeepEqual(s.field.Interface(), next[i].field.Interface()) {
+			continue
+		}
+
+		change := Change{
+			Setting: s.env,
+			Old:     format(s.field),
+			New:     format(next[i].field),
+			Live:    s.live,
+		}
+		if s.secret {
+			change.Old, change.New = "(hidden)", "(hidden)"
+		}
+		changes = append(changes, change)
+
+		if s.live {
+			s.field.Set(next[i].field)
+			c.Sources[s.env] = n.Sources[s.env]
+		}
+	}
+
+	return changes
+}
+
+// format prints a setting the way it is set
+func format(v reflect.Value) string {
+	if list, ok := v.Interface().([]string); ok {
+		return strings.Join(list, ",")
+	}
+
+	return fmt.Sprint(v.Interface())
+}
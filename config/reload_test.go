@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+// A well formed token of bot 468814860596019201
+const testToken = "NDY4ODE0ODYwNTk2MDE5MjAx.Dh1a2b.c3d4e5f6g7h8i9j0"
+
+func TestReloadOptions(t *testing.T) {
+	os.Setenv("KETI_DISCORD_TOKEN", testToken)
+	defer os.Unsetenv("KETI_DISCORD_TOKEN")
+
+	cfg, err := LoadArgs([]string{"--discord-log-channel=466629625167085571"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	Options = cfg
+	before := Current()
+
+	next, err := LoadArgs([]string{
+		"--debug",
+		"--discord-log-channel=",
+		"--discord-status-channel=466629625167085572",
+		"--discord-shard-count=3",
+		"--discord-ignored-events=TYPING_START",
+		"--broker-events-subject=keti.events",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := make(map[string]bool)
+	for _, c := range ReloadOptions(next) {
+		live[c.Setting] = c.Live
+	}
+	want := map[string]bool{
+		"KETI_DEBUG":                  true,
+		"KETI_DISCORD_LOG_CHANNEL":    true,
+		"KETI_DISCORD_STATUS_CHANNEL": true,
+		"KETI_DISCORD_SHARD_COUNT":    false,
+		"KETI_DISCORD_IGNORED_EVENTS": true,
+		"KETI_BROKER_EVENTS_SUBJECT":  true,
+	}
+	for setting, l := range want {
+		if got, ok := live[setting]; !ok || got != l {
+			t.Errorf("%s: reported %v (live %v), want live %v", setting, ok, got, l)
+		}
+	}
+	if len(live) != len(want) {
+		t.Errorf("Changes %v, want %v", live, want)
+	}
+
+	o := Current()
+	if !o.Debug || o.Discord.LogChan != "" || o.Discord.StatusChan != "466629625167085572" {
+		t.Errorf("Live settings not applied: debug %v, log channel %q, status channel %q", o.Debug, o.Discord.LogChan, o.Discord.StatusChan)
+	}
+	if len(o.Discord.IgnoredEvents) != 1 || o.Broker.EventsSubject != "keti.events" {
+		t.Errorf("Live settings not applied: ignored events %v, events subject %q", o.Discord.IgnoredEvents, o.Broker.EventsSubject)
+	}
+	if o.Discord.ShardCount != before.Discord.ShardCount {
+		t.Error("Settings requiring a restart were applied")
+	}
+	if o.Sources["KETI_DEBUG"] != SourceFlag {
+		t.Errorf("KETI_DEBUG source = %q, want %q", o.Sources["KETI_DEBUG"], SourceFlag)
+	}
+
+	// Copies taken before are left alone
+	if before.Debug || before.Discord.LogChan == "" || before.Sources["KETI_DEBUG"] == SourceFlag {
+		t.Error("Reloading changed a copy returned by Current")
+	}
+}
@@ -0,0 +1,276 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codechimp-io/keti/codec"
+)
+
+// FieldError is a problem with the value of a setting
+type FieldError struct {
+	// Environment variable name of the setting
+	Setting string
+
+	// Where the value came from, empty when it was not set
+	Source string
+
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("%s: %s", e.Setting, e.Err)
+	}
+
+	return fmt.Sprintf("%s (from %s): %s", e.Setting, e.Source, e.Err)
+}
+
+// Errors are the problems found loading the config, reported together
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks the settings against each other and returns every problem found.
+func (c *Config) Validate() Errors {
+	var errs Errors
+	fail := func(setting, format string, args ...interface{}) {
+		errs = append(errs, &FieldError{Setting: setting, Source: c.Sources[setting], Err: fmt.Errorf(format, args...)})
+	}
+
+	b := c.Broker
+	if b.Encoding != "" {
+		if _, err := codec.Encoder(b.Encoding); err != nil {
+			fail("KETI_BROKER_ENCODING", "%s", err)
+		}
+	}
+	subjects := []struct{ setting, subject string }{
+		{"KETI_BROKER_EVENTS_SUBJECT", b.EventsSubject},
+		{"KETI_BROKER_GUILD_JOINED_SUBJECT", b.GuildJoinedSubject},
+		{"KETI_BROKER_GUILD_AVAILABLE_SUBJECT", b.GuildAvailableSubject},
+		{"KETI_BROKER_GUILD_LEFT_SUBJECT", b.GuildLeftSubject},
+		{"KETI_BROKER_GUILD_UNAVAILABLE_SUBJECT", b.GuildUnavailableSubject},
+	}
+	for _, s := range subjects {
+		if s.subject == "" || strings.ContainsAny(s.subject, " \t\r\n*>") {
+			fail(s.setting, "%q is not a subject to publish on", s.subject)
+		}
+	}
+
+	switch b.Backpressure {
+	case "drop", "block":
+	case "disk":
+		if b.SpoolFile == "" {
+			fail("KETI_BROKER_SPOOL_FILE", "Required with the disk backpressure policy")
+		}
+	default:
+		fail("KETI_BROKER_BACKPRESSURE", "%q is not drop, disk or block", b.Backpressure)
+	}
+	if b.MaxPendingBytes < 0 {
+		fail("KETI_BROKER_MAX_PENDING_BYTES", "Cannot be negative")
+	}
+	if b.Backpressure == "block" && b.BlockTimeout <= 0 {
+		fail("KETI_BROKER_BLOCK_TIMEOUT", "Must be positive")
+	}
+	if b.SlowConsumerPending < 0 {
+		fail("KETI_BROKER_SLOW_CONSUMER_PENDING", "Cannot be negative")
+	}
+
+	d := c.Discord
+	if err := checkToken(d.Token); err != nil {
+		fail("KETI_DISCORD_TOKEN", "%s", err)
+	}
+
+	if d.ShardCount < 0 {
+		fail("KETI_DISCORD_SHARD_COUNT", "Cannot be negative")
+	}
+	if d.ShardOffset < 0 {
+		fail("KETI_DISCORD_SHARD_OFFSET", "Cannot be negative")
+	}
+	if d.ShardTotal < 0 {
+		fail("KETI_DISCORD_SHARD_TOTAL", "Cannot be negative")
+	}
+	if d.ShardCount > 0 && d.ShardOffset >= d.ShardCount {
+		// The shards run are the ones from the offset up to the count, excluded
+		fail("KETI_DISCORD_SHARD_OFFSET", "No shard to run from shard %d up to KETI_DISCORD_SHARD_COUNT %d", d.ShardOffset, d.ShardCount)
+	}
+	if d.ShardTotal > 0 {
+		if d.ShardCount > d.ShardTotal {
+			fail("KETI_DISCORD_SHARD_COUNT", "Shards %d to %d do not fit in the %d shards of KETI_DISCORD_SHARD_TOTAL", d.ShardOffset, d.ShardCount-1, d.ShardTotal)
+		}
+		if d.ShardOffset >= d.ShardTotal {
+			fail("KETI_DISCORD_SHARD_OFFSET", "Shard %d is out of the %d shards of KETI_DISCORD_SHARD_TOTAL", d.ShardOffset, d.ShardTotal)
+		}
+	}
+
+	if d.StatusChan != "" && !isSnowflake(d.StatusChan) {
+		fail("KETI_DISCORD_STATUS_CHANNEL", "%q is not a channel ID", d.StatusChan)
+	}
+	if d.LogChan != "" && !isSnowflake(d.LogChan) {
+		fail("KETI_DISCORD_LOG_CHANNEL", "%q is not a channel ID", d.LogChan)
+	}
+	if d.LargeThreshold < 50 || d.LargeThreshold > 250 {
+		fail("KETI_DISCORD_LARGE_THRESHOLD", "%d is not between 50 and 250", d.LargeThreshold)
+	}
+	if err := checkURL(d.APIURL, "http", "https"); err != nil {
+		fail("KETI_DISCORD_API_URL", "%s", err)
+	}
+	if _, err := strconv.Atoi(d.APIVersion); d.APIVersion != "" && err != nil {
+		fail("KETI_DISCORD_API_VERSION", "%q is not a version number, e.g. 10", d.APIVersion)
+	}
+	if err := checkURL(d.GatewayURL, "ws", "wss"); err != nil {
+		fail("KETI_DISCORD_GATEWAY_URL", "%s", err)
+	}
+	if d.Dedup.Enabled && d.Dedup.Size < 1 {
+		fail("KETI_DISCORD_DEDUP_SIZE", "Must be at least 1")
+	}
+
+	if cl := c.Cluster; cl.Enabled {
+		if cl.Heartbeat <= 0 {
+			fail("KETI_CLUSTER_HEARTBEAT", "Must be positive")
+		}
+		if cl.LeaseTTL <= cl.Heartbeat {
+			fail("KETI_CLUSTER_LEASE_TTL", "%s must be longer than the %s KETI_CLUSTER_HEARTBEAT", cl.LeaseTTL, cl.Heartbeat)
+		}
+		if cl.Coordinator && cl.Capacity < 1 {
+			fail("KETI_CLUSTER_CAPACITY", "Must be at least 1")
+		}
+		if !cl.Coordinator && d.ShardTotal < 1 {
+			// Standby instances only claim the orphaned shards among them
+			fail("KETI_DISCORD_SHARD_TOTAL", "Required when KETI_CLUSTER_ENABLED is set without KETI_CLUSTER_COORDINATOR")
+		}
+	}
+
+	if s := c.State; s.RedisAddr != "" && s.RedisQueue < 1 {
+		fail("KETI_STATE_REDIS_QUEUE", "Must be at least 1")
+	}
+
+	if i := c.Interactions; i.Addr != "" {
+		if key, err := hex.DecodeString(i.PublicKey); err != nil || len(key) != 32 {
+			fail("KETI_INTERACTIONS_PUBLIC_KEY", "A 64 characters hex key is required with KETI_INTERACTIONS_ADDR")
+		}
+	}
+
+	if c.RateLimit.GlobalLimit < 0 {
+		fail("KETI_RATELIMIT_GLOBAL_LIMIT", "Cannot be negative")
+	}
+	if p := c.Proxy; p.Addr != "" {
+		if err := checkURL(p.Upstream, "http", "https"); err != nil {
+			fail("KETI_PROXY_UPSTREAM", "%s", err)
+		}
+		if p.Retries < 0 {
+			fail("KETI_PROXY_RETRIES", "Cannot be negative")
+		}
+		if p.Secret == "" && !loopback(p.Addr) {
+			fail("KETI_PROXY_SECRET", "Required unless KETI_PROXY_ADDR is a loopback address, e.g. 127.0.0.1:8080")
+		}
+	}
+
+	if c.Shutdown.Timeout <= 0 {
+		fail("KETI_SHUTDOWN_TIMEOUT", "Must be positive")
+	}
+
+	settings := make([]string, 0, len(checks))
+	for setting := range checks {
+		settings = append(settings, setting)
+	}
+	sort.Strings(settings)
+	for _, setting := range settings {
+		if err := checks[setting](c); err != nil {
+			fail(setting, "%s", err)
+		}
+	}
+
+	return errs
+}
+
+// checks are the validations of the settings parsed by packages that import config, by setting
+var checks = make(map[string]func(c *Config) error)
+
+// RegisterCheck adds a validation of setting to Validate, for the settings parsed by the packages
+// using them, e.g. gateway intent names. It must be called from init functions.
+func RegisterCheck(setting string, check func(c *Config) error) {
+	checks[setting] = check
+}
+
+// loopback reports whether addr only listens on the local host.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkToken checks a bot token is made of the base64 encoded bot ID, a timestamp and an HMAC.
+func checkToken(token string) error {
+	if token == "" {
+		return errors.New("Required")
+	}
+	if strings.HasPrefix(token, "Bot ") {
+		return errors.New("Must not include the Bot prefix")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return errors.New("Malformed token, expected three parts separated by dots")
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil || !isSnowflake(string(id)) {
+		return errors.New("Malformed token, the first part is not a base64 encoded bot ID")
+	}
+
+	return nil
+}
+
+// checkURL checks an optional URL is absolute with one of the schemes.
+func checkURL(s string, schemes ...string) error {
+	if s == "" {
+		return nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && u.Host != "" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%q is not a %s URL", s, strings.Join(schemes, " or "))
+}
+
+func isSnowflake(s string) bool {
+	if s == "" || len(s) > 20 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
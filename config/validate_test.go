@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// invalid loads the config from args and returns the settings reported invalid.
+func invalid(t *testing.T, args ...string) []string {
+	t.Helper()
+
+	os.Setenv("KETI_DISCORD_TOKEN", testToken)
+	defer os.Unsetenv("KETI_DISCORD_TOKEN")
+
+	_, err := LoadArgs(args)
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("LoadArgs: %s", err)
+	}
+
+	var settings []string
+	for _, err := range errs {
+		fe, ok := err.(*FieldError)
+		if !ok {
+			t.Fatalf("Not a setting error: %s", err)
+		}
+		settings = append(settings, fe.Setting)
+	}
+	sort.Strings(settings)
+
+	return settings
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"lease mode without a shard total", []string{"--cluster-enabled"}, []string{"KETI_DISCORD_SHARD_TOTAL"}},
+		{"lease mode", []string{"--cluster-enabled", "--discord-shard-total=4"}, nil},
+		{"coordinator mode without a shard total", []string{"--cluster-enabled", "--cluster-coordinator"}, nil},
+		{"public proxy without a secret", []string{"--proxy-addr=:8080"}, []string{"KETI_PROXY_SECRET"}},
+		{"public proxy", []string{"--proxy-addr=:8080", "--proxy-secret=s3cret"}, nil},
+		{"loopback proxy", []string{"--proxy-addr=127.0.0.1:8080"}, nil},
+		{"localhost proxy", []string{"--proxy-addr=localhost:8080"}, nil},
+		{"proxy upstream", []string{"--proxy-addr=127.0.0.1:8080", "--proxy-upstream=discord.com"}, []string{"KETI_PROXY_UPSTREAM"}},
+		{"default shards", nil, nil},
+		{"empty shard range", []string{"--discord-shard-offset=2", "--discord-shard-count=2"}, []string{"KETI_DISCORD_SHARD_OFFSET"}},
+		{"shard range", []string{"--discord-shard-offset=2", "--discord-shard-count=4", "--discord-shard-total=4"}, nil},
+		{"shard range past the total", []string{"--discord-shard-offset=2", "--discord-shard-count=6", "--discord-shard-total=4"}, []string{"KETI_DISCORD_SHARD_COUNT"}},
+		{"broker encoding", []string{"--broker-encoding=xml"}, []string{"KETI_BROKER_ENCODING"}},
+		{"msgpack broker encoding", []string{"--broker-encoding=msgpack"}, nil},
+	}
+
+	for _, tt := range tests {
+		if got := invalid(t, tt.args...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: invalid settings %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateShardCount(t *testing.T) {
+	os.Setenv("KETI_DISCORD_TOKEN", testToken)
+	defer os.Unsetenv("KETI_DISCORD_TOKEN")
+
+	_, err := LoadArgs([]string{"--discord-shard-offset=2", "--discord-shard-count=6", "--discord-shard-total=4"})
+	if err == nil || !strings.Contains(err.Error(), "Shards 2 to 5 do not fit in the 4 shards") {
+		t.Errorf("Got %v, want shards 2 to 5 reported", err)
+	}
+}
+
+func TestRegisterCheck(t *testing.T) {
+	RegisterCheck("KETI_CAPTURE_FILE", func(c *Config) error {
+		if c.Capture.File == "invalid" {
+			return errors.New("Invalid")
+		}
+		return nil
+	})
+	defer delete(checks, "KETI_CAPTURE_FILE")
+
+	if got := invalid(t, "--capture-file=invalid"); !reflect.DeepEqual(got, []string{"KETI_CAPTURE_FILE"}) {
+		t.Errorf("Invalid settings %v, want the checked one", got)
+	}
+	if got := invalid(t, "--capture-file=valid"); got != nil {
+		t.Errorf("Invalid settings %v, want none", got)
+	}
+}
@@ -0,0 +1,159 @@
+package discord
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// DedupSubject is the broker subject instances sharing their deduplication stage publish
+// the identity keys of the dispatches they forward on, as JSON dedupShare messages
+const DedupSubject = "keti.dedup"
+
+// dedupShare is an identity key shared on DedupSubject
+type dedupShare struct {
+	// Instance which forwarded the dispatch, so that it skips its own keys
+	Instance string `json:"instance"`
+	Type     string `json:"t"`
+	ID       string `json:"id"`
+}
+
+// Dispatch types whose top-level "id" identifies a single occurrence,
+// used to catch duplicates coming from different sessions of the same shard
+var identityEvents = map[string]struct{}{
+	"CHANNEL_CREATE":     struct{}{},
+	"CHANNEL_DELETE":     struct{}{},
+	"INTERACTION_CREATE": struct{}{},
+	"MESSAGE_CREATE":     struct{}{},
+	"MESSAGE_DELETE":     struct{}{},
+	"THREAD_CREATE":      struct{}{},
+	"THREAD_DELETE":      struct{}{},
+}
+
+// dedupKey is either a sequence key (shard, session, seq) or an identity key (typ, id)
+type dedupKey struct {
+	shard   int
+	session string
+	seq     int64
+
+	typ string
+	id  string
+}
+
+type dedupEntry struct {
+	key     dedupKey
+	expires int64
+}
+
+// Deduper drops dispatches that were already forwarded within a time window, such as
+// the events Discord replays after a RESUME or the ones received twice while two
+// sessions own the same shard. Memory is bounded by the window and by Size.
+type Deduper struct {
+	sync.Mutex
+
+	// How long a dispatch is remembered
+	Window time.Duration
+
+	// Maximum number of keys remembered, the oldest ones are forgotten first
+	Size int
+
+	seen  map[dedupKey]int64
+	queue []dedupEntry
+	head  int
+}
+
+// NewDeduper creates a deduper remembering up to size keys for window.
+func NewDeduper(window time.Duration, size int) *Deduper {
+	return &Deduper{
+		Window: window,
+		Size:   size,
+		seen:   make(map[dedupKey]int64),
+	}
+}
+
+// Duplicate records the dispatch received by shard in session and reports whether it
+// was already seen, along with the kind of key that matched.
+func (d *Deduper) Duplicate(shard int, session string, e *discordgo.Event) (bool, string) {
+	now := time.Now().UnixNano()
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.expire(now)
+
+	if session != "" {
+		if d.record(dedupKey{shard: shard, session: session, seq: e.Sequence}, now) {
+			return true, "sequence"
+		}
+	}
+
+	if _, ok := identityEvents[e.Type]; ok {
+		if id := jsonTopLevelString(e.RawData, "id"); id != "" {
+			if d.record(dedupKey{typ: e.Type, id: id}, now) {
+				return true, "identity"
+			}
+		}
+	}
+
+	return false, ""
+}
+
+// Observe records an identity key seen elsewhere, e.g. published by another instance.
+func (d *Deduper) Observe(typ, id string) {
+	if _, ok := identityEvents[typ]; !ok || id == "" {
+		return
+	}
+
+	now := time.Now().UnixNano()
+
+	d.Lock()
+	d.expire(now)
+	d.record(dedupKey{typ: typ, id: id}, now)
+	d.Unlock()
+}
+
+// Len returns the number of keys remembered.
+func (d *Deduper) Len() int {
+	d.Lock()
+	defer d.Unlock()
+
+	return len(d.seen)
+}
+
+// record stores the key and reports whether it was already present and not expired.
+func (d *Deduper) record(k dedupKey, now int64) bool {
+	if exp, ok := d.seen[k]; ok && exp > now {
+		return true
+	}
+
+	exp := now + int64(d.Window)
+	d.seen[k] = exp
+	d.queue = append(d.queue, dedupEntry{k, exp})
+
+	return false
+}
+
+// expire forgets keys past the window or beyond the size limit.
+func (d *Deduper) expire(now int64) {
+	for d.head < len(d.queue) {
+		e := d.queue[d.head]
+		if e.expires > now && (d.Size <= 0 || len(d.seen) < d.Size) {
+			break
+		}
+
+		// Only delete if the key was not recorded again later
+		if d.seen[e.key] == e.expires {
+			delete(d.seen, e.key)
+		}
+		d.queue[d.head] = dedupEntry{}
+		d.head++
+	}
+
+	// Compact the queue once the consumed half gets large
+	if d.head > 1024 && d.head*2 > len(d.queue) {
+		n := copy(d.queue, d.queue[d.head:])
+		d.queue = d.queue[:n]
+		d.head = 0
+	}
+}
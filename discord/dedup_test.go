@@ -0,0 +1,163 @@
+package discord
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/nats-io/go-nats"
+)
+
+func dedupEvent(typ string, seq int64, id string) *discordgo.Event {
+	e := &discordgo.Event{Type: typ, Sequence: seq, RawData: []byte(`{}`)}
+	if id != "" {
+		e.RawData = []byte(`{"id":"` + id + `","content":"hi"}`)
+	}
+
+	return e
+}
+
+func TestDeduperKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		shard   int
+		session string
+		event   *discordgo.Event
+		dup     bool
+		key     string
+	}{
+		{"first", 0, "a", dedupEvent("MESSAGE_CREATE", 1, "100"), false, ""},
+		{"replayed after a resume", 0, "a", dedupEvent("MESSAGE_CREATE", 1, "100"), true, "sequence"},
+		{"same sequence on another shard", 1, "a", dedupEvent("GUILD_UPDATE", 1, ""), false, ""},
+		{"same sequence in another session", 0, "b", dedupEvent("GUILD_UPDATE", 1, ""), false, ""},
+		{"same message from another session", 0, "c", dedupEvent("MESSAGE_CREATE", 7, "100"), true, "identity"},
+		{"same id, other type", 0, "c", dedupEvent("MESSAGE_DELETE", 8, "100"), false, ""},
+		{"ids of other types are ignored", 0, "c", dedupEvent("GUILD_UPDATE", 9, "100"), false, ""},
+		{"no session", 0, "", dedupEvent("GUILD_UPDATE", 9, ""), false, ""},
+		{"no session, again", 0, "", dedupEvent("GUILD_UPDATE", 9, ""), false, ""},
+	}
+
+	d := NewDeduper(time.Minute, 100)
+	for _, tt := range tests {
+		dup, key := d.Duplicate(tt.shard, tt.session, tt.event)
+		if dup != tt.dup || key != tt.key {
+			t.Errorf("%s: got %v %q, want %v %q", tt.name, dup, key, tt.dup, tt.key)
+		}
+	}
+}
+
+func TestDeduperWindow(t *testing.T) {
+	d := NewDeduper(50*time.Millisecond, 100)
+
+	e := dedupEvent("MESSAGE_CREATE", 1, "100")
+	d.Duplicate(0, "a", e)
+	if d.Len() != 2 {
+		t.Fatalf("%d keys, want the sequence and identity keys", d.Len())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if dup, _ := d.Duplicate(0, "a", e); dup {
+		t.Error("Duplicate after the window")
+	}
+	if d.Len() != 2 {
+		t.Errorf("%d keys after the window, want the 2 recorded again", d.Len())
+	}
+}
+
+func TestDeduperSize(t *testing.T) {
+	d := NewDeduper(time.Minute, 3)
+
+	for seq := int64(1); seq <= 10; seq++ {
+		d.Duplicate(0, "a", dedupEvent("GUILD_UPDATE", seq, ""))
+		if n := d.Len(); n > 3 {
+			t.Fatalf("%d keys, want at most 3", n)
+		}
+	}
+
+	// The oldest keys are forgotten first
+	if dup, _ := d.Duplicate(0, "a", dedupEvent("GUILD_UPDATE", 10, "")); !dup {
+		t.Error("Newest key forgotten")
+	}
+	if dup, _ := d.Duplicate(0, "a", dedupEvent("GUILD_UPDATE", 1, "")); dup {
+		t.Error("Oldest key kept")
+	}
+}
+
+func TestDeduperQueue(t *testing.T) {
+	d := NewDeduper(time.Minute, 0)
+
+	for i := 0; i < 5000; i++ {
+		d.Observe("MESSAGE_CREATE", strconv.Itoa(i))
+	}
+	if d.Len() != 5000 {
+		t.Fatalf("%d keys, want 5000 without a size limit", d.Len())
+	}
+
+	// Expiring the whole queue compacts it
+	d.Lock()
+	d.expire(time.Now().Add(2 * time.Minute).UnixNano())
+	queued, head := len(d.queue), d.head
+	d.Unlock()
+	if d.Len() != 0 || queued != 0 || head != 0 {
+		t.Errorf("%d keys, %d queued from %d after expiring everything", d.Len(), queued, head)
+	}
+}
+
+func TestOnDedupShare(t *testing.T) {
+	m := New("Bot token", nil)
+	m.Deduper = NewDeduper(time.Minute, 100)
+
+	share := func(instance, id string) *nats.Msg {
+		data, _ := json.Marshal(dedupShare{Instance: instance, Type: "MESSAGE_CREATE", ID: id})
+		return &nats.Msg{Subject: DedupSubject, Data: data}
+	}
+	m.OnDedupShare(share("other", "100"))
+	m.OnDedupShare(share(m.instance, "101"))
+	m.OnDedupShare(&nats.Msg{Subject: DedupSubject, Data: []byte("{")})
+
+	if dup, key := m.Deduper.Duplicate(0, "a", dedupEvent("MESSAGE_CREATE", 1, "100")); !dup || key != "identity" {
+		t.Errorf("Key shared by another instance: got %v %q, want a duplicate", dup, key)
+	}
+	if dup, _ := m.Deduper.Duplicate(0, "a", dedupEvent("MESSAGE_CREATE", 2, "101")); dup {
+		t.Error("Key shared by this instance recorded")
+	}
+}
+
+func TestShareDedup(t *testing.T) {
+	_, nc := startBroker(t)
+
+	shared := make(chan *nats.Msg, 10)
+	if _, err := nc.Conn.ChanSubscribe(DedupSubject, shared); err != nil {
+		t.Fatal(err)
+	}
+	nc.Flush()
+
+	m := New("Bot token", nc)
+	m.Deduper = NewDeduper(time.Minute, 100)
+	m.ShareDedup = true
+
+	m.publishEvent(m.Routing(), 0, "a", "80351110224678912", dedupEvent("GUILD_UPDATE", 1, "41771983423143937"))
+	m.publishEvent(m.Routing(), 0, "a", "80351110224678912", dedupEvent("MESSAGE_CREATE", 2, "100"))
+	m.publishEvent(m.Routing(), 0, "b", "80351110224678912", dedupEvent("MESSAGE_CREATE", 1, "100"))
+
+	// Only the forwarded dispatch with an identity key is shared
+	select {
+	case msg := <-shared:
+		var k dedupShare
+		if err := json.Unmarshal(msg.Data, &k); err != nil {
+			t.Fatal(err)
+		}
+		if k != (dedupShare{Instance: m.instance, Type: "MESSAGE_CREATE", ID: "100"}) {
+			t.Errorf("Shared %+v", k)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing shared")
+	}
+	select {
+	case msg := <-shared:
+		t.Errorf("Shared %s", msg.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,407 @@
+package discordtest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// Gateway opcodes
+const (
+	opDispatch       = 0
+	opHeartbeat      = 1
+	opIdentify       = 2
+	opResume         = 6
+	opReconnect      = 7
+	opInvalidSession = 9
+	opHello          = 10
+	opHeartbeatAck   = 11
+)
+
+// Gateway close codes sent by the server
+const (
+	closeUnknownOpcode    = 4001
+	closeDecodeError      = 4002
+	closeNotAuthenticated = 4003
+	closeAuthFailed       = 4004
+	closeInvalidShard     = 4010
+)
+
+// resumable reports whether a session survives a connection closed with code
+func resumable(code int) bool {
+	switch code {
+	case websocket.CloseNormalClosure, websocket.CloseGoingAway, 4004, 4007, 4009, 4010, 4011, 4012, 4013, 4014:
+		return false
+	}
+
+	return true
+}
+
+// session is a gateway session, kept across the connections resuming it
+type session struct {
+	sync.Mutex
+
+	id    string
+	shard int
+	total int
+
+	// Payloads of the dispatches sent, the one of sequence n at n-1
+	sent [][]byte
+}
+
+// conn is a websocket connection of a shard
+type conn struct {
+	s  *Server
+	ws *websocket.Conn
+
+	// Set on connections asking for zlib-stream, one context for the whole connection
+	z    *zlib.Writer
+	zbuf bytes.Buffer
+	wmu  sync.Mutex
+
+	// Set once the shard is ready, guarded by the server lock
+	session *session
+}
+
+// payload is a gateway message
+type payload struct {
+	Operation int             `json:"op"`
+	Data      json.RawMessage `json:"d"`
+	Sequence  int64           `json:"s,omitempty"`
+	Type      string          `json:"t,omitempty"`
+}
+
+func (s *Server) serveGateway(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &conn{s: s, ws: ws}
+	if r.URL.Query().Get("compress") == "zlib-stream" {
+		c.z = zlib.NewWriter(&c.zbuf)
+	}
+	defer c.disconnect()
+
+	if err := c.send(opHello, map[string]interface{}{
+		"heartbeat_interval": s.HeartbeatInterval / time.Millisecond,
+	}); err != nil {
+		return
+	}
+
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			if ce, ok := err.(*websocket.CloseError); ok && !resumable(ce.Code) {
+				c.endSession()
+			}
+			return
+		}
+
+		var p payload
+		if err := json.Unmarshal(msg, &p); err != nil {
+			c.close(closeDecodeError)
+			return
+		}
+
+		s.mu.Lock()
+		ready := c.session != nil
+		s.mu.Unlock()
+
+		switch p.Operation {
+		case opHeartbeat:
+			err = c.send(opHeartbeatAck, nil)
+		case opIdentify:
+			err = c.identify(p.Data)
+		case opResume:
+			err = c.resume(p.Data)
+		case 3, 4, 8:
+			// Presence, voice state and guild members requests are accepted and ignored
+			if !ready {
+				c.close(closeNotAuthenticated)
+				return
+			}
+		default:
+			code := closeUnknownOpcode
+			if !ready {
+				code = closeNotAuthenticated
+			}
+			c.close(code)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// identify starts a new session, sending READY, the guilds of the shard and the script.
+func (c *conn) identify(data json.RawMessage) error {
+	s := c.s
+
+	// The presence is left out, discordgo cannot decode the activities it encodes
+	var p struct {
+		Token          string                       `json:"token"`
+		Properties     discordgo.IdentifyProperties `json:"properties"`
+		Compress       bool                         `json:"compress"`
+		LargeThreshold int                          `json:"large_threshold"`
+		Shard          *[2]int                      `json:"shard"`
+		Intents        discordgo.Intent             `json:"intents"`
+	}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return c.close(closeDecodeError)
+	}
+	id := discordgo.Identify{
+		Token:          p.Token,
+		Properties:     p.Properties,
+		Compress:       p.Compress,
+		LargeThreshold: p.LargeThreshold,
+		Shard:          p.Shard,
+		Intents:        p.Intents,
+	}
+	if !s.validToken(id.Token) {
+		return c.close(closeAuthFailed)
+	}
+	shard := [2]int{0, 1}
+	if id.Shard != nil {
+		shard = *id.Shard
+	}
+	if shard[1] < 1 || shard[0] < 0 || shard[0] >= shard[1] {
+		return c.close(closeInvalidShard)
+	}
+
+	sess := &session{id: newSessionID(), shard: shard[0], total: shard[1]}
+
+	var guilds []map[string]interface{}
+	var owned []string
+	for _, g := range s.Guilds {
+		n, _ := strconv.ParseUint(g, 10, 64)
+		if int((n>>22)%uint64(shard[1])) == shard[0] {
+			guilds = append(guilds, map[string]interface{}{"id": g, "unavailable": true})
+			owned = append(owned, g)
+		}
+	}
+
+	s.mu.Lock()
+	s.identifies = append(s.identifies, id)
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+
+	c.ready(sess)
+
+	err := c.dispatch("READY", map[string]interface{}{
+		"v":                  10,
+		"session_id":         sess.id,
+		"resume_gateway_url": s.GatewayURL,
+		"user":               &s.User,
+		"shard":              shard,
+		"guilds":             guilds,
+		"private_channels":   []interface{}{},
+		"application":        map[string]interface{}{"id": s.User.ID, "flags": s.ApplicationFlags},
+	})
+	for _, g := range owned {
+		if err != nil {
+			return err
+		}
+		err = c.dispatch("GUILD_CREATE", map[string]interface{}{
+			"id":           g,
+			"name":         "Guild " + g,
+			"unavailable":  false,
+			"member_count": 1,
+			"channels":     []interface{}{},
+			"roles":        []interface{}{},
+			"members":      []interface{}{},
+		})
+	}
+	for _, d := range s.Script {
+		if err != nil {
+			return err
+		}
+		err = c.dispatch(d.Type, d.Data)
+	}
+
+	return err
+}
+
+// resume takes over a session, replaying the dispatches after the given sequence then RESUMED.
+func (c *conn) resume(data json.RawMessage) error {
+	s := c.s
+
+	var r struct {
+		Token     string `json:"token"`
+		SessionID string `json:"session_id"`
+		Sequence  int64  `json:"seq"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return c.close(closeDecodeError)
+	}
+	if !s.validToken(r.Token) {
+		return c.close(closeAuthFailed)
+	}
+
+	s.mu.Lock()
+	sess, ok := s.sessions[r.SessionID]
+	s.mu.Unlock()
+	if !ok {
+		return c.send(opInvalidSession, false)
+	}
+
+	sess.Lock()
+	var missed [][]byte
+	if r.Sequence >= 0 && r.Sequence <= int64(len(sess.sent)) {
+		missed = append(missed, sess.sent[r.Sequence:]...)
+	} else {
+		ok = false
+	}
+	sess.Unlock()
+	if !ok {
+		return c.send(opInvalidSession, false)
+	}
+
+	s.mu.Lock()
+	s.resumes++
+	s.mu.Unlock()
+
+	c.ready(sess)
+
+	for _, msg := range missed {
+		if err := c.write(msg); err != nil {
+			return err
+		}
+	}
+
+	return c.dispatch("RESUMED", nil)
+}
+
+// ready makes the connection the one of the session's shard, closing the one it replaces.
+func (c *conn) ready(sess *session) {
+	s := c.s
+
+	s.mu.Lock()
+	old := s.conns[sess.shard]
+	c.session = sess
+	s.conns[sess.shard] = c
+	s.notify()
+	s.mu.Unlock()
+
+	if old != nil && old != c {
+		old.ws.Close()
+	}
+}
+
+// disconnect forgets the connection once it is closed.
+func (c *conn) disconnect() {
+	c.ws.Close()
+
+	s := c.s
+	s.mu.Lock()
+	if c.session != nil && s.conns[c.session.shard] == c {
+		delete(s.conns, c.session.shard)
+	}
+	s.mu.Unlock()
+}
+
+// endSession forgets the session of the connection, it cannot be resumed anymore.
+func (c *conn) endSession() {
+	s := c.s
+	s.mu.Lock()
+	if c.session != nil {
+		delete(s.sessions, c.session.id)
+	}
+	s.mu.Unlock()
+}
+
+// dispatch sends an event with the next sequence of the session, keeping it for resumes.
+func (c *conn) dispatch(typ string, data interface{}) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	c.s.mu.Lock()
+	sess := c.session
+	c.s.mu.Unlock()
+
+	sess.Lock()
+	defer sess.Unlock()
+
+	msg, err := json.Marshal(&payload{
+		Operation: opDispatch,
+		Data:      d,
+		Sequence:  int64(len(sess.sent)) + 1,
+		Type:      typ,
+	})
+	if err != nil {
+		return err
+	}
+	sess.sent = append(sess.sent, msg)
+
+	return c.write(msg)
+}
+
+func (c *conn) send(op int, data interface{}) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(&payload{Operation: op, Data: d})
+	if err != nil {
+		return err
+	}
+
+	return c.write(msg)
+}
+
+// write sends a payload, compressed if the connection asked for it.
+func (c *conn) write(msg []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.z == nil {
+		return c.ws.WriteMessage(websocket.TextMessage, msg)
+	}
+
+	c.zbuf.Reset()
+	if _, err := c.z.Write(msg); err != nil {
+		return err
+	}
+	if err := c.z.Flush(); err != nil {
+		return err
+	}
+
+	return c.ws.WriteMessage(websocket.BinaryMessage, c.zbuf.Bytes())
+}
+
+// close sends a close code and closes the connection.
+func (c *conn) close(code int) error {
+	c.wmu.Lock()
+	err := c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+	c.wmu.Unlock()
+
+	if e := c.ws.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+func (s *Server) validToken(token string) bool {
+	return s.Token == "" || strings.TrimPrefix(token, "Bot ") == s.Token
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,289 @@
+// Package discordtest provides a fake Discord gateway to run shards and managers against in tests.
+// It speaks enough of the gateway protocol for discordgo sessions and raw shards: HELLO, IDENTIFY,
+// READY, heartbeats, RESUME with replay of the missed dispatches, scripted dispatches and close codes,
+// along with the REST routes used to find the gateway.
+//
+// A manager is pointed at it with its endpoints:
+//
+//	srv := discordtest.NewServer()
+//	defer srv.Close()
+//
+//	m := discord.New("Bot "+token, nsc)
+//	m.Endpoints = &discord.Endpoints{API: srv.URL}
+//	m.Init()
+package discordtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// Dispatch is a gateway event sent to shards
+type Dispatch struct {
+	Type string
+	Data interface{}
+}
+
+// Server is a fake Discord gateway. Its fields are read when shards connect,
+// set them before connecting any.
+type Server struct {
+	// Token expected in IDENTIFY and RESUME, without the Bot prefix. Any token is accepted when empty,
+	// others are closed with 4004.
+	Token string
+
+	// Shard count recommended by /gateway/bot
+	Shards int
+
+	// Heartbeat interval sent in HELLO
+	HeartbeatInterval time.Duration
+
+	// Bot user sent in READY
+	User discordgo.User
+
+	// Application flags returned by /applications/@me, the privileged intents are enabled by default
+	ApplicationFlags int
+
+	// Guilds announced as unavailable in READY, then sent as GUILD_CREATE, to the shard they belong to
+	Guilds []string
+
+	// Dispatches sent to every new session after its guilds
+	Script []Dispatch
+
+	// Base URL of the REST API without the version, e.g. http://127.0.0.1:1234/api
+	URL string
+
+	// Gateway URL returned by /gateway and /gateway/bot
+	GatewayURL string
+
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu         sync.Mutex
+	conns      map[int]*conn
+	sessions   map[string]*session
+	identifies []discordgo.Identify
+	resumes    int
+
+	// Closed and replaced whenever a shard becomes ready, see WaitReady
+	changed chan struct{}
+}
+
+// NewServer starts a fake gateway on a local port, it must be closed with Close.
+func NewServer() *Server {
+	s := &Server{
+		Shards:            1,
+		HeartbeatInterval: 41250 * time.Millisecond,
+		User: discordgo.User{
+			ID:            "111111111111111111",
+			Username:      "keti",
+			Discriminator: "0",
+			Bot:           true,
+		},
+		// Presence, guild members and message content
+		ApplicationFlags: 1<<12 | 1<<14 | 1<<18,
+
+		conns:    make(map[int]*conn),
+		sessions: make(map[string]*session),
+		changed:  make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/", s.serveGateway)
+	mux.HandleFunc("/api/", s.serveAPI)
+	s.srv = httptest.NewServer(mux)
+
+	s.URL = s.srv.URL + "/api"
+	s.GatewayURL = "ws" + strings.TrimPrefix(s.srv.URL, "http") + "/ws/"
+
+	return s
+}
+
+// Close disconnects the shards and stops the server.
+func (s *Server) Close() {
+	s.mu.Lock()
+	for _, c := range s.conns {
+		c.ws.Close()
+	}
+	s.mu.Unlock()
+
+	s.srv.Close()
+}
+
+// serveAPI answers the REST routes a shard manager needs, any other route is not found.
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "Bot "+s.Token {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"message": "401: Unauthorized", "code": 0})
+		return
+	}
+
+	// Any API version
+	path := strings.TrimPrefix(r.URL.Path, "/api/")
+	if i := strings.IndexByte(path, '/'); strings.HasPrefix(path, "v") && i > 0 {
+		path = path[i+1:]
+	}
+
+	switch path {
+	case "gateway":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"url": s.GatewayURL})
+	case "gateway/bot":
+		writeJSON(w, http.StatusOK, &discordgo.GatewayBotResponse{
+			URL:    s.GatewayURL,
+			Shards: s.Shards,
+			SessionStartLimit: discordgo.SessionInformation{
+				Total:          1000,
+				Remaining:      1000,
+				ResetAfter:     int(24 * time.Hour / time.Millisecond),
+				MaxConcurrency: 1,
+			},
+		})
+	case "applications/@me", "oauth2/applications/@me":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":    s.User.ID,
+			"name":  s.User.Username,
+			"flags": s.ApplicationFlags,
+		})
+	case "users/@me":
+		writeJSON(w, http.StatusOK, &s.User)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "404: Not Found", "code": 0})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Identifies returns the IDENTIFY payloads received, in order.
+func (s *Server) Identifies() []discordgo.Identify {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]discordgo.Identify(nil), s.identifies...)
+}
+
+// Resumes returns the number of sessions successfully resumed.
+func (s *Server) Resumes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.resumes
+}
+
+// SessionID returns the gateway session of the shard, empty if it is not connected.
+func (s *Server) SessionID(shard int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.conns[shard]; ok && c.session != nil {
+		return c.session.id
+	}
+
+	return ""
+}
+
+// WaitReady waits until the shard has identified or resumed, and got its READY or RESUMED.
+func (s *Server) WaitReady(shard int, timeout time.Duration) error {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		s.mu.Lock()
+		c, ok := s.conns[shard]
+		ready := ok && c.session != nil
+		changed := s.changed
+		s.mu.Unlock()
+
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-t.C:
+			return fmt.Errorf("Shard %d not ready after %s", shard, timeout)
+		}
+	}
+}
+
+// Dispatch sends an event to the shard. It is kept in the session, to be replayed if the shard resumes
+// from an earlier sequence.
+func (s *Server) Dispatch(shard int, typ string, data interface{}) error {
+	c, err := s.conn(shard)
+	if err != nil {
+		return err
+	}
+
+	return c.dispatch(typ, data)
+}
+
+// Disconnect closes the connection of the shard with a close code. The session is forgotten
+// for the codes after which Discord does not allow resuming, e.g. 4007 and 4009.
+func (s *Server) Disconnect(shard, code int) error {
+	c, err := s.conn(shard)
+	if err != nil {
+		return err
+	}
+
+	if !resumable(code) {
+		s.mu.Lock()
+		delete(s.sessions, c.session.id)
+		s.mu.Unlock()
+	}
+
+	return c.close(code)
+}
+
+// Reconnect asks the shard to reconnect and resume, with op 7.
+func (s *Server) Reconnect(shard int) error {
+	c, err := s.conn(shard)
+	if err != nil {
+		return err
+	}
+
+	return c.send(opReconnect, nil)
+}
+
+// InvalidateSession sends op 9 to the shard, forgetting its session unless resumable is set.
+func (s *Server) InvalidateSession(shard int, resumable bool) error {
+	c, err := s.conn(shard)
+	if err != nil {
+		return err
+	}
+
+	if !resumable {
+		s.mu.Lock()
+		delete(s.sessions, c.session.id)
+		s.mu.Unlock()
+	}
+
+	return c.send(opInvalidSession, resumable)
+}
+
+// conn returns the ready connection of the shard.
+func (s *Server) conn(shard int) (*conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.conns[shard]
+	if !ok || c.session == nil {
+		return nil, fmt.Errorf("Shard %d is not connected", shard)
+	}
+
+	return c, nil
+}
+
+// notify wakes up WaitReady, it must be called with the lock held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
@@ -0,0 +1,129 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Endpoints points sessions at another REST API and gateway than Discord's, e.g. a local stand-in
+// or a gateway cache. discordgo's package level endpoints are left alone, the requests are rewritten
+// by the HTTP transport of the sessions instead.
+type Endpoints struct {
+	// Base URL of the REST API without the version, e.g. http://localhost:8080/api, Discord's when empty
+	API string
+
+	// API version of the REST calls and of raw shards, discordgo's when empty.
+	// discordgo sessions always connect to the gateway version they decode.
+	Version string
+
+	// Gateway URL, the one returned by the REST API when empty
+	Gateway string
+}
+
+// Apply makes the REST calls of s go to the endpoints, it does nothing if e is nil.
+func (e *Endpoints) Apply(s *discordgo.Session) {
+	if e == nil {
+		return
+	}
+	if _, ok := s.Client.Transport.(*endpointsTransport); ok {
+		return
+	}
+
+	client := *s.Client
+	client.Transport = &endpointsTransport{Endpoints: e, base: s.Client.Transport}
+	s.Client = &client
+}
+
+// version returns the API version in use.
+func (e *Endpoints) version() string {
+	if e == nil || e.Version == "" {
+		return discordgo.APIVersion
+	}
+
+	return e.Version
+}
+
+// apiURL returns the versioned base URL of the REST API, with a trailing slash.
+func (e *Endpoints) apiURL() string {
+	api := strings.TrimSuffix(discordgo.EndpointDiscord, "/") + "/api"
+	if e.API != "" {
+		api = strings.TrimSuffix(e.API, "/")
+	}
+
+	return api + "/v" + e.version() + "/"
+}
+
+// endpointsTransport rewrites the requests to discordgo's API endpoints
+type endpointsTransport struct {
+	*Endpoints
+
+	// Used for the requests, http.DefaultTransport if nil
+	base http.RoundTripper
+}
+
+// RoundTrip sends the request to the configured API, answering gateway lookups with the configured gateway.
+func (t *endpointsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	route := strings.TrimPrefix(req.URL.String(), discordgo.EndpointAPI)
+	if route == req.URL.String() {
+		// Not an API call, e.g. the CDN
+		return base.RoundTrip(req)
+	}
+
+	if t.Gateway != "" && req.Method == http.MethodGet && route == "gateway" {
+		return jsonResponse(req, map[string]string{"url": t.Gateway})
+	}
+
+	u, err := url.Parse(t.apiURL() + route)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.URL = u
+	req.Host = u.Host
+
+	resp, err := base.RoundTrip(req)
+	if err != nil || t.Gateway == "" || route != "gateway/bot" || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	// Keep the recommended shards, with the configured gateway
+	var gb map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&gb)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	gb["url"] = t.Gateway
+
+	return jsonResponse(req, gb)
+}
+
+func jsonResponse(req *http.Request, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
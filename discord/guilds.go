@@ -0,0 +1,234 @@
+package discord
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// GuildsLoadedSubject is the broker subject GuildsLoaded notifications are published on, as JSON
+const GuildsLoadedSubject = "keti.shard.guilds_loaded"
+
+// Default broker subjects guild lifecycle events are published on, in addition to EventsSubject.
+// They carry the same gateway event as the GUILD_CREATE or GUILD_DELETE it derives from.
+const (
+	// The bot was added to the guild
+	GuildJoinedSubject = "guild.joined"
+
+	// The guild was announced in READY, or came back after an outage
+	GuildAvailableSubject = "guild.available"
+
+	// The bot was removed from the guild
+	GuildLeftSubject = "guild.left"
+
+	// The guild became unavailable because of an outage
+	GuildUnavailableSubject = "guild.unavailable"
+)
+
+// GuildJoinWindow is how recent joined_at must be for a guild unknown to the shard to count as joined,
+// used when the shard resumed a session this instance did not see the READY of
+var GuildJoinWindow = time.Minute
+
+// GuildsLoaded is published once a shard received the guilds announced in READY
+type GuildsLoaded struct {
+	Shard      int `json:"shard"`
+	ShardTotal int `json:"shard_total"`
+
+	// Guilds announced in READY, the ones received since and the ones still missing at the timeout
+	Guilds  int `json:"guilds"`
+	Loaded  int `json:"loaded"`
+	Missing int `json:"missing"`
+
+	TimedOut bool          `json:"timed_out"`
+	Duration time.Duration `json:"duration"`
+	Time     time.Time     `json:"time"`
+}
+
+// shardGuilds is the guild set and loading state of a shard since its last READY
+type shardGuilds struct {
+	// Guilds of the shard, true when available
+	guilds map[string]bool
+
+	// Set when the guild set comes from READY, rather than from events seen after a resume
+	complete bool
+
+	pending map[string]struct{}
+	total   int
+	started time.Time
+	timer   *time.Timer
+}
+
+// guildTracker follows the GUILD_CREATE stream following READY on every shard
+type guildTracker struct {
+	sync.Mutex
+
+	shards map[int]*shardGuilds
+}
+
+// trackGuilds updates the guild set and loading state of the shard from a dispatch,
+// and returns the lifecycle subject of guild creations and deletions in r.
+func (m *Manager) trackGuilds(r *Routing, shard int, e *discordgo.Event) string {
+	switch e.Type {
+	case "READY":
+		var r struct {
+			Guilds []struct {
+				ID string `json:"id"`
+			} `json:"guilds"`
+		}
+		if err := json.Unmarshal(e.RawData, &r); err != nil {
+			m.handleError(err, shard, "Failed decoding READY guilds")
+			return ""
+		}
+
+		sg := &shardGuilds{
+			guilds:   make(map[string]bool, len(r.Guilds)),
+			complete: true,
+			pending:  make(map[string]struct{}, len(r.Guilds)),
+			total:    len(r.Guilds),
+			started:  time.Now(),
+		}
+		for _, g := range r.Guilds {
+			sg.guilds[g.ID] = false
+			sg.pending[g.ID] = struct{}{}
+		}
+
+		m.guilds.Lock()
+		if prev, ok := m.guilds.shards[shard]; ok && prev.timer != nil {
+			prev.timer.Stop()
+		}
+		m.guilds.shards[shard] = sg
+		if len(sg.pending) > 0 && m.GuildsLoadTimeout > 0 {
+			sg.timer = time.AfterFunc(m.GuildsLoadTimeout, func() { m.guildsLoaded(shard, sg, true) })
+		}
+		m.guilds.Unlock()
+
+		if len(sg.pending) == 0 {
+			m.guildsLoaded(shard, sg, false)
+		}
+
+	case "GUILD_CREATE":
+		id := jsonTopLevelString(e.RawData, "id")
+		if string(jsonTopLevel(e.RawData, "unavailable")) == "true" {
+			// Still in an outage
+			return ""
+		}
+
+		m.guilds.Lock()
+		sg := m.shardGuilds(shard)
+		available, known := sg.guilds[id]
+		sg.guilds[id] = true
+
+		subject := r.GuildJoined
+		switch {
+		case known && available:
+			// Replayed, e.g. after a resume
+			subject = ""
+		case known:
+			subject = r.GuildAvailable
+		case !sg.complete && !recentlyJoined(e.RawData):
+			subject = r.GuildAvailable
+		}
+
+		done := false
+		if sg.pending != nil {
+			if _, pending := sg.pending[id]; pending {
+				delete(sg.pending, id)
+				done = len(sg.pending) == 0
+			}
+		}
+		m.guilds.Unlock()
+
+		if done {
+			m.guildsLoaded(shard, sg, false)
+		}
+
+		return subject
+
+	case "GUILD_DELETE":
+		id := jsonTopLevelString(e.RawData, "id")
+
+		m.guilds.Lock()
+		defer m.guilds.Unlock()
+
+		sg := m.shardGuilds(shard)
+		if string(jsonTopLevel(e.RawData, "unavailable")) == "true" {
+			sg.guilds[id] = false
+			return r.GuildUnavailable
+		}
+
+		delete(sg.guilds, id)
+		return r.GuildLeft
+	}
+
+	return ""
+}
+
+// shardGuilds returns the guild state of the shard, creating an incomplete one
+// if no READY was seen. It must be called with the tracker lock held.
+func (m *Manager) shardGuilds(shard int) *shardGuilds {
+	sg, ok := m.guilds.shards[shard]
+	if !ok {
+		sg = &shardGuilds{guilds: make(map[string]bool)}
+		m.guilds.shards[shard] = sg
+	}
+
+	return sg
+}
+
+// recentlyJoined reports whether the joined_at of a GUILD_CREATE is within GuildJoinWindow.
+func recentlyJoined(data []byte) bool {
+	joinedAt, err := time.Parse(time.RFC3339, jsonTopLevelString(data, "joined_at"))
+	if err != nil {
+		return false
+	}
+
+	return time.Since(joinedAt) < GuildJoinWindow
+}
+
+// guildsLoaded emits and publishes the end of the guild loading of sg, once.
+func (m *Manager) guildsLoaded(shard int, sg *shardGuilds, timedOut bool) {
+	m.guilds.Lock()
+	if sg.pending == nil || m.guilds.shards[shard] != sg {
+		// Already reported, or superseded by a new READY
+		m.guilds.Unlock()
+		return
+	}
+	if sg.timer != nil {
+		sg.timer.Stop()
+	}
+
+	now := time.Now()
+	gl := &GuildsLoaded{
+		Shard:      shard,
+		ShardTotal: m.GetShardsTotal(),
+		Guilds:     sg.total,
+		Loaded:     sg.total - len(sg.pending),
+		Missing:    len(sg.pending),
+		TimedOut:   timedOut,
+		Duration:   now.Sub(sg.started),
+		Time:       now,
+	}
+	sg.pending = nil
+	m.guilds.Unlock()
+
+	msg := fmt.Sprintf("%d/%d guilds in %s", gl.Loaded, gl.Guilds, gl.Duration.Round(time.Millisecond))
+	if timedOut {
+		msg += fmt.Sprintf(", %d still unavailable", gl.Missing)
+	}
+	m.handleEvent(EventGuildsLoaded, shard, msg)
+
+	data, err := json.Marshal(gl)
+	if err != nil {
+		log.Errorf("Cannot encode guilds loaded notification: %s", err)
+		return
+	}
+	// Through the publisher, which applies the backpressure policy
+	if err := m.Publisher.PublishData(GuildsLoadedSubject, data); err != nil {
+		log.Errorf("Cannot publish on %s: %s", GuildsLoadedSubject, err)
+	}
+}
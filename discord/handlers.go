@@ -2,20 +2,20 @@ package discord
 
 import (
 	"encoding/json"
+	"sync/atomic"
 	"time"
 
 	"github.com/codechimp-io/keti/broker"
+	"github.com/codechimp-io/keti/codec"
 	"github.com/codechimp-io/keti/log"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nuid"
 )
 
-var ignoredEventsMap = map[string]struct{}{
-	"CHANNEL_PINS_UPDATE": struct{}{},
-	"GUILD_EMOJIS_UPDATE": struct{}{},
-	"MESSAGE_UPDATE":      struct{}{},
-	"TYPING_START":        struct{}{},
-}
+// EventsSubject is the default broker subject gateway events are published on, see Routing
+const EventsSubject = "gateway:exchange"
 
 func (m *Manager) OnDiscordConnected(s *discordgo.Session, e *discordgo.Connect) {
 	m.handleEvent(EventConnected, s.ShardID, "")
@@ -29,6 +29,10 @@ func (m *Manager) OnDiscordReady(s *discordgo.Session, e *discordgo.Ready) {
 	// Disable State cache
 	m.Sessions[s.ShardID].StateEnabled = false
 
+	m.Lock()
+	m.sessionIDs[s.ShardID] = e.SessionID
+	m.Unlock()
+
 	m.handleEvent(EventReady, s.ShardID, "")
 }
 
@@ -43,29 +47,127 @@ func (m *Manager) OnDiscordEvent(s *discordgo.Session, e *discordgo.Event) {
 		return
 	}
 
-	// Ignore events in ignoredEventsMap
-	if _, ok := ignoredEventsMap[e.Type]; ok {
+	// Ignore the events filtered out
+	r := m.Routing()
+	if r.ignored(e.Type) {
+		return
+	}
+
+	m.dispatchMu.RLock()
+	defer m.dispatchMu.RUnlock()
+	if m.draining {
+		return
+	}
+
+	m.RLock()
+	session := m.sessionIDs[s.ShardID]
+	m.RUnlock()
+
+	m.publishEvent(r, s.ShardID, session, s.State.User.ID, e)
+}
+
+// OnShardDispatch forwards dispatches received by raw shards.
+func (m *Manager) OnShardDispatch(sh *Shard, e *discordgo.Event) {
+	m.dispatchMu.RLock()
+	defer m.dispatchMu.RUnlock()
+	if m.draining {
+		// Replayed when the session is resumed, from the last sequence forwarded
+		return
+	}
+
+	if r := m.Routing(); !r.ignored(e.Type) {
+		m.publishEvent(r, sh.ID, sh.SessionID(), sh.UserID(), e)
+	}
+	atomic.StoreInt64(&sh.forwarded, e.Sequence)
+}
+
+// OnDedupShare records the identity keys other instances forwarded, so that the Deduper also catches
+// dispatches received by another process. The keys this instance shared are skipped.
+func (m *Manager) OnDedupShare(msg *nats.Msg) {
+	var k dedupShare
+	if err := json.Unmarshal(msg.Data, &k); err != nil || k.Instance == m.instance {
+		return
+	}
+
+	m.Deduper.Observe(k.Type, k.ID)
+}
+
+// shareDedup publishes the identity key of a forwarded dispatch on DedupSubject.
+func (m *Manager) shareDedup(e *discordgo.Event) {
+	if _, ok := identityEvents[e.Type]; !ok {
+		return
+	}
+	id := jsonTopLevelString(e.RawData, "id")
+	if id == "" {
 		return
 	}
 
-	// Unmarshal event if no data is supplied by DiscordGo
-	if e.Struct == nil {
-		err := json.Unmarshal(e.RawData, &e.Struct)
-		if err != nil {
-			log.Warn("Failed to unmarshal event without DiscordGo struct")
+	data, err := json.Marshal(dedupShare{Instance: m.instance, Type: e.Type, ID: id})
+	if err == nil {
+		err = m.nsc.Conn.Publish(DedupSubject, data)
+	}
+	if err != nil {
+		log.Debugf("Cannot share deduplication key: %s", err)
+	}
+}
+
+func (m *Manager) publishEvent(r *Routing, shard int, session, botID string, e *discordgo.Event) {
+	if m.Deduper != nil {
+		if dup, key := m.Deduper.Duplicate(shard, session, e); dup {
+			dedupDroppedCounter.WithLabelValues(key, e.Type).Inc()
+			return
+		}
+		if m.ShareDedup && m.nsc != nil {
+			m.shareDedup(e)
 		}
 	}
 
-	// Create NATS messaage and send
+	lifecycle := m.trackGuilds(r, shard, e)
+
+	for _, sink := range m.StateSinks {
+		if err := sink.HandleDispatch(shard, e); err != nil {
+			stateSinkErrorsCounter.WithLabelValues(e.Type).Inc()
+		}
+	}
+
+	// Create NATS messaage and send, only the raw payload is forwarded
 	evt := &broker.GatewayEvent{
-		Shard:  s.ShardID,
-		UserID: s.State.User.ID,
-		Data:   e,
-		Time:   time.Now(),
+		Version:    codec.SchemaVersion,
+		BotID:      botID,
+		Shard:      shard,
+		ShardTotal: m.GetShardsTotal(),
+		Type:       e.Type,
+		Sequence:   e.Sequence,
+		ID:         nuid.Next(),
+		GuildID:    payloadGuildID(e.Type, e.RawData),
+		ReceivedAt: time.Now(),
+		Data:       e.RawData,
+	}
+
+	if e.Type == "INTERACTION_CREATE" && m.Interactions != nil {
+		// Deferred in the shard loop so that events keep their order, within the 3 seconds Discord allows
+		deferred, err := m.Interactions.Defer(m.bareSession, e.RawData)
+		m.handleError(err, shard, "Failed deferring interaction")
+		evt.Deferred = deferred
+	}
+
+	m.forward(shard, r.Events, lifecycle, evt)
+}
+
+// forward publishes an event on the events subject and its lifecycle subject if any, then hands it to the taps.
+func (m *Manager) forward(shard int, subject, lifecycle string, evt *broker.GatewayEvent) {
+	// Publish message, the publisher counts the events it drops
+	if err := m.Publisher.Publish(subject, evt); err != nil {
+		log.Debugf("ShardID: %d: %s", shard, err)
+	}
+	if lifecycle != "" {
+		if err := m.Publisher.Publish(lifecycle, evt); err != nil {
+			log.Debugf("ShardID: %d: %s", shard, err)
+		}
 	}
 
-	// Publish message
-	m.nsc.Publish("gateway:exchange", evt)
+	for _, tap := range m.Taps {
+		tap.TapEvent(subject, evt)
+	}
 
-	//	log.Debugf("Type: %s, ShardID: %d, Msg: %s", e.Type, s.ShardID+1, e.RawData)
 }
@@ -12,16 +12,61 @@ import (
 	"github.com/nats-io/go-nats"
 )
 
-// Run starts new Discord manager.
-func Run(ctx context.Context, wg *sync.WaitGroup, nsc *nats.EncodedConn) {
+func init() {
+	config.RegisterCheck("KETI_DISCORD_INTENTS", func(c *config.Config) error {
+		_, err := ParseIntents(c.Discord.Intents)
+		return err
+	})
+}
+
+// Run starts new Discord manager, opts are applied to it before its shards are started.
+func Run(ctx context.Context, wg *sync.WaitGroup, nsc *nats.EncodedConn, opts ...func(*Manager)) *Manager {
 
 	// Configure new manager
 	mgr := New(config.Options.Discord.BotToken(), nsc)
 	mgr.Name = version.Name
 	mgr.LogChannel = "466629625167085571"
+	if config.Options.Discord.LogChan != "" {
+		mgr.LogChannel = config.Options.Discord.LogChan
+	}
 	mgr.ShardsCount = config.Options.Discord.ShardCount
 	mgr.ShardsOffset = config.Options.Discord.ShardOffset
 	mgr.ShardsTotal = config.Options.Discord.ShardTotal
+	mgr.StatusChannel = config.Options.Discord.StatusChan
+	mgr.RawDispatch = config.Options.Discord.RawDispatch
+	mgr.SetRouting(ConfiguredRouting())
+	mgr.Endpoints = ConfiguredEndpoints()
+	mgr.ShutdownTimeout = config.Options.Shutdown.Timeout
+	mgr.SessionsFile = config.Options.Shutdown.SessionsFile
+
+	intents, err := ParseIntents(config.Options.Discord.Intents)
+	if err != nil {
+		log.Fatalf("Invalid KETI_DISCORD_INTENTS: %s", err)
+	}
+	mgr.Intents = intents
+	mgr.Compress = config.Options.Discord.Compress
+	mgr.LargeThreshold = config.Options.Discord.LargeThreshold
+	mgr.GuildsLoadTimeout = config.Options.Discord.GuildsLoadTimeout
+	if !config.Options.Discord.GuildSubscriptions {
+		mgr.GuildSubscriptions = &config.Options.Discord.GuildSubscriptions
+	}
+
+	if dc := config.Options.Discord.Dedup; dc.Enabled {
+		mgr.Deduper = NewDeduper(dc.Window, dc.Size)
+		go mgr.updateDedupStats(ctx, 10*time.Second)
+
+		// Also learn about the dispatches other instances forward
+		if dc.Shared {
+			mgr.ShareDedup = true
+			if _, err := nsc.Conn.Subscribe(DedupSubject, mgr.OnDedupShare); err != nil {
+				log.Fatalf("Cannot subscribe to %s for deduplication: %s", DedupSubject, err)
+			}
+		}
+	}
+
+	for _, opt := range opts {
+		opt(mgr)
+	}
 
 	wg.Add(1)
 	go mgr.Start(ctx, wg)
@@ -37,4 +82,30 @@ func Run(ctx context.Context, wg *sync.WaitGroup, nsc *nats.EncodedConn) {
 	}
 
 	log.Info("Connected to Discord")
+
+	return mgr
+}
+
+// ConfiguredEndpoints returns the REST API and gateway set in config, or nil to use Discord's.
+func ConfiguredEndpoints() *Endpoints {
+	d := config.Options.Discord
+	if d.APIURL == "" && d.APIVersion == "" && d.GatewayURL == "" {
+		return nil
+	}
+
+	return &Endpoints{API: d.APIURL, Version: d.APIVersion, Gateway: d.GatewayURL}
+}
+
+// ConfiguredRouting returns the dispatch types ignored and the subjects set in config.
+func ConfiguredRouting() *Routing {
+	o := config.Current()
+
+	r := NewRouting(o.Discord.IgnoredEvents)
+	r.Events = o.Broker.EventsSubject
+	r.GuildJoined = o.Broker.GuildJoinedSubject
+	r.GuildAvailable = o.Broker.GuildAvailableSubject
+	r.GuildLeft = o.Broker.GuildLeftSubject
+	r.GuildUnavailable = o.Broker.GuildUnavailableSubject
+
+	return r
 }
@@ -0,0 +1,105 @@
+package discord
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Gateway intents by their name in the Discord documentation
+var intentNames = map[string]discordgo.Intent{
+	"GUILDS":                        discordgo.IntentGuilds,
+	"GUILD_MEMBERS":                 discordgo.IntentGuildMembers,
+	"GUILD_MODERATION":              discordgo.IntentGuildBans,
+	"GUILD_BANS":                    discordgo.IntentGuildBans,
+	"GUILD_EMOJIS_AND_STICKERS":     discordgo.IntentGuildEmojis,
+	"GUILD_EMOJIS":                  discordgo.IntentGuildEmojis,
+	"GUILD_INTEGRATIONS":            discordgo.IntentGuildIntegrations,
+	"GUILD_WEBHOOKS":                discordgo.IntentGuildWebhooks,
+	"GUILD_INVITES":                 discordgo.IntentGuildInvites,
+	"GUILD_VOICE_STATES":            discordgo.IntentGuildVoiceStates,
+	"GUILD_PRESENCES":               discordgo.IntentGuildPresences,
+	"GUILD_MESSAGES":                discordgo.IntentGuildMessages,
+	"GUILD_MESSAGE_REACTIONS":       discordgo.IntentGuildMessageReactions,
+	"GUILD_MESSAGE_TYPING":          discordgo.IntentGuildMessageTyping,
+	"DIRECT_MESSAGES":               discordgo.IntentDirectMessages,
+	"DIRECT_MESSAGE_REACTIONS":      discordgo.IntentDirectMessageReactions,
+	"DIRECT_MESSAGE_TYPING":         discordgo.IntentDirectMessageTyping,
+	"MESSAGE_CONTENT":               discordgo.IntentMessageContent,
+	"GUILD_SCHEDULED_EVENTS":        discordgo.IntentGuildScheduledEvents,
+	"AUTO_MODERATION_CONFIGURATION": discordgo.IntentAutoModerationConfiguration,
+	"AUTO_MODERATION_EXECUTION":     discordgo.IntentAutoModerationExecution,
+
+	"ALL_WITHOUT_PRIVILEGED": discordgo.IntentsAllWithoutPrivileged,
+	"ALL":                    discordgo.IntentsAll,
+}
+
+// Application flags allowing a privileged intent, the limited flag applies to bots in less than 100 guilds
+var privilegedIntents = map[discordgo.Intent]struct {
+	name          string
+	flag, limited int
+}{
+	discordgo.IntentGuildPresences: {"GUILD_PRESENCES", 1 << 12, 1 << 13},
+	discordgo.IntentGuildMembers:   {"GUILD_MEMBERS", 1 << 14, 1 << 15},
+	discordgo.IntentMessageContent: {"MESSAGE_CONTENT", 1 << 18, 1 << 19},
+}
+
+// ParseIntents combines intents given by name, e.g. GUILDS or GUILD_MESSAGES, or as numeric bitfields.
+func ParseIntents(names []string) (discordgo.Intent, error) {
+	var intents discordgo.Intent
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		if i, ok := intentNames[name]; ok {
+			intents |= i
+			continue
+		}
+		if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+			intents |= discordgo.Intent(n)
+			continue
+		}
+
+		return 0, fmt.Errorf("Unknown gateway intent %q", name)
+	}
+
+	return intents, nil
+}
+
+// CheckPrivilegedIntents returns an error naming the privileged intents in intents
+// that are not enabled for the bot application in the Discord developer portal.
+func CheckPrivilegedIntents(s *discordgo.Session, intents discordgo.Intent) error {
+	var requested []discordgo.Intent
+	for i := range privilegedIntents {
+		if intents&i != 0 {
+			requested = append(requested, i)
+		}
+	}
+	if len(requested) == 0 {
+		return nil
+	}
+
+	app, err := s.Application("@me")
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, i := range requested {
+		p := privilegedIntents[i]
+		if app.Flags&(p.flag|p.limited) == 0 {
+			missing = append(missing, p.name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("Privileged intents %s are not enabled for the bot, enable them in the Discord developer portal or remove them from the configured intents", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
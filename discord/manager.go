@@ -3,18 +3,40 @@ package discord
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/codechimp-io/keti/broker"
+	"github.com/codechimp-io/keti/codec"
 	"github.com/codechimp-io/keti/log"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nuid"
 )
 
 type SessionFunc func(token string) (*discordgo.Session, error)
 
+// InteractionDeferrer acknowledges INTERACTION_CREATE payloads through the REST session s
+// and reports whether it did
+type InteractionDeferrer interface {
+	Defer(s *discordgo.Session, data []byte) (bool, error)
+}
+
+// EventTap sees every event the manager publishes on the events subject, e.g. to record it.
+// It is called in the dispatch path and must not retain the event beyond the call.
+type EventTap interface {
+	TapEvent(subject string, e *codec.GatewayEvent)
+}
+
+// StateSink keeps a state store up to date from dispatches, the event is not retained after the call
+type StateSink interface {
+	HandleDispatch(shard int, e *discordgo.Event) error
+}
+
 // Manager implements
 type Manager struct {
 	sync.RWMutex
@@ -26,11 +48,98 @@ type Manager struct {
 	Sessions map[int]*discordgo.Session
 	nsc      *nats.EncodedConn
 
+	// Raw gateway shards, used instead of Sessions when RawDispatch is set
+	Shards map[int]*Shard
+
+	// RawDispatch forwards dispatches through lean gateway shards instead of discordgo sessions,
+	// events are published with their raw payload and never decoded into discordgo structs
+	RawDispatch bool
+
+	// Gateway intents sent when identifying, the discordgo default is used when 0
+	Intents discordgo.Intent
+
+	// Compress enables zlib-stream transport compression on raw shards,
+	// and payload compression on discordgo sessions which do not support zlib-stream
+	Compress bool
+
+	// Total member count above which the gateway stops sending offline members, Discord default when 0
+	LargeThreshold int
+
+	// If set, sent as guild_subscriptions when identifying raw shards, discordgo sessions ignore it
+	GuildSubscriptions *bool
+
+	// How long to wait for the guilds announced in READY before emitting EventGuildsLoaded anyway
+	GuildsLoadTimeout time.Duration
+
+	// Guild loading state of every shard
+	guilds guildTracker
+
+	// If set, acknowledges interactions before they are forwarded
+	Interactions InteractionDeferrer
+
+	// Sinks kept up to date with every dispatch forwarded to the broker
+	StateSinks []StateSink
+
+	// Taps called with every event published on the events subject
+	Taps []EventTap
+
+	// Publishes the events on the broker, applying its backpressure policy when the broker falls behind
+	Publisher *broker.Publisher
+
+	// If set, HTTP client of the REST calls of the sessions, e.g. to go through a shared rate limiter
+	Client *http.Client
+
+	// If set, REST API and gateway used instead of Discord's, by every session including the ones of SessionFunc
+	Endpoints *Endpoints
+
+	// If set, dispatches already forwarded within its window are dropped before publishing
+	Deduper *Deduper
+
+	// ShareDedup publishes the identity keys of the forwarded dispatches on DedupSubject,
+	// for the instances subscribed with OnDedupShare
+	ShareDedup bool
+
+	// Identifies this manager in the keys it shares
+	instance string
+
+	// If set, only the shards it returns true for are initialized and started,
+	// e.g. to skip shards leased by another instance
+	ShardFilter func(shard int) bool
+
+	// Gateway session IDs of the discordgo sessions, by shard
+	sessionIDs map[int]string
+
+	// How long Shutdown may take once the context of Start is done
+	ShutdownTimeout time.Duration
+
+	// If set, raw shard sessions are saved to this file on shutdown and resumed from it by Init
+	SessionsFile string
+
+	// Sessions resumed by raw shards instead of identifying when they are started, by shard
+	Resume map[int]SessionInfo
+
+	// Current *Routing, see SetRouting
+	routing atomic.Value
+
+	// Held while forwarding dispatches, draining is set once they are not anymore
+	dispatchMu sync.RWMutex
+	draining   bool
+
+	stopOnce       sync.Once
+	stopped        chan struct{}
+	closedSessions map[int]SessionInfo
+
 	// handlers
 	eventHandlers []interface{}
 
-	// If set logs connection status events to this channel
+	// If set logs connection status events to this channel, change it with SetLogChannel once started
 	LogChannel string
+	logMu      sync.Mutex
+
+	// If set keeps a message with the status of the shards up to date in this channel, every
+	// StatusInterval. Change it with SetStatusChannel once started.
+	StatusChannel string
+	statusChanged chan struct{}
 
 	// The function that provides the guild counts for this shard, used for the updated status message
 	// Should return guilds count
@@ -44,14 +153,20 @@ type Manager struct {
 	// session settings to apply
 	SessionFunc SessionFunc
 
-	// Total Shards and current number of shards for this instance
+	// Total Shards and current number of shards for this instance. ShardsTotal is set before starting,
+	// read it with GetShardsTotal and change it with SetShardsTotal once started.
 	ShardsTotal  int
 	ShardsCount  int
 	ShardsOffset int
 
+	// ShardsTotal as of Init or SetShardsTotal, read without the lock
+	total int64
+
 	token string
 
 	bareSession *discordgo.Session
+	restOnce    sync.Once
+	gatewayURL  string
 	started     bool
 }
 
@@ -64,11 +179,26 @@ func New(token string, nsc *nats.EncodedConn) *Manager {
 		token:       token,
 		ShardsCount: -1,
 		nsc:         nsc,
+		sessionIDs:  make(map[int]string),
+		stopped:     make(chan struct{}),
+		instance:    nuid.Next(),
+
+		statusChanged: make(chan struct{}, 1),
+
+		ShutdownTimeout: 10 * time.Second,
+
+		GuildsLoadTimeout: time.Minute,
+		guilds:            guildTracker{shards: make(map[int]*shardGuilds)},
 	}
 
+	manager.routing.Store(NewRouting(DefaultIgnoredEvents))
 	manager.OnEvent = manager.LogConnectionEventStd
 	manager.SessionFunc = manager.DefaultSessionFunc
 
+	if nsc != nil {
+		manager.Publisher = broker.NewPublisher(nsc)
+	}
+
 	manager.bareSession, _ = discordgo.New(token)
 
 	return manager
@@ -79,6 +209,51 @@ func (m *Manager) GetNumShards() int {
 	return m.ShardsCount
 }
 
+// SetShardsTotal changes the total number of shards of the bot, it fails while shards are running.
+func (m *Manager) SetShardsTotal(total int) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if total == m.ShardsTotal {
+		return nil
+	}
+	if len(m.Shards)+len(m.Sessions) > 0 {
+		return fmt.Errorf("Cannot change the shard total from %d to %d with running shards", m.ShardsTotal, total)
+	}
+
+	m.ShardsTotal = total
+	atomic.StoreInt64(&m.total, int64(total))
+	return nil
+}
+
+// GetShardsTotal returns the total number of shards of the bot, it can be called with the lock held.
+func (m *Manager) GetShardsTotal() int {
+	return int(atomic.LoadInt64(&m.total))
+}
+
+// RecommendedShards returns the number of shards Discord recommends for the bot.
+func (m *Manager) RecommendedShards() (int, error) {
+	gb, err := m.rest().GatewayBot()
+	if err != nil {
+		return 0, err
+	}
+
+	return gb.Shards, nil
+}
+
+// rest returns the session of the manager's own REST calls, with the client and endpoints applied
+// the first time, as they are set before the manager is started.
+func (m *Manager) rest() *discordgo.Session {
+	m.restOnce.Do(func() {
+		if m.Client != nil {
+			m.bareSession.Client = m.Client
+		}
+		m.Endpoints.Apply(m.bareSession)
+	})
+
+	return m.bareSession
+}
+
 // Adds an event handler to all shards
 // All event handlers will be added to new sessions automatically.
 func (m *Manager) AddHandler(handler interface{}) {
@@ -104,10 +279,53 @@ func (m *Manager) Init() error {
 		m.ShardsTotal = 1
 		m.ShardsOffset = 0
 	}
+	atomic.StoreInt64(&m.total, int64(m.ShardsTotal))
+
+	m.rest()
+
+	if m.Intents != 0 {
+		if err := CheckPrivilegedIntents(m.bareSession, m.Intents); err != nil {
+			m.Unlock()
+			return err
+		}
+	}
+
+	if m.RawDispatch && m.SessionsFile != "" {
+		sessions, err := loadSessions(m.SessionsFile, m.ShardsTotal)
+		if err != nil {
+			log.Errorf("Cannot resume the saved gateway sessions: %s", err)
+		} else if sessions != nil {
+			log.Infof("Resuming %d gateway sessions saved in %s", len(sessions), m.SessionsFile)
+			if m.Resume == nil {
+				m.Resume = sessions
+			}
+		}
+	}
+
+	if m.RawDispatch {
+		gateway, err := m.bareSession.Gateway()
+		if err != nil {
+			m.Unlock()
+			return err
+		}
+		m.gatewayURL = gateway
+		m.Shards = make(map[int]*Shard, m.ShardsCount)
+	} else {
+		m.Sessions = make(map[int]*discordgo.Session, m.ShardsCount)
+	}
 
-	m.Sessions = make(map[int]*discordgo.Session, m.ShardsCount)
 	for i := m.ShardsOffset; i < m.ShardsCount; i++ {
-		err := m.initSession(i)
+		if m.ShardFilter != nil && !m.ShardFilter(i) {
+			log.Infof("Skipping Discord ShardID: %d", i)
+			continue
+		}
+
+		var err error
+		if m.RawDispatch {
+			err = m.initShard(i)
+		} else {
+			err = m.initSession(i)
+		}
 		if err != nil {
 			m.Unlock()
 			return err
@@ -125,7 +343,7 @@ func (m *Manager) Start(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	m.Lock()
-	if m.Sessions == nil {
+	if m.Sessions == nil && m.Shards == nil {
 		m.Unlock()
 		err := m.Init()
 		if err != nil {
@@ -136,26 +354,34 @@ func (m *Manager) Start(ctx context.Context, wg *sync.WaitGroup) {
 
 	m.Unlock()
 
+	opened := 0
 	for i := m.ShardsOffset; i < m.ShardsCount; i++ {
-		if i != 0 {
+		m.RLock()
+		ok := m.hasShard(i)
+		m.RUnlock()
+		if !ok {
+			continue
+		}
+
+		if opened != 0 {
 			// One indentify every 5 seconds
 			time.Sleep(time.Second * 5)
 		}
+		opened++
 
 		m.Lock()
 		err := m.startSession(i)
 		m.Unlock()
 		if err != nil {
-			log.Fatalf("Cannot start Discord ShardID: %d, session: %s", err, i)
+			log.Fatalf("Cannot start Discord ShardID: %d, session: %s", i, err)
 		}
 	}
 
-	select {
-	case <-ctx.Done():
-		m.StopAll()
-		log.Info("Discord sessions closed")
-	}
+	go m.updateStatusMessage(ctx, StatusInterval)
 
+	<-ctx.Done()
+	m.Shutdown(m.ShutdownTimeout)
+	log.Info("Discord sessions closed")
 }
 
 // StopAll stops all the shard sessions and returns the last error that occured
@@ -166,11 +392,102 @@ func (m *Manager) StopAll() (err error) {
 			err = e
 		}
 	}
+	for _, v := range m.Shards {
+		if e := v.Close(); e != nil {
+			err = e
+		}
+	}
 	m.Unlock()
 
 	return
 }
 
+// StartShard initializes and opens a shard that is not running yet, resuming
+// the given gateway session if it is set and the manager uses raw shards.
+func (m *Manager) StartShard(shard int, resume *SessionInfo) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.hasShard(shard) {
+		return fmt.Errorf("Shard %d is already running", shard)
+	}
+
+	var err error
+	if m.RawDispatch {
+		if m.Shards == nil {
+			m.Shards = make(map[int]*Shard)
+		}
+		if m.gatewayURL == "" {
+			if m.gatewayURL, err = m.bareSession.Gateway(); err != nil {
+				return err
+			}
+		}
+		err = m.initShard(shard)
+		if err == nil && resume != nil {
+			m.Shards[shard].Resume(*resume)
+		}
+	} else {
+		if m.Sessions == nil {
+			m.Sessions = make(map[int]*discordgo.Session)
+		}
+		err = m.initSession(shard)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = m.startSession(shard); err != nil {
+		delete(m.Shards, shard)
+		delete(m.Sessions, shard)
+	}
+
+	return err
+}
+
+// StopShard closes a running shard and forgets it. Raw shards are closed with a
+// resumable close code, so that another instance can resume the session.
+func (m *Manager) StopShard(shard int) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if sh, ok := m.Shards[shard]; ok {
+		err = sh.CloseWithCode(CloseResumable)
+		delete(m.Shards, shard)
+	}
+	if s, ok := m.Sessions[shard]; ok {
+		err = s.Close()
+		delete(m.Sessions, shard)
+		delete(m.sessionIDs, shard)
+	}
+
+	return
+}
+
+// RunningShards returns the running shards with their gateway session,
+// the session is only known for raw shards.
+func (m *Manager) RunningShards() map[int]SessionInfo {
+	m.RLock()
+	defer m.RUnlock()
+
+	shards := make(map[int]SessionInfo, len(m.Shards)+len(m.Sessions))
+	for id, sh := range m.Shards {
+		shards[id] = forwardedSession(sh)
+	}
+	for id := range m.Sessions {
+		shards[id] = SessionInfo{}
+	}
+
+	return shards
+}
+
+func (m *Manager) hasShard(shard int) bool {
+	if _, ok := m.Shards[shard]; ok {
+		return true
+	}
+	_, ok := m.Sessions[shard]
+	return ok
+}
+
 // Started determines if the manager have been started
 func (m *Manager) Started() bool {
 	m.RLock()
@@ -187,6 +504,18 @@ func (m *Manager) initSession(shard int) error {
 
 	session.ShardCount = m.ShardsTotal
 	session.ShardID = shard
+	if m.Client != nil {
+		session.Client = m.Client
+	}
+	m.Endpoints.Apply(session)
+	if m.Intents != 0 {
+		session.Identify.Intents = m.Intents
+	}
+	if m.LargeThreshold != 0 {
+		session.Identify.LargeThreshold = m.LargeThreshold
+	}
+	session.Compress = m.Compress
+	session.Identify.Compress = m.Compress
 
 	session.AddHandler(m.OnDiscordConnected)
 	session.AddHandler(m.OnDiscordDisconnected)
@@ -203,9 +532,36 @@ func (m *Manager) initSession(shard int) error {
 	return nil
 }
 
-func (m *Manager) startSession(shard int) error {
+func (m *Manager) initShard(shard int) error {
+	sh := NewShard(m.token, shard, m.ShardsTotal)
+	sh.Gateway = m.gatewayURL
+	sh.Version = m.Endpoints.version()
+	if m.Intents != 0 {
+		sh.Identify.Intents = m.Intents
+	}
+	if m.LargeThreshold != 0 {
+		sh.Identify.LargeThreshold = m.LargeThreshold
+	}
+	sh.Compress = m.Compress
+	sh.GuildSubscriptions = m.GuildSubscriptions
+	sh.OnDispatch = m.OnShardDispatch
+	sh.OnEvent = m.handleEvent
+	if si, ok := m.Resume[shard]; ok {
+		sh.Resume(si)
+		delete(m.Resume, shard)
+	}
 
-	err := m.Sessions[shard].Open()
+	m.Shards[shard] = sh
+	return nil
+}
+
+func (m *Manager) startSession(shard int) error {
+	var err error
+	if m.RawDispatch {
+		err = m.Shards[shard].Open()
+	} else {
+		err = m.Sessions[shard].Open()
+	}
 	if err != nil {
 		return err
 	}
@@ -243,18 +599,28 @@ func (m *Manager) handleEvent(typ EventType, shard int, msg string) {
 	evt := &Event{
 		Type:      typ,
 		Shard:     shard,
-		NumShards: m.ShardsTotal,
+		NumShards: m.GetShardsTotal(),
 		Msg:       msg,
 		Time:      time.Now(),
 	}
 
 	m.OnEvent(evt)
 
-	if m.LogChannel != "" {
-		go m.logEventToDiscord(evt)
+	m.logMu.Lock()
+	channel := m.LogChannel
+	m.logMu.Unlock()
+	if channel != "" {
+		go m.logEventToDiscord(evt, channel)
 	}
 }
 
+// SetLogChannel changes the channel connection status events are logged to, empty to stop logging them.
+func (m *Manager) SetLogChannel(channel string) {
+	m.logMu.Lock()
+	m.LogChannel = channel
+	m.logMu.Unlock()
+}
+
 // DefaultSessionFunc is the default session provider, it does nothing to the actual session
 func (m *Manager) DefaultSessionFunc(token string) (*discordgo.Session, error) {
 	s, err := discordgo.New(token)
@@ -264,7 +630,7 @@ func (m *Manager) DefaultSessionFunc(token string) (*discordgo.Session, error) {
 	return s, nil
 }
 
-func (m *Manager) logEventToDiscord(evt *Event) {
+func (m *Manager) logEventToDiscord(evt *Event, channel string) {
 	if evt.Type == EventError {
 		return
 	}
@@ -281,7 +647,7 @@ func (m *Manager) logEventToDiscord(evt *Event) {
 		Color:       eventColors[evt.Type],
 	}
 
-	_, err := m.bareSession.ChannelMessageSendEmbed(m.LogChannel, embed)
+	_, err := m.bareSession.ChannelMessageSendEmbed(channel, embed)
 	m.handleError(err, evt.Shard, "Failed sending event to discord")
 }
 
@@ -335,6 +701,9 @@ const (
 
 	// Sent when an error occurs
 	EventError
+
+	// Sent when the guilds announced in READY were all received, or the timeout passed
+	EventGuildsLoaded
 )
 
 var (
@@ -346,6 +715,7 @@ var (
 		EventResumed:      "resumed",
 		EventReady:        "ready",
 		EventError:        "error",
+		EventGuildsLoaded: "guilds_loaded",
 	}
 
 	eventColors = map[EventType]int{
@@ -356,6 +726,7 @@ var (
 		EventResumed:      0x5985ff,
 		EventReady:        0x00ffbf,
 		EventError:        0x7a1bad,
+		EventGuildsLoaded: 0x2ecc71,
 	}
 )
 
@@ -0,0 +1,299 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codechimp-io/keti/broker"
+	"github.com/codechimp-io/keti/codec"
+	"github.com/codechimp-io/keti/discord/discordtest"
+
+	"github.com/nats-io/go-nats"
+)
+
+// startBroker runs an embedded broker until the test ends and connects to it.
+func startBroker(t *testing.T) (*broker.Server, *nats.EncodedConn) {
+	t.Helper()
+
+	srv, err := broker.NewServer(false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random client port, without the monitoring and cluster listeners
+	srv.Opts.Host = "127.0.0.1"
+	srv.Opts.Port = 0
+	srv.Opts.HTTPPort = 0
+	srv.Opts.Cluster.Port = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go srv.Start(ctx, wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	if !srv.Server.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Broker not ready")
+	}
+
+	nc, err := broker.NewEncodedClient(&nats.Options{
+		Url:     fmt.Sprintf("nats://%s", srv.Server.Addr()),
+		Timeout: 5 * time.Second,
+	}, codec.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	return srv, nc
+}
+
+// subscribe returns the events published on EventsSubject from now on.
+func subscribe(t *testing.T, nc *nats.EncodedConn) <-chan *codec.GatewayEvent {
+	t.Helper()
+
+	events := make(chan *codec.GatewayEvent, 100)
+	if _, err := nc.Subscribe(EventsSubject, func(e *codec.GatewayEvent) {
+		events <- e
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return events
+}
+
+// waitEvent returns the next event of type typ published, the ones before it are skipped.
+func waitEvent(t *testing.T, events <-chan *codec.GatewayEvent, typ string) *codec.GatewayEvent {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == typ {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("No %s published on the broker", typ)
+		}
+	}
+}
+
+// TestManagerBroker runs a manager against the fake gateway and checks the dispatches reach the broker,
+// across resumed and new sessions.
+func TestManagerBroker(t *testing.T) {
+	_, nc := startBroker(t)
+	events := subscribe(t, nc)
+
+	srv := discordtest.NewServer()
+	srv.Guilds = []string{"41771983423143937"}
+	defer srv.Close()
+
+	m := New("Bot token", nc)
+	m.RawDispatch = true
+	m.Endpoints = &Endpoints{API: srv.URL}
+	m.ShardsCount, m.ShardsTotal = 1, 1
+	m.ShutdownTimeout = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go m.Start(ctx, wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// IDENTIFY, READY, then the guilds of the shard and the dispatches
+	if err := srv.WaitReady(0, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Identifies()); n != 1 {
+		t.Fatalf("%d IDENTIFY sent, want 1", n)
+	}
+	ready := waitEvent(t, events, "READY")
+	if ready.BotID != srv.User.ID || ready.Shard != 0 || ready.ShardTotal != 1 {
+		t.Errorf("READY published as %+v", ready)
+	}
+	if e := waitEvent(t, events, "GUILD_CREATE"); e.GuildID != "41771983423143937" {
+		t.Errorf("GUILD_CREATE published for guild %q", e.GuildID)
+	}
+
+	message := map[string]interface{}{
+		"id":         "1047566290853937192",
+		"channel_id": "1047566110427250708",
+		"guild_id":   "41771983423143937",
+		"content":    "hello",
+	}
+	if err := srv.Dispatch(0, "MESSAGE_CREATE", message); err != nil {
+		t.Fatal(err)
+	}
+	first := waitEvent(t, events, "MESSAGE_CREATE")
+	if first.GuildID != "41771983423143937" || first.BotID != srv.User.ID {
+		t.Errorf("MESSAGE_CREATE published as %+v", first)
+	}
+
+	// A resumable close code: the shard resumes its session and keeps its sequence
+	session := srv.SessionID(0)
+	if err := srv.Disconnect(0, 4000); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, events, "RESUMED")
+	if n := srv.Resumes(); n != 1 {
+		t.Errorf("%d sessions resumed, want 1", n)
+	}
+	if n := len(srv.Identifies()); n != 1 {
+		t.Errorf("%d IDENTIFY sent after resuming, want 1", n)
+	}
+	if id := srv.SessionID(0); id != session {
+		t.Errorf("Session %q after resuming, want %q", id, session)
+	}
+
+	if err := srv.Dispatch(0, "MESSAGE_CREATE", message); err != nil {
+		t.Fatal(err)
+	}
+	if e := waitEvent(t, events, "MESSAGE_CREATE"); e.Sequence <= first.Sequence {
+		t.Errorf("Sequence %d after resuming, want more than %d", e.Sequence, first.Sequence)
+	}
+
+	// A session that cannot be resumed: the shard identifies again
+	if err := srv.InvalidateSession(0, false); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, events, "READY")
+	if n := len(srv.Identifies()); n != 2 {
+		t.Errorf("%d IDENTIFY sent, want 2", n)
+	}
+	if id := srv.SessionID(0); id == "" || id == session {
+		t.Errorf("Session %q after identifying again, want a new one", id)
+	}
+
+	if err := srv.Dispatch(0, "MESSAGE_CREATE", message); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, events, "MESSAGE_CREATE")
+}
+
+// TestShutdownBlocked checks dispatches blocked by the backpressure policy do not hold the shutdown
+// past its timeout.
+func TestShutdownBlocked(t *testing.T) {
+	bsrv, nc := startBroker(t)
+
+	srv := discordtest.NewServer()
+	defer srv.Close()
+
+	m := New("Bot token", nc)
+	m.RawDispatch = true
+	m.Endpoints = &Endpoints{API: srv.URL}
+	m.ShardsCount, m.ShardsTotal = 1, 1
+	m.ShutdownTimeout = time.Second
+	m.Publisher.Policy = broker.PolicyBlock
+	m.Publisher.MaxPending = 1
+	m.Publisher.BlockTimeout = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go m.Start(ctx, wg)
+	defer cancel()
+
+	if err := srv.WaitReady(0, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Events are buffered while the client reconnects, the connection is backed up after the first one
+	bsrv.Server.Shutdown()
+	for deadline := time.Now().Add(5 * time.Second); nc.Conn.IsConnected(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Still connected to the broker")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := srv.Dispatch(0, "MESSAGE_CREATE", map[string]string{"id": "1047566290853937192"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	cancel()
+	wg.Wait()
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("Shutdown took %s with a 1s timeout", took)
+	}
+}
+
+// TestManagerRouting checks the ignored dispatch types and the subjects set with SetRouting apply to
+// the dispatches forwarded after.
+func TestManagerRouting(t *testing.T) {
+	_, nc := startBroker(t)
+	events := subscribe(t, nc)
+
+	srv := discordtest.NewServer()
+	defer srv.Close()
+
+	m := New("Bot token", nc)
+	m.RawDispatch = true
+	m.Endpoints = &Endpoints{API: srv.URL}
+	m.ShardsCount, m.ShardsTotal = 1, 1
+	m.ShutdownTimeout = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go m.Start(ctx, wg)
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	if err := srv.WaitReady(0, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, events, "READY")
+
+	routed := make(chan *codec.GatewayEvent, 100)
+	if _, err := nc.Subscribe("keti.events", func(e *codec.GatewayEvent) {
+		routed <- e
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRouting([]string{"message_create"})
+	r.Events = "keti.events"
+	m.SetRouting(r)
+
+	for _, typ := range []string{"MESSAGE_CREATE", "TYPING_START"} {
+		if err := srv.Dispatch(0, typ, map[string]string{"channel_id": "1047566110427250708"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Dispatches are published in order, the ignored one would come first
+	select {
+	case e := <-routed:
+		if e.Type != "TYPING_START" {
+			t.Errorf("Ignored %s published", e.Type)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("No TYPING_START published on the routed subject")
+	}
+
+	select {
+	case e := <-routed:
+		t.Errorf("Ignored %s published", e.Type)
+	case e := <-events:
+		t.Errorf("%s published on %s", e.Type, EventsSubject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
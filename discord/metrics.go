@@ -0,0 +1,57 @@
+package discord
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dedupDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_dedup_dropped_events_total",
+		Help: "Dispatches dropped as duplicates, by matching key",
+	}, []string{"key", "type"})
+
+	dedupKeysGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "keti_dedup_keys",
+		Help: "Keys currently remembered by the deduplication stage",
+	})
+
+	stateSinkErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_state_sink_errors_total",
+		Help: "Dispatches a state sink failed to apply, by type",
+	}, []string{"type"})
+
+	gatewayCompressedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_gateway_compressed_bytes_total",
+		Help: "Bytes received from the gateway by raw shards, as sent on the wire",
+	}, []string{"shard"})
+
+	gatewayDecompressedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_gateway_decompressed_bytes_total",
+		Help: "Bytes of gateway payloads received by raw shards, after decompression",
+	}, []string{"shard"})
+)
+
+func init() {
+	prometheus.MustRegister(dedupDroppedCounter)
+	prometheus.MustRegister(dedupKeysGauge)
+	prometheus.MustRegister(stateSinkErrorsCounter)
+	prometheus.MustRegister(gatewayCompressedBytes)
+	prometheus.MustRegister(gatewayDecompressedBytes)
+}
+
+func (m *Manager) updateDedupStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			dedupKeysGauge.Set(float64(m.Deduper.Len()))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
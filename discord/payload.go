@@ -0,0 +1,135 @@
+package discord
+
+import "bytes"
+
+// payloadGuildID returns the guild a dispatch belongs to without decoding its payload,
+// or "" when the event is not guild scoped.
+func payloadGuildID(typ string, data []byte) string {
+	switch typ {
+	case "GUILD_CREATE", "GUILD_UPDATE", "GUILD_DELETE":
+		return jsonTopLevelString(data, "id")
+	case "READY", "RESUMED":
+		return ""
+	}
+
+	return jsonTopLevelString(data, "guild_id")
+}
+
+// jsonTopLevelString returns the string value of key in the JSON object data, skipping
+// over the other members without decoding them. It returns "" if the key is missing
+// or its value is not a string.
+func jsonTopLevelString(data []byte, key string) string {
+	v := jsonTopLevel(data, key)
+	if len(v) < 2 || v[0] != '"' {
+		return ""
+	}
+
+	return string(v[1 : len(v)-1])
+}
+
+// jsonTopLevel returns the raw value of key in the JSON object data, or nil if the key is missing.
+func jsonTopLevel(data []byte, key string) []byte {
+	i := skipSpace(data, 0)
+	if i >= len(data) || data[i] != '{' {
+		return nil
+	}
+	i++
+
+	for {
+		i = skipSpace(data, i)
+		if i >= len(data) || data[i] != '"' {
+			return nil
+		}
+
+		end := skipString(data, i)
+		if end < 0 {
+			return nil
+		}
+		k := data[i+1 : end-1]
+
+		i = skipSpace(data, end)
+		if i >= len(data) || data[i] != ':' {
+			return nil
+		}
+		i = skipSpace(data, i+1)
+
+		end = skipValue(data, i)
+		if end < 0 {
+			return nil
+		}
+		if string(k) == key {
+			return bytes.TrimRight(data[i:end], " \t\n\r")
+		}
+
+		i = skipSpace(data, end)
+		if i >= len(data) || data[i] != ',' {
+			return nil
+		}
+		i++
+	}
+}
+
+func skipSpace(data []byte, i int) int {
+	for i < len(data) {
+		switch data[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+
+	return i
+}
+
+// skipString returns the index following the string starting at data[i], or -1 if it is not terminated.
+func skipString(data []byte, i int) int {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// skipValue returns the index following the value starting at data[i], or -1 if it is not terminated.
+func skipValue(data []byte, i int) int {
+	depth := 0
+	for i < len(data) {
+		switch data[i] {
+		case '"':
+			i = skipString(data, i)
+			if i < 0 {
+				return -1
+			}
+			if depth == 0 {
+				return i
+			}
+			continue
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				return i
+			}
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		case ',':
+			if depth == 0 {
+				return i
+			}
+		}
+		i++
+	}
+
+	if depth == 0 {
+		return i
+	}
+
+	return -1
+}
@@ -0,0 +1,60 @@
+package discord
+
+import (
+	"strings"
+)
+
+// DefaultIgnoredEvents are the dispatch types not forwarded unless configured otherwise
+var DefaultIgnoredEvents = []string{"CHANNEL_PINS_UPDATE", "GUILD_EMOJIS_UPDATE", "MESSAGE_UPDATE", "TYPING_START"}
+
+// Routing selects the dispatches forwarded and the broker subjects they are published on.
+// It is replaced as a whole with Manager.SetRouting and must not be modified once set.
+type Routing struct {
+	// Dispatch types not forwarded
+	Ignored map[string]struct{}
+
+	// Subject every event is published on
+	Events string
+
+	// Subjects guild lifecycle events are also published on
+	GuildJoined      string
+	GuildAvailable   string
+	GuildLeft        string
+	GuildUnavailable string
+}
+
+// NewRouting returns the routing ignoring the dispatch types of ignored, with the default subjects.
+func NewRouting(ignored []string) *Routing {
+	r := &Routing{
+		Ignored:          make(map[string]struct{}, len(ignored)),
+		Events:           EventsSubject,
+		GuildJoined:      GuildJoinedSubject,
+		GuildAvailable:   GuildAvailableSubject,
+		GuildLeft:        GuildLeftSubject,
+		GuildUnavailable: GuildUnavailableSubject,
+	}
+	for _, typ := range ignored {
+		if typ = strings.ToUpper(strings.TrimSpace(typ)); typ != "" {
+			r.Ignored[typ] = struct{}{}
+		}
+	}
+
+	return r
+}
+
+// ignored reports whether dispatches of type typ are not forwarded.
+func (r *Routing) ignored(typ string) bool {
+	_, ok := r.Ignored[typ]
+	return ok
+}
+
+// Routing returns the dispatch types ignored and the subjects events are published on.
+func (m *Manager) Routing() *Routing {
+	return m.routing.Load().(*Routing)
+}
+
+// SetRouting changes the dispatch types ignored and the subjects events are published on,
+// it applies to the dispatches forwarded from now on.
+func (m *Manager) SetRouting(r *Routing) {
+	m.routing.Store(r)
+}
@@ -0,0 +1,524 @@
+package discord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Gateway opcodes handled by Shard
+const (
+	opDispatch       = 0
+	opHeartbeat      = 1
+	opIdentify       = 2
+	opResume         = 6
+	opReconnect      = 7
+	opInvalidSession = 9
+	opHello          = 10
+	opHeartbeatAck   = 11
+)
+
+// Gateway close codes after which the session cannot be resumed
+var sessionCloseCodes = map[int]struct{}{
+	4007: struct{}{}, // Invalid seq
+	4009: struct{}{}, // Session timed out
+}
+
+// Gateway close codes after which reconnecting is pointless
+var fatalCloseCodes = map[int]string{
+	4004: "authentication failed",
+	4010: "invalid shard",
+	4011: "sharding required",
+	4012: "invalid API version",
+	4013: "invalid intents",
+	4014: "disallowed intents, enable the privileged intents in the Discord developer portal or stop requesting them",
+}
+
+// CloseResumable is the close code used to disconnect without ending the gateway session
+const CloseResumable = 4000
+
+// Heartbeat intervals without an ACK after which the connection is considered zombied
+const maxMissedAcks = 5
+
+// ErrShardAlreadyOpen is returned by Open when the shard is connected
+var ErrShardAlreadyOpen = errors.New("Shard is already open")
+
+// Shard is a lean gateway connection used by the raw dispatch fast path.
+// It handles identify, heartbeats, resumes and reconnects itself and hands
+// every dispatch over with its raw payload, without building discordgo structs.
+type Shard struct {
+	sync.Mutex
+
+	ID    int
+	Total int
+
+	// Gateway URL to connect to, without query string
+	Gateway string
+
+	// Gateway API version
+	Version string
+
+	// Identify payload sent when starting a new session,
+	// Token and Shard are filled in by the shard
+	Identify discordgo.Identify
+
+	// The dialer used for the websocket connection
+	Dialer *websocket.Dialer
+
+	// Compress requests zlib-stream transport compression
+	Compress bool
+
+	// If set, sent as guild_subscriptions in the identify payload
+	GuildSubscriptions *bool
+
+	// Called from the read loop for every dispatch, in sequence order.
+	// The event is not retained by the shard.
+	OnDispatch func(sh *Shard, e *discordgo.Event)
+
+	// Called on connection lifecycle events
+	OnEvent func(typ EventType, shard int, msg string)
+
+	token string
+
+	conn      *websocket.Conn
+	wsMutex   sync.Mutex
+	listening chan struct{}
+	stopped   bool
+
+	sessionID string
+	resumeURL string
+	userID    atomic.Value
+	sequence  int64
+	lastAck   int64
+
+	// Sequence of the last dispatch the manager forwarded, at most sequence
+	forwarded int64
+
+	compressedBytes   prometheus.Counter
+	decompressedBytes prometheus.Counter
+}
+
+// SessionInfo holds what is needed to resume a gateway session
+type SessionInfo struct {
+	SessionID string `json:"session_id,omitempty"`
+	Sequence  int64  `json:"seq,omitempty"`
+	ResumeURL string `json:"resume_url,omitempty"`
+}
+
+// NewShard creates a raw gateway shard with the same identify defaults as a discordgo session.
+func NewShard(token string, id, total int) *Shard {
+	sh := &Shard{
+		ID:      id,
+		Total:   total,
+		Version: discordgo.APIVersion,
+		Dialer:  websocket.DefaultDialer,
+		token:   token,
+
+		compressedBytes:   gatewayCompressedBytes.WithLabelValues(strconv.Itoa(id)),
+		decompressedBytes: gatewayDecompressedBytes.WithLabelValues(strconv.Itoa(id)),
+	}
+
+	sh.Identify.Properties.OS = runtime.GOOS
+	sh.Identify.Properties.Browser = "keti"
+	sh.Identify.Properties.Device = "keti"
+	sh.Identify.LargeThreshold = 250
+	sh.Identify.Intents = discordgo.IntentsAllWithoutPrivileged
+	sh.userID.Store("")
+
+	return sh
+}
+
+// UserID returns the bot user ID received in READY.
+func (sh *Shard) UserID() string {
+	return sh.userID.Load().(string)
+}
+
+// SessionID returns the current gateway session ID, empty until READY.
+func (sh *Shard) SessionID() string {
+	sh.Lock()
+	defer sh.Unlock()
+
+	return sh.sessionID
+}
+
+// Session returns the current gateway session, to be resumed later with Resume.
+func (sh *Shard) Session() SessionInfo {
+	sh.Lock()
+	defer sh.Unlock()
+
+	return SessionInfo{
+		SessionID: sh.sessionID,
+		Sequence:  sh.Sequence(),
+		ResumeURL: sh.resumeURL,
+	}
+}
+
+// Resume sets the gateway session the next Open resumes instead of identifying.
+func (sh *Shard) Resume(si SessionInfo) {
+	sh.Lock()
+	defer sh.Unlock()
+
+	sh.sessionID = si.SessionID
+	sh.resumeURL = si.ResumeURL
+	atomic.StoreInt64(&sh.sequence, si.Sequence)
+	atomic.StoreInt64(&sh.forwarded, si.Sequence)
+}
+
+// Sequence returns the last dispatch sequence received.
+func (sh *Shard) Sequence() int64 {
+	return atomic.LoadInt64(&sh.sequence)
+}
+
+// Open connects the shard to the gateway, resuming the previous session if there is one.
+func (sh *Shard) Open() error {
+	sh.Lock()
+	defer sh.Unlock()
+
+	if sh.conn != nil {
+		return ErrShardAlreadyOpen
+	}
+	sh.stopped = false
+
+	return sh.connect()
+}
+
+// Close closes the connection with a normal closure, which invalidates the session.
+func (sh *Shard) Close() error {
+	return sh.CloseWithCode(websocket.CloseNormalClosure)
+}
+
+// CloseWithCode closes the connection with the given close code.
+// Closing with 1000 or 1001 ends the session, any other code keeps it resumable.
+func (sh *Shard) CloseWithCode(code int) error {
+	sh.Lock()
+	defer sh.Unlock()
+
+	sh.stopped = true
+	if sh.conn == nil {
+		return nil
+	}
+
+	err := sh.disconnect(code)
+	if code == websocket.CloseNormalClosure || code == websocket.CloseGoingAway {
+		sh.sessionID = ""
+		sh.resumeURL = ""
+	}
+	sh.emit(EventClose, "")
+
+	return err
+}
+
+// connect dials the gateway and starts the read and heartbeat loops, it must be called with the lock held.
+func (sh *Shard) connect() error {
+	gateway := sh.Gateway
+	if sh.sessionID != "" && sh.resumeURL != "" {
+		gateway = sh.resumeURL
+	}
+
+	query := "?v=" + sh.Version + "&encoding=json"
+	var z *inflater
+	if sh.Compress {
+		query += "&compress=zlib-stream"
+		z = &inflater{}
+	}
+
+	conn, _, err := sh.Dialer.Dial(gateway+query, nil)
+	if err != nil {
+		return err
+	}
+
+	// The first message must be HELLO with the heartbeat interval
+	var hello struct {
+		Operation int `json:"op"`
+		Data      struct {
+			HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+		} `json:"d"`
+	}
+	msg, err := sh.read(conn, z)
+	if err == nil {
+		err = json.Unmarshal(msg, &hello)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if hello.Operation != opHello {
+		conn.Close()
+		return fmt.Errorf("Expected HELLO from gateway, got op %d", hello.Operation)
+	}
+
+	sh.conn = conn
+	sh.listening = make(chan struct{})
+	atomic.StoreInt64(&sh.lastAck, time.Now().UnixNano())
+
+	if sh.sessionID != "" {
+		err = sh.resume()
+	} else {
+		err = sh.identify()
+	}
+	if err != nil {
+		sh.disconnect(websocket.CloseServiceRestart)
+		return err
+	}
+
+	go sh.heartbeat(conn, sh.listening, hello.Data.HeartbeatInterval*time.Millisecond)
+	go sh.listen(conn, z, sh.listening)
+
+	sh.emit(EventConnected, "")
+
+	return nil
+}
+
+// disconnect closes the current connection, it must be called with the lock held.
+func (sh *Shard) disconnect(code int) error {
+	close(sh.listening)
+
+	sh.wsMutex.Lock()
+	err := sh.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+	sh.wsMutex.Unlock()
+
+	if e := sh.conn.Close(); err == nil {
+		err = e
+	}
+	sh.conn = nil
+
+	return err
+}
+
+func (sh *Shard) identify() error {
+	id := struct {
+		discordgo.Identify
+		GuildSubscriptions *bool `json:"guild_subscriptions,omitempty"`
+	}{sh.Identify, sh.GuildSubscriptions}
+	id.Token = sh.token
+	id.Shard = &[2]int{sh.ID, sh.Total}
+
+	return sh.send(opIdentify, id)
+}
+
+func (sh *Shard) resume() error {
+	return sh.send(opResume, struct {
+		Token     string `json:"token"`
+		SessionID string `json:"session_id"`
+		Sequence  int64  `json:"seq"`
+	}{sh.token, sh.sessionID, sh.Sequence()})
+}
+
+func (sh *Shard) send(op int, data interface{}) error {
+	sh.wsMutex.Lock()
+	defer sh.wsMutex.Unlock()
+
+	return sh.conn.WriteJSON(struct {
+		Operation int         `json:"op"`
+		Data      interface{} `json:"d"`
+	}{op, data})
+}
+
+func (sh *Shard) sendHeartbeat(conn *websocket.Conn) error {
+	sh.wsMutex.Lock()
+	defer sh.wsMutex.Unlock()
+
+	return conn.WriteJSON(struct {
+		Operation int   `json:"op"`
+		Data      int64 `json:"d"`
+	}{opHeartbeat, sh.Sequence()})
+}
+
+func (sh *Shard) heartbeat(conn *websocket.Conn, listening <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// Missing acks for several intervals means the connection is zombied
+		last := time.Unix(0, atomic.LoadInt64(&sh.lastAck))
+		if time.Since(last) > interval*maxMissedAcks {
+			sh.emit(EventError, "heartbeat ACK timeout, reconnecting")
+			go sh.reconnect(conn, 0)
+			return
+		}
+
+		if err := sh.sendHeartbeat(conn); err != nil {
+			// The read loop sees the broken connection and reconnects
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-listening:
+			return
+		}
+	}
+}
+
+// read returns the next complete gateway payload, decompressing it with z if set.
+func (sh *Shard) read(conn *websocket.Conn, z *inflater) ([]byte, error) {
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		sh.compressedBytes.Add(float64(len(msg)))
+
+		if z != nil {
+			if msg, err = z.Inflate(msg); err != nil {
+				return nil, err
+			}
+			if msg == nil {
+				// Partial message, the rest comes in the next frames
+				continue
+			}
+		}
+		sh.decompressedBytes.Add(float64(len(msg)))
+
+		return msg, nil
+	}
+}
+
+func (sh *Shard) listen(conn *websocket.Conn, z *inflater, listening <-chan struct{}) {
+	for {
+		msg, err := sh.read(conn, z)
+		if err != nil {
+			select {
+			case <-listening:
+				// Closed by us
+				return
+			default:
+			}
+
+			code := 0
+			if ce, ok := err.(*websocket.CloseError); ok {
+				code = ce.Code
+			}
+
+			sh.emit(EventDisconnected, err.Error())
+			sh.reconnect(conn, code)
+			return
+		}
+
+		sh.onMessage(conn, msg)
+	}
+}
+
+func (sh *Shard) onMessage(conn *websocket.Conn, msg []byte) {
+	var e discordgo.Event
+	if err := json.Unmarshal(msg, &e); err != nil {
+		sh.emit(EventError, "failed decoding gateway message: "+err.Error())
+		return
+	}
+
+	switch e.Operation {
+	case opDispatch:
+		atomic.StoreInt64(&sh.sequence, e.Sequence)
+
+		switch e.Type {
+		case "READY":
+			sh.onReady(e.RawData)
+		case "RESUMED":
+			sh.emit(EventResumed, "")
+		}
+
+		if sh.OnDispatch != nil {
+			sh.OnDispatch(sh, &e)
+		}
+	case opHeartbeat:
+		sh.sendHeartbeat(conn)
+	case opHeartbeatAck:
+		atomic.StoreInt64(&sh.lastAck, time.Now().UnixNano())
+	case opReconnect:
+		go sh.reconnect(conn, 0)
+	case opInvalidSession:
+		var resumable bool
+		json.Unmarshal(e.RawData, &resumable)
+		if !resumable {
+			sh.Lock()
+			sh.sessionID = ""
+			sh.Unlock()
+		}
+
+		// Discord asks to wait 1-5 seconds before identifying again, the read loop keeps going meanwhile
+		time.AfterFunc(time.Duration(1000+rand.Intn(4000))*time.Millisecond, func() {
+			sh.reconnect(conn, 0)
+		})
+	}
+}
+
+func (sh *Shard) onReady(data json.RawMessage) {
+	var r struct {
+		SessionID        string `json:"session_id"`
+		ResumeGatewayURL string `json:"resume_gateway_url"`
+		User             struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		sh.emit(EventError, "failed decoding READY: "+err.Error())
+		return
+	}
+
+	sh.Lock()
+	sh.sessionID = r.SessionID
+	sh.resumeURL = r.ResumeGatewayURL
+	sh.Unlock()
+
+	sh.userID.Store(r.User.ID)
+	sh.emit(EventReady, "")
+}
+
+// reconnect replaces the broken connection conn, retrying with backoff until
+// it succeeds or the shard is closed. It does nothing if conn was already replaced.
+func (sh *Shard) reconnect(conn *websocket.Conn, code int) {
+	sh.Lock()
+	if sh.conn != conn {
+		sh.Unlock()
+		return
+	}
+
+	sh.disconnect(websocket.CloseServiceRestart)
+	if _, ok := sessionCloseCodes[code]; ok {
+		sh.sessionID = ""
+	}
+	sh.Unlock()
+
+	if reason, ok := fatalCloseCodes[code]; ok {
+		sh.emit(EventError, fmt.Sprintf("gateway closed the connection with %d (%s), not reconnecting", code, reason))
+		return
+	}
+
+	wait := time.Second
+	for {
+		sh.Lock()
+		if sh.stopped || sh.conn != nil {
+			sh.Unlock()
+			return
+		}
+		err := sh.connect()
+		sh.Unlock()
+
+		if err == nil {
+			return
+		}
+
+		sh.emit(EventError, "reconnect failed: "+err.Error())
+
+		time.Sleep(wait)
+		if wait *= 2; wait > 10*time.Minute {
+			wait = 10 * time.Minute
+		}
+	}
+}
+
+func (sh *Shard) emit(typ EventType, msg string) {
+	if sh.OnEvent != nil {
+		sh.OnEvent(typ, sh.ID, msg)
+	}
+}
@@ -0,0 +1,120 @@
+package discord
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/codechimp-io/keti/codec"
+	"github.com/codechimp-io/keti/discord/discordtest"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// A MESSAGE_CREATE gateway message as sent by Discord
+var benchMessage = []byte(`{"op":0,"s":42,"t":"MESSAGE_CREATE","d":{"id":"1047566290853937192","type":0,` +
+	`"content":"Hello there, how are you doing today?","channel_id":"1047566110427250708",` +
+	`"author":{"id":"80351110224678912","username":"Nelly","avatar":"8342729096ea3675442027381ff50dfe","discriminator":"1337","public_flags":64},` +
+	`"member":{"roles":["41771983423143936","41771983423143937"],"joined_at":"2015-04-26T06:26:56.936000+00:00","deaf":false,"mute":false},` +
+	`"attachments":[],"embeds":[],"mentions":[],"mention_roles":[],"pinned":false,"mention_everyone":false,"tts":false,` +
+	`"timestamp":"2022-11-29T20:35:12.454000+00:00","edited_timestamp":null,"flags":0,"components":[],"nonce":"1047566289859887104",` +
+	`"guild_id":"41771983423143937"}}`)
+
+// TestShardInvalidSession checks the shard keeps reading while it waits to identify again after op 9.
+func TestShardInvalidSession(t *testing.T) {
+	srv := discordtest.NewServer()
+	defer srv.Close()
+
+	dispatches := make(chan string, 10)
+	sh := NewShard("token", 0, 1)
+	sh.Gateway = srv.GatewayURL
+	sh.OnDispatch = func(sh *Shard, e *discordgo.Event) {
+		dispatches <- e.Type
+	}
+	if err := sh.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer sh.Close()
+
+	if err := srv.WaitReady(0, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if typ := <-dispatches; typ != "READY" {
+		t.Fatalf("Got %s, want READY", typ)
+	}
+
+	if err := srv.InvalidateSession(0, false); err != nil {
+		t.Fatal(err)
+	}
+	// Sent on the invalidated connection before the shard identifies again, at least a second later
+	if err := srv.Dispatch(0, "MESSAGE_CREATE", map[string]string{"id": "1047566290853937192"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case typ := <-dispatches:
+		if typ != "MESSAGE_CREATE" {
+			t.Fatalf("Got %s, want MESSAGE_CREATE", typ)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("The read loop is blocked after op 9")
+	}
+
+	select {
+	case typ := <-dispatches:
+		if typ != "READY" {
+			t.Fatalf("Got %s, want READY", typ)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The shard did not identify again")
+	}
+	if n := len(srv.Identifies()); n != 2 {
+		t.Errorf("%d IDENTIFY sent, want 2", n)
+	}
+}
+
+// BenchmarkDispatchRaw decodes a dispatch the way raw shards do and encodes its envelope,
+// the payload is never decoded.
+func BenchmarkDispatchRaw(b *testing.B) {
+	sh := &Shard{}
+	sh.OnDispatch = func(sh *Shard, e *discordgo.Event) {
+		evt := &codec.GatewayEvent{
+			Version:    codec.SchemaVersion,
+			Type:       e.Type,
+			Sequence:   e.Sequence,
+			GuildID:    payloadGuildID(e.Type, e.RawData),
+			ReceivedAt: time.Now(),
+			Data:       e.RawData,
+		}
+		if _, err := json.Marshal(evt); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchMessage)))
+	for i := 0; i < b.N; i++ {
+		sh.onMessage(nil, benchMessage)
+	}
+}
+
+// BenchmarkDispatchDiscordgo decodes a dispatch into its discordgo struct as sessions do,
+// then encodes the whole event as forwarding used to.
+func BenchmarkDispatchDiscordgo(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchMessage)))
+	for i := 0; i < b.N; i++ {
+		var e discordgo.Event
+		if err := json.Unmarshal(benchMessage, &e); err != nil {
+			b.Fatal(err)
+		}
+		mc := &discordgo.MessageCreate{}
+		if err := json.Unmarshal(e.RawData, mc); err != nil {
+			b.Fatal(err)
+		}
+		e.Struct = mc
+
+		if _, err := json.Marshal(&e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package discord
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+)
+
+// sessionsFile is the content of the file raw shard sessions are saved to on shutdown
+type sessionsFile struct {
+	ShardsTotal int                 `json:"shards_total"`
+	Sessions    map[int]SessionInfo `json:"sessions"`
+	SavedAt     time.Time           `json:"saved_at"`
+}
+
+// Drain stops forwarding dispatches, it returns once the ones being forwarded are published.
+// The shards stay connected, the dispatches received after are replayed when their sessions are resumed.
+func (m *Manager) Drain() {
+	m.dispatchMu.Lock()
+	m.draining = true
+	m.dispatchMu.Unlock()
+}
+
+// Shutdown drains the manager, flushes the published events to the broker, then closes the shards with a
+// resumable close code and saves their sessions to SessionsFile, within timeout. Only raw shard sessions
+// can be resumed by another process, discordgo sessions are closed without being saved.
+func (m *Manager) Shutdown(timeout time.Duration) {
+	m.stopOnce.Do(func() {
+		deadline := time.Now().Add(timeout)
+
+		// Dispatches blocked by the backpressure policy would hold Drain past the deadline
+		if m.Publisher != nil {
+			m.Publisher.SetDeadline(deadline)
+		}
+		m.Drain()
+
+		if m.nsc != nil {
+			if d := time.Until(deadline); d > 0 {
+				if err := m.nsc.FlushTimeout(d); err != nil {
+					log.Errorf("Cannot flush the events to the broker: %s", err)
+				}
+			}
+		}
+
+		sessions := m.closeShards()
+		if m.SessionsFile != "" && m.RawDispatch {
+			if err := saveSessions(m.SessionsFile, m.GetShardsTotal(), sessions); err != nil {
+				log.Errorf("Cannot save the gateway sessions: %s", err)
+			} else {
+				log.Infof("Saved %d gateway sessions to %s", len(sessions), m.SessionsFile)
+			}
+		}
+
+		m.Lock()
+		m.closedSessions = sessions
+		m.Unlock()
+		close(m.stopped)
+	})
+}
+
+// Stopped is closed once Shutdown has closed the shards.
+func (m *Manager) Stopped() <-chan struct{} {
+	return m.stopped
+}
+
+// ClosedSessions returns the sessions of the raw shards closed by Shutdown, by shard.
+func (m *Manager) ClosedSessions() map[int]SessionInfo {
+	m.RLock()
+	defer m.RUnlock()
+
+	sessions := make(map[int]SessionInfo, len(m.closedSessions))
+	for shard, si := range m.closedSessions {
+		sessions[shard] = si
+	}
+
+	return sessions
+}
+
+// closeShards closes every shard with a resumable close code and returns the raw shard sessions.
+func (m *Manager) closeShards() map[int]SessionInfo {
+	m.Lock()
+	defer m.Unlock()
+
+	sessions := make(map[int]SessionInfo, len(m.Shards))
+	for id, sh := range m.Shards {
+		si := forwardedSession(sh)
+		if err := sh.CloseWithCode(CloseResumable); err != nil {
+			log.Errorf("Error closing Discord ShardID: %d: %s", id, err)
+		}
+		if si.SessionID != "" {
+			sessions[id] = si
+		}
+		delete(m.Shards, id)
+	}
+	for id, s := range m.Sessions {
+		if err := s.CloseWithCode(CloseResumable); err != nil {
+			log.Errorf("Error closing Discord ShardID: %d: %s", id, err)
+		}
+		delete(m.Sessions, id)
+		delete(m.sessionIDs, id)
+	}
+
+	return sessions
+}
+
+// forwardedSession returns the session of the shard with the sequence of the last dispatch forwarded,
+// so that the ones received after it are replayed when it is resumed.
+func forwardedSession(sh *Shard) SessionInfo {
+	si := sh.Session()
+	si.Sequence = atomic.LoadInt64(&sh.forwarded)
+
+	return si
+}
+
+func saveSessions(path string, total int, sessions map[int]SessionInfo) error {
+	data, err := json.Marshal(&sessionsFile{
+		ShardsTotal: total,
+		Sessions:    sessions,
+		SavedAt:     time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Written aside then renamed, a partial file would fail every resume
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// loadSessions reads the sessions saved by a previous shutdown and removes the file, they can only
+// be resumed once. It returns nil if there is no file.
+func loadSessions(path string, total int) (map[int]SessionInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+
+	var f sessionsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.ShardsTotal != total {
+		return nil, fmt.Errorf("Sessions saved for %d shards, not %d", f.ShardsTotal, total)
+	}
+
+	return f.Sessions, nil
+}
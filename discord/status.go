@@ -0,0 +1,137 @@
+package discord
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// StatusInterval is how often the status message of the status channel is updated
+var StatusInterval = time.Minute
+
+// ShardStatus is the state of a running shard
+type ShardStatus struct {
+	Shard int `json:"shard"`
+
+	// Gateway session, only known for raw shards
+	SessionInfo
+
+	// Guilds of the shard and how many of them are unavailable
+	Guilds      int `json:"guilds"`
+	Unavailable int `json:"unavailable"`
+
+	// Set until the guilds announced in READY are received
+	Loading bool `json:"loading"`
+}
+
+// Status returns the state of the running shards, by shard ID.
+func (m *Manager) Status() []ShardStatus {
+	running := m.RunningShards()
+
+	status := make([]ShardStatus, 0, len(running))
+	m.guilds.Lock()
+	for id, session := range running {
+		st := ShardStatus{Shard: id, SessionInfo: session}
+		if sg, ok := m.guilds.shards[id]; ok {
+			st.Guilds = len(sg.guilds)
+			for _, available := range sg.guilds {
+				if !available {
+					st.Unavailable++
+				}
+			}
+			st.Loading = sg.pending != nil
+		}
+		status = append(status, st)
+	}
+	m.guilds.Unlock()
+
+	sort.Slice(status, func(i, j int) bool { return status[i].Shard < status[j].Shard })
+
+	return status
+}
+
+// SetStatusChannel changes the channel the status message is kept up to date in, empty to stop
+// updating it. A new message is sent to the new channel.
+func (m *Manager) SetStatusChannel(channel string) {
+	m.logMu.Lock()
+	m.StatusChannel = channel
+	m.logMu.Unlock()
+
+	select {
+	case m.statusChanged <- struct{}{}:
+	default:
+	}
+}
+
+// updateStatusMessage sends the status of the shards to the status channel, then edits that message
+// every interval until ctx is done.
+func (m *Manager) updateStatusMessage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var channel, message string
+	for {
+		m.logMu.Lock()
+		current := m.StatusChannel
+		m.logMu.Unlock()
+		if current != channel {
+			channel, message = current, ""
+		}
+
+		if channel != "" {
+			message = m.sendStatus(channel, message)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.statusChanged:
+		}
+	}
+}
+
+// sendStatus edits the status message in channel, or sends a new one if there is none yet or
+// it is gone, and returns its ID.
+func (m *Manager) sendStatus(channel, message string) string {
+	status := m.Status()
+
+	lines := make([]string, len(status))
+	for i, st := range status {
+		lines[i] = fmt.Sprintf("Shard %d: %d guilds, %d unavailable", st.Shard, st.Guilds, st.Unavailable)
+		if st.Loading {
+			lines[i] += ", loading"
+		}
+	}
+
+	title := "Shards"
+	if m.Name != "" {
+		title = m.Name + ": shards"
+	}
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("%s (%d of %d)", title, len(status), m.GetShardsTotal()),
+		Description: strings.Join(lines, "\n"),
+		Timestamp:   time.Now().Format(time.RFC3339),
+		Color:       eventColors[EventReady],
+	}
+
+	if message != "" {
+		if _, err := m.rest().ChannelMessageEditEmbed(channel, message, embed); err == nil {
+			return message
+		}
+	}
+
+	msg, err := m.rest().ChannelMessageSendEmbed(channel, embed)
+	if err != nil {
+		log.Errorf("Cannot send the status message to channel %s: %s", channel, err)
+		return ""
+	}
+
+	return msg.ID
+}
@@ -0,0 +1,49 @@
+package discord
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// Every complete message of a zlib-stream connection ends with a sync flush
+var zlibSuffix = []byte{0x00, 0x00, 0xff, 0xff}
+
+// inflater decompresses the zlib-stream transport of a gateway connection,
+// a single zlib context shared by all the messages of the connection.
+type inflater struct {
+	in  bytes.Buffer
+	out bytes.Buffer
+	r   io.ReadCloser
+	buf [32 * 1024]byte
+}
+
+// Inflate feeds a websocket message to the stream and returns the decompressed
+// payload, or nil if the message is incomplete. The returned slice is only valid
+// until the next call.
+func (z *inflater) Inflate(msg []byte) ([]byte, error) {
+	z.in.Write(msg)
+	if !bytes.HasSuffix(msg, zlibSuffix) {
+		return nil, nil
+	}
+
+	if z.r == nil {
+		r, err := zlib.NewReader(&z.in)
+		if err != nil {
+			return nil, err
+		}
+		z.r = r
+	}
+
+	// bytes.Buffer is a ByteReader, so the decompressor never reads past the flush
+	z.out.Reset()
+	for z.in.Len() > 0 {
+		n, err := z.r.Read(z.buf[:])
+		z.out.Write(z.buf[:n])
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	return z.out.Bytes(), nil
+}
@@ -0,0 +1,69 @@
+package interactions
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Deferrer acknowledges the interactions received over the gateway that match its rules
+type Deferrer struct {
+	// Longest a deferred response may take, Discord rejects the ones sent after 3 seconds
+	Timeout time.Duration
+
+	mu    sync.RWMutex
+	rules Rules
+}
+
+// NewDeferrer creates a deferrer applying rules.
+func NewDeferrer(rules Rules) *Deferrer {
+	return &Deferrer{Timeout: 3 * time.Second, rules: rules}
+}
+
+// Rules returns the rules applied.
+func (d *Deferrer) Rules() Rules {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.rules
+}
+
+// SetRules replaces the rules applied.
+func (d *Deferrer) SetRules(rules Rules) {
+	d.mu.Lock()
+	d.rules = rules
+	d.mu.Unlock()
+}
+
+// Defer sends the deferred response of a matching INTERACTION_CREATE payload through the
+// REST session s, and reports whether it did. It implements discord.InteractionDeferrer.
+func (d *Deferrer) Defer(s *discordgo.Session, data []byte) (bool, error) {
+	rules := d.Rules()
+	if len(rules) == 0 {
+		return false, nil
+	}
+
+	i, err := parseInteraction(data)
+	if err != nil {
+		return false, err
+	}
+
+	resp := rules.response(i)
+	if resp == nil {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+
+	err = s.InteractionRespond(&discordgo.Interaction{ID: i.ID, Token: i.Token}, resp, discordgo.WithContext(ctx))
+	if err != nil {
+		deferredCounter.WithLabelValues("gateway", "error").Inc()
+		return false, err
+	}
+	deferredCounter.WithLabelValues("gateway", "ok").Inc()
+
+	return true, nil
+}
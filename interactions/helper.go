@@ -0,0 +1,78 @@
+package interactions
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/broker"
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/log"
+)
+
+func init() {
+	config.RegisterCheck("KETI_INTERACTIONS_DEFER", func(c *config.Config) error {
+		_, err := ParseRules(c.Interactions.Defer)
+		return err
+	})
+}
+
+// Run starts the HTTP interactions endpoint if an address is set in config, and returns the deferrer
+// of the rules in config, which defers nothing while it has none, and the endpoint handler if serving.
+func Run(ctx context.Context, wg *sync.WaitGroup, p *broker.Publisher) (*Deferrer, *Handler) {
+	ic := config.Options.Interactions
+
+	rules, err := ParseRules(ic.Defer)
+	if err != nil {
+		log.Fatalf("Invalid KETI_INTERACTIONS_DEFER: %s", err)
+	}
+
+	d := NewDeferrer(rules)
+	if ic.Addr == "" {
+		return d, nil
+	}
+
+	h, err := NewHandler(ic.PublicKey, d, p)
+	if err != nil {
+		log.Fatalf("Cannot configure the interactions endpoint: %s", err)
+	}
+	if total := config.Options.Discord.ShardTotal; total > 0 {
+		h.ShardTotal = total
+	}
+	h.SetSubject(config.Options.Broker.EventsSubject)
+
+	serve(ctx, wg, ic.Addr, h)
+
+	return d, h
+}
+
+func serve(ctx context.Context, wg *sync.WaitGroup, addr string, h http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/interactions", h)
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+		log.Info("Interactions server stopped")
+	}()
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Interactions server failed: %s", err)
+		}
+	}()
+
+	log.Infof("Serving interactions on http://%s/interactions", addr)
+}
@@ -0,0 +1,182 @@
+package interactions
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/broker"
+	"github.com/codechimp-io/keti/codec"
+	"github.com/codechimp-io/keti/discord"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/nats-io/nuid"
+)
+
+// Maximum size of an interaction request body
+const maxBodySize = 1 << 20
+
+// Largest difference between a request signature timestamp and now, older requests may be replays
+const maxTimestampSkew = 5 * time.Second
+
+// Handler is an HTTP interactions endpoint, to be set as the interactions endpoint URL of
+// the application. Requests are verified with the application public key and forwarded on
+// the broker like gateway INTERACTION_CREATE dispatches. The HTTP response is the only way
+// to acknowledge them, so every interaction is deferred, ephemerally when the rules of the
+// deferrer say so.
+type Handler struct {
+	PublicKey ed25519.PublicKey
+	Deferrer  *Deferrer
+
+	// Total number of shards of the bot, used to attribute interactions to the shard of their guild
+	ShardTotal int
+
+	publisher *broker.Publisher
+
+	// Subject interactions are published on, change it with SetSubject once serving
+	mu      sync.RWMutex
+	subject string
+}
+
+// NewHandler creates an endpoint verifying requests with the hex encoded public key and publishing
+// with p, which applies the backpressure policy like for gateway dispatches.
+func NewHandler(publicKey string, d *Deferrer, p *broker.Publisher) (*Handler, error) {
+	key, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid interactions public key size")
+	}
+
+	return &Handler{
+		PublicKey:  ed25519.PublicKey(key),
+		Deferrer:   d,
+		ShardTotal: 1,
+		publisher:  p,
+		subject:    discord.EventsSubject,
+	}, nil
+}
+
+// SetSubject changes the subject interactions are published on.
+func (h *Handler) SetSubject(subject string) {
+	h.mu.Lock()
+	h.subject = subject
+	h.mu.Unlock()
+}
+
+// ServeHTTP verifies, publishes and acknowledges an interaction.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.fail(w, http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		h.fail(w, http.StatusBadRequest)
+		return
+	}
+
+	if !h.verify(r.Header.Get("X-Signature-Ed25519"), r.Header.Get("X-Signature-Timestamp"), body) {
+		h.fail(w, http.StatusUnauthorized)
+		return
+	}
+
+	i, err := parseInteraction(body)
+	if err != nil {
+		h.fail(w, http.StatusBadRequest)
+		return
+	}
+
+	var resp *discordgo.InteractionResponse
+	switch i.Type {
+	case discordgo.InteractionPing:
+		resp = &discordgo.InteractionResponse{Type: discordgo.InteractionResponsePong}
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		// Autocompletes cannot be deferred, workers never get to answer them over HTTP
+		resp = &discordgo.InteractionResponse{
+			Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+			Data: &discordgo.InteractionResponseData{Choices: []*discordgo.ApplicationCommandOptionChoice{}},
+		}
+	default:
+		if resp = h.Deferrer.Rules().response(i); resp == nil {
+			resp = deferredResponse(i.Type, Rule{})
+		}
+	}
+
+	if i.Type != discordgo.InteractionPing {
+		deferred := i.Type != discordgo.InteractionApplicationCommandAutocomplete
+		if err := h.publish(i, body, deferred); err != nil {
+			log.Errorf("Cannot publish HTTP interaction: %s", err)
+			h.fail(w, http.StatusInternalServerError)
+			return
+		}
+		if deferred {
+			deferredCounter.WithLabelValues("http", "ok").Inc()
+		}
+	}
+
+	httpRequestsCounter.WithLabelValues("200").Inc()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) verify(signature, timestamp string, body []byte) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize || timestamp == "" {
+		return false
+	}
+
+	// The timestamp is signed, checking it rejects captured requests sent again later
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > maxTimestampSkew || skew < -maxTimestampSkew {
+		return false
+	}
+
+	msg := make([]byte, 0, len(timestamp)+len(body))
+	msg = append(msg, timestamp...)
+	msg = append(msg, body...)
+
+	return ed25519.Verify(h.PublicKey, msg, sig)
+}
+
+// publish forwards the interaction in the same envelope as gateway dispatches.
+func (h *Handler) publish(i *interaction, body []byte, deferred bool) error {
+	shard := 0
+	if id, err := strconv.ParseUint(i.GuildID, 10, 64); err == nil && h.ShardTotal > 0 {
+		shard = int((id >> 22) % uint64(h.ShardTotal))
+	}
+
+	h.mu.RLock()
+	subject := h.subject
+	h.mu.RUnlock()
+
+	return h.publisher.Publish(subject, &broker.GatewayEvent{
+		Version:    codec.SchemaVersion,
+		BotID:      i.ApplicationID,
+		Shard:      shard,
+		ShardTotal: h.ShardTotal,
+		Type:       "INTERACTION_CREATE",
+		ID:         nuid.Next(),
+		GuildID:    i.GuildID,
+		ReceivedAt: time.Now(),
+		Deferred:   deferred,
+		Data:       body,
+	})
+}
+
+func (h *Handler) fail(w http.ResponseWriter, code int) {
+	httpRequestsCounter.WithLabelValues(strconv.Itoa(code)).Inc()
+	http.Error(w, http.StatusText(code), code)
+}
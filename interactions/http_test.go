@@ -0,0 +1,62 @@
+package interactions
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const pingBody = `{"type":1,"id":"1","application_id":"2"}`
+
+func signedRequest(priv ed25519.PrivateKey, timestamp, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/interactions", strings.NewReader(body))
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+	req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(ed25519.Sign(priv, []byte(timestamp+body))))
+
+	return req
+}
+
+func TestHandlerVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHandler(hex.EncodeToString(pub), NewDeferrer(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		code int
+	}{
+		{"unsigned", httptest.NewRequest(http.MethodPost, "/interactions", strings.NewReader(pingBody)), http.StatusUnauthorized},
+		{"signed", signedRequest(priv, strconv.FormatInt(now.Unix(), 10), pingBody), http.StatusOK},
+		{"stale", signedRequest(priv, strconv.FormatInt(now.Add(-time.Minute).Unix(), 10), pingBody), http.StatusUnauthorized},
+		{"future", signedRequest(priv, strconv.FormatInt(now.Add(time.Minute).Unix(), 10), pingBody), http.StatusUnauthorized},
+		{"not a timestamp", signedRequest(priv, "yesterday", pingBody), http.StatusUnauthorized},
+		{"other key", signedRequest(other, strconv.FormatInt(now.Unix(), 10), pingBody), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, tt.req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: got %d, want %d", tt.name, rec.Code, tt.code)
+		}
+		if tt.code == http.StatusOK && strings.TrimSpace(rec.Body.String()) != `{"type":1}` {
+			t.Errorf("%s: got %s, want a PONG", tt.name, rec.Body.String())
+		}
+	}
+}
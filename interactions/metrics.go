@@ -0,0 +1,22 @@
+package interactions
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deferredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_interactions_deferred_total",
+		Help: "Interactions acknowledged with a deferred response, by ingress and result",
+	}, []string{"ingress", "result"})
+
+	httpRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_interactions_http_requests_total",
+		Help: "Requests received by the HTTP interactions endpoint, by status code",
+	}, []string{"code"})
+)
+
+func init() {
+	prometheus.MustRegister(deferredCounter)
+	prometheus.MustRegister(httpRequestsCounter)
+}
@@ -0,0 +1,111 @@
+// Package interactions acknowledges Discord interactions with a deferred response
+// before they are forwarded, and receives them over HTTP as an alternative to the gateway.
+package interactions
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Wildcard matches every command, component and modal without a rule of its own
+const Wildcard = "*"
+
+// Rule is how an interaction is deferred
+type Rule struct {
+	// Only the user sees the deferred response and its follow-ups
+	Ephemeral bool
+}
+
+// Rules maps command names, and custom IDs of components and modals, to the way they are deferred
+type Rules map[string]Rule
+
+// ParseRules parses rules given as name or name:ephemeral, the name * matching everything else.
+func ParseRules(specs []string) (Rules, error) {
+	rules := make(Rules, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		name, opt := spec, ""
+		if i := strings.LastIndexByte(spec, ':'); i >= 0 {
+			name, opt = spec[:i], spec[i+1:]
+		}
+
+		switch opt {
+		case "":
+			rules[name] = Rule{}
+		case "ephemeral":
+			rules[name] = Rule{Ephemeral: true}
+		default:
+			return nil, fmt.Errorf("Unknown option %q in interaction rule %q", opt, spec)
+		}
+	}
+
+	return rules, nil
+}
+
+// interaction holds the fields of an INTERACTION_CREATE payload the rules look at
+type interaction struct {
+	ID            string                    `json:"id"`
+	ApplicationID string                    `json:"application_id"`
+	Type          discordgo.InteractionType `json:"type"`
+	Token         string                    `json:"token"`
+	GuildID       string                    `json:"guild_id"`
+	Data          struct {
+		Name     string `json:"name"`
+		CustomID string `json:"custom_id"`
+	} `json:"data"`
+}
+
+func parseInteraction(data []byte) (*interaction, error) {
+	var i interaction
+	if err := json.Unmarshal(data, &i); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// response returns the deferred response for the interaction, or nil if no rule matches.
+// Pings and autocompletes are never deferred.
+func (r Rules) response(i *interaction) *discordgo.InteractionResponse {
+	var key string
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		key = i.Data.Name
+	case discordgo.InteractionMessageComponent, discordgo.InteractionModalSubmit:
+		key = i.Data.CustomID
+	default:
+		return nil
+	}
+
+	rule, ok := r[key]
+	if !ok {
+		if rule, ok = r[Wildcard]; !ok {
+			return nil
+		}
+	}
+
+	return deferredResponse(i.Type, rule)
+}
+
+func deferredResponse(typ discordgo.InteractionType, rule Rule) *discordgo.InteractionResponse {
+	// Components update the message they belong to, the rest answers with a new message
+	if typ == discordgo.InteractionMessageComponent {
+		return &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredMessageUpdate}
+	}
+
+	resp := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	}
+	if rule.Ephemeral {
+		resp.Data = &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral}
+	}
+
+	return resp
+}
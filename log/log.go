@@ -26,6 +26,15 @@ func init() {
 	stdlog.SetOutput(Logger)
 }
 
+// SetDebug logs debug messages when debug is set, and from the info level otherwise.
+func SetDebug(debug bool) {
+	if debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
+
 func WithCaller(name string) {
 	Logger = Logger.With().Str(zerolog.CallerFieldName, name).Logger()
 }
@@ -0,0 +1,85 @@
+// Package metrics serves the Prometheus metrics registered by keti.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+	"github.com/codechimp-io/keti/version"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func init() {
+	prometheus.MustRegister(version.NewMetricsCollector())
+}
+
+// Server serves the metrics over HTTP, on an address that can change while running
+type Server struct {
+	sync.Mutex
+
+	addr string
+	srv  *http.Server
+}
+
+// Run starts the metrics HTTP server on addr, it does not listen while addr is empty.
+// The server stops when ctx is done.
+func Run(ctx context.Context, wg *sync.WaitGroup, addr string) *Server {
+	s := &Server{}
+	s.SetAddr(addr)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+
+		s.SetAddr("")
+	}()
+
+	return s
+}
+
+// SetAddr moves the server to addr, stopping it if addr is empty.
+func (s *Server) SetAddr(addr string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if addr == s.addr {
+		return
+	}
+
+	if s.srv != nil {
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		s.srv.Shutdown(sctx)
+		cancel()
+		s.srv = nil
+		log.Info("Metrics server stopped")
+	}
+
+	s.addr = addr
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+	s.srv = srv
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics server failed: %s", err)
+		}
+	}()
+
+	log.Infof("Serving metrics on http://%s/metrics", addr)
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/log"
+	"github.com/codechimp-io/keti/ratelimit"
+)
+
+// Run serves the REST proxy if an address is set in config. Without a shared limiter,
+// the proxy gets one of its own.
+func Run(ctx context.Context, wg *sync.WaitGroup, limiter *ratelimit.Limiter) {
+	pc := config.Options.Proxy
+	if pc.Addr == "" {
+		return
+	}
+
+	p, err := New(pc.Upstream, config.Options.Discord.BotToken())
+	if err != nil {
+		log.Fatalf("Invalid KETI_PROXY_UPSTREAM: %s", err)
+	}
+	p.Secret = pc.Secret
+	p.Retries = pc.Retries
+	p.Backoff = pc.Backoff
+
+	if limiter == nil {
+		limiter = ratelimit.New(config.Options.RateLimit.GlobalLimit)
+	}
+	p.Limiter = limiter
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/", p)
+
+	srv := &http.Server{
+		Addr:    pc.Addr,
+		Handler: mux,
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+		log.Info("REST proxy stopped")
+	}()
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("REST proxy failed: %s", err)
+		}
+	}()
+
+	log.Infof("Serving the Discord REST API on http://%s/api/", pc.Addr)
+}
@@ -0,0 +1,23 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "keti_proxy_request_duration_seconds",
+		Help:    "Latency of the proxied REST requests, retries included, by route and status",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "status"})
+
+	retriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_proxy_retries_total",
+		Help: "Proxied REST requests retried, by route and reason",
+	}, []string{"route", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(retriesCounter)
+}
@@ -0,0 +1,235 @@
+// Package proxy serves the Discord REST API over HTTP with the bot token added,
+// within the shared rate limits.
+package proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+	"github.com/codechimp-io/keti/ratelimit"
+	"github.com/codechimp-io/keti/version"
+)
+
+// DefaultUpstream is the Discord API origin requests are forwarded to
+const DefaultUpstream = "https://discord.com"
+
+// SecretHeader carries the shared secret clients authenticate with, it is not forwarded
+const SecretHeader = "X-Keti-Secret"
+
+// Largest request body accepted, attachments included
+const maxBodySize = 25 << 20
+
+// Headers not forwarded, in either direction
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Proxy is a reverse proxy for the Discord REST API. Requests keep their path, e.g. /api/v10/...,
+// get the bot token, wait for the rate limiter and are retried on 429 responses. Failures and 5xx
+// responses are only retried for idempotent methods, the others may have been applied.
+type Proxy struct {
+	Upstream *url.URL
+
+	// Authorization header value, Bot <token>
+	Token string
+
+	// If set, requests without it in SecretHeader are rejected
+	Secret string
+
+	// If set, every attempt waits for it and reports its response
+	Limiter ratelimit.RateLimiter
+
+	// Retries of a request, and the delay before the first one, doubling after
+	Retries int
+	Backoff time.Duration
+
+	Client *http.Client
+}
+
+// New creates a proxy to upstream authenticating with token.
+func New(upstream, token string) (*Proxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Proxy{
+		Upstream: u,
+		Token:    token,
+		Retries:  3,
+		Backoff:  500 * time.Millisecond,
+		Client:   &http.Client{Timeout: 20 * time.Second},
+	}, nil
+}
+
+// ServeHTTP forwards the request and copies the final response back.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	route := label(ratelimit.Route(r.Method, r.URL.Path))
+
+	if p.Secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(p.Secret)) != 1 {
+		p.fail(w, route, start, http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		p.fail(w, route, start, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp, err := p.do(r, body, route)
+	if err != nil {
+		log.Errorf("Cannot proxy %s %s: %s", r.Method, r.URL.Path, err)
+		p.fail(w, route, start, http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	h := w.Header()
+	for k, vs := range resp.Header {
+		h[k] = vs
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+
+	requestDuration.WithLabelValues(route, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+}
+
+// do sends the request until it is not rate limited nor failed, or the retries are exhausted.
+func (p *Proxy) do(r *http.Request, body []byte, route string) (*http.Response, error) {
+	target := *p.Upstream
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+
+	for attempt := 0; ; attempt++ {
+		if p.Limiter != nil {
+			if err := p.Limiter.Wait(r.Context(), r.Method, r.URL.Path); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := http.NewRequest(r.Method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(r.Context())
+		for k, vs := range r.Header {
+			req.Header[k] = vs
+		}
+		for _, k := range hopHeaders {
+			req.Header.Del(k)
+		}
+		req.Header.Del(SecretHeader)
+		req.Header.Set("Authorization", p.Token)
+		if req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", "DiscordBot (https://github.com/codechimp-io/keti, "+version.Version+")")
+		}
+
+		resp, err := p.Client.Do(req)
+		last := attempt >= p.Retries
+		if err != nil {
+			if last || !idempotent(r.Method) || r.Context().Err() != nil {
+				return nil, err
+			}
+			retriesCounter.WithLabelValues(route, "error").Inc()
+			if !p.sleep(r, p.backoff(attempt)) {
+				return nil, r.Context().Err()
+			}
+			continue
+		}
+		if p.Limiter != nil {
+			p.Limiter.Report(r.Method, r.URL.Path, resp.StatusCode, resp.Header)
+		}
+
+		var delay time.Duration
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			retriesCounter.WithLabelValues(route, "429").Inc()
+			retry, _ := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64)
+			delay = time.Duration(retry * float64(time.Second))
+		case resp.StatusCode >= 500 && idempotent(r.Method):
+			retriesCounter.WithLabelValues(route, "5xx").Inc()
+			delay = p.backoff(attempt)
+		default:
+			return resp, nil
+		}
+		if last {
+			return resp, nil
+		}
+
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if !p.sleep(r, delay) {
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// idempotent reports whether a request with method can be sent again after failing.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+func (p *Proxy) backoff(attempt int) time.Duration {
+	return time.Duration(float64(p.Backoff) * math.Pow(2, float64(attempt)))
+}
+
+// sleep waits for d, it returns false if the client went away first.
+func (p *Proxy) sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (p *Proxy) fail(w http.ResponseWriter, route string, start time.Time, code int) {
+	requestDuration.WithLabelValues(route, strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+	http.Error(w, http.StatusText(code), code)
+}
+
+// label turns a rate limit route into a metric label, without its major parameters
+func label(route string) string {
+	parts := strings.Split(route, "/")
+	for i, p := range parts {
+		if i > 0 && p != "" && strings.Trim(p, "0123456789") == "" {
+			parts[i] = ":id"
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
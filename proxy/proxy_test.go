@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codechimp-io/keti/ratelimit"
+)
+
+// discord is an httptest stand-in for the Discord API answering with the scripted responses in turn,
+// the last one over and over
+type discord struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses []func(w http.ResponseWriter)
+	requests  []*http.Request
+	bodies    []string
+	times     []time.Time
+}
+
+func newDiscord(t *testing.T, responses ...func(w http.ResponseWriter)) *discord {
+	t.Helper()
+
+	d := &discord{responses: responses}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		d.mu.Lock()
+		n := len(d.requests)
+		d.requests = append(d.requests, r)
+		d.bodies = append(d.bodies, string(body))
+		d.times = append(d.times, time.Now())
+		d.mu.Unlock()
+
+		if n >= len(d.responses) {
+			n = len(d.responses) - 1
+		}
+		d.responses[n](w)
+	}))
+	t.Cleanup(d.Close)
+
+	return d
+}
+
+func (d *discord) Requests() []*http.Request {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]*http.Request(nil), d.requests...)
+}
+
+func status(code int, header ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(`{"message":"` + http.StatusText(code) + `"}`))
+	}
+}
+
+func ok(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"id":"1047566290853937192"}`))
+}
+
+// newProxy serves a proxy to d until the test ends.
+func newProxy(t *testing.T, d *discord) (*Proxy, *httptest.Server) {
+	t.Helper()
+
+	p, err := New(d.URL, "Bot s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Backoff = 10 * time.Millisecond
+	p.Limiter = ratelimit.New(50)
+
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+
+	return p, srv
+}
+
+func TestProxyToken(t *testing.T) {
+	d := newDiscord(t, ok)
+	_, srv := newProxy(t, d)
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v10/channels/1/messages?nonce=2", strings.NewReader(`{"content":"hi"}`))
+	req.Header.Set("Authorization", "Bot someone-else")
+	req.Header.Set("X-Audit-Log-Reason", "test")
+	// Not sent, the proxy sets its own
+	req.Header.Set("User-Agent", "")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != `{"id":"1047566290853937192"}` {
+		t.Fatalf("Got %d %s", resp.StatusCode, body)
+	}
+
+	reqs := d.Requests()
+	if len(reqs) != 1 {
+		t.Fatalf("Discord got %d requests, want 1", len(reqs))
+	}
+	r := reqs[0]
+	if got := r.Header.Get("Authorization"); got != "Bot s3cret" {
+		t.Errorf("Authorization = %q, want the bot token", got)
+	}
+	if r.URL.Path != "/api/v10/channels/1/messages" || r.URL.RawQuery != "nonce=2" {
+		t.Errorf("Forwarded to %s", r.URL)
+	}
+	if got := r.Header.Get("X-Audit-Log-Reason"); got != "test" {
+		t.Errorf("X-Audit-Log-Reason = %q, want it forwarded", got)
+	}
+	if !strings.HasPrefix(r.Header.Get("User-Agent"), "DiscordBot (") {
+		t.Errorf("User-Agent = %q, want a DiscordBot one", r.Header.Get("User-Agent"))
+	}
+}
+
+func TestProxyRetryAfter(t *testing.T) {
+	d := newDiscord(t,
+		status(http.StatusTooManyRequests, "Retry-After", "0.2", "X-RateLimit-Scope", "user"),
+		ok,
+	)
+	_, srv := newProxy(t, d)
+
+	resp, err := http.Post(srv.URL+"/api/v10/channels/1/messages", "application/json", strings.NewReader(`{"content":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got %d, want the retried 200", resp.StatusCode)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.requests) != 2 {
+		t.Fatalf("Discord got %d requests, want 2", len(d.requests))
+	}
+	if wait := d.times[1].Sub(d.times[0]); wait < 200*time.Millisecond {
+		t.Errorf("Retried after %s, before Retry-After", wait)
+	}
+
+	// The retried request is sent again whole
+	for i, body := range d.bodies {
+		if body != `{"content":"hi"}` {
+			t.Errorf("Request %d body = %q", i+1, body)
+		}
+	}
+}
+
+func TestProxyServerErrors(t *testing.T) {
+	d := newDiscord(t, status(http.StatusBadGateway))
+	p, srv := newProxy(t, d)
+	p.Retries = 2
+
+	resp, err := http.Get(srv.URL + "/api/v10/users/@me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The last response is passed on once the retries are exhausted
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Got %d, want 502", resp.StatusCode)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.requests) != 3 {
+		t.Fatalf("Discord got %d requests, want 3", len(d.requests))
+	}
+	// The backoff doubles: 10ms then 20ms
+	for i, min := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond} {
+		if wait := d.times[i+1].Sub(d.times[i]); wait < min {
+			t.Errorf("Retry %d after %s, want at least %s", i+1, wait, min)
+		}
+	}
+}
+
+func TestProxyNoRetryOnPost(t *testing.T) {
+	d := newDiscord(t, status(http.StatusInternalServerError))
+	p, srv := newProxy(t, d)
+	p.Retries = 2
+
+	// The message may have been sent before the error, sending it again could post it twice
+	resp, err := http.Post(srv.URL+"/api/v10/channels/1/messages", "application/json", strings.NewReader(`{"content":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError || len(d.Requests()) != 1 {
+		t.Fatalf("Got %d after %d requests, want a single 500", resp.StatusCode, len(d.Requests()))
+	}
+}
+
+func TestProxySecret(t *testing.T) {
+	d := newDiscord(t, ok)
+	p, srv := newProxy(t, d)
+	p.Secret = "shared"
+
+	for _, secret := range []string{"", "other"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v10/users/@me", nil)
+		if secret != "" {
+			req.Header.Set(SecretHeader, secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Got %d with secret %q, want 401", resp.StatusCode, secret)
+		}
+	}
+	if n := len(d.Requests()); n != 0 {
+		t.Fatalf("Discord got %d unauthenticated requests", n)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v10/users/@me", nil)
+	req.Header.Set(SecretHeader, "shared")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Got %d with the secret, want 200", resp.StatusCode)
+	}
+	if v := d.Requests()[0].Header.Get(SecretHeader); v != "" {
+		t.Errorf("Secret %q forwarded to Discord", v)
+	}
+}
+
+func TestProxyNoRetryOnClientErrors(t *testing.T) {
+	d := newDiscord(t, status(http.StatusNotFound))
+	_, srv := newProxy(t, d)
+
+	resp, err := http.Get(srv.URL + "/api/v10/channels/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound || len(d.Requests()) != 1 {
+		t.Fatalf("Got %d after %d requests, want a single 404", resp.StatusCode, len(d.Requests()))
+	}
+}
+
+func TestProxyHopHeaders(t *testing.T) {
+	d := newDiscord(t, func(w http.ResponseWriter) {
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("X-RateLimit-Bucket", "abc")
+		ok(w)
+	})
+	_, srv := newProxy(t, d)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v10/users/@me", nil)
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	req.Header.Set("Te", "trailers")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	r := d.Requests()[0]
+	for _, k := range []string{"Proxy-Authorization", "Te", "Upgrade"} {
+		if v := r.Header.Get(k); v != "" {
+			t.Errorf("%s: %q forwarded to Discord", k, v)
+		}
+	}
+	for _, k := range []string{"Proxy-Authenticate", "Keep-Alive"} {
+		if v := resp.Header.Get(k); v != "" {
+			t.Errorf("%s: %q returned to the client", k, v)
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Bucket") != "abc" {
+		t.Error("X-RateLimit-Bucket was not returned to the client")
+	}
+}
+
+func TestLabel(t *testing.T) {
+	tests := map[string]string{
+		"POST /channels/123/messages":                "POST /channels/:id/messages",
+		"PATCH /webhooks/1047566290853937192/:token": "PATCH /webhooks/:id/:token",
+		"PUT /guilds/1/members/:id/roles/:id":        "PUT /guilds/:id/members/:id/roles/:id",
+		"POST /interactions/:id/:token/callback":     "POST /interactions/:id/:token/callback",
+	}
+
+	for route, want := range tests {
+		if got := label(route); got != want {
+			t.Errorf("label(%s) = %s, want %s", route, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/go-nats"
+)
+
+// RateLimiter grants calls and learns from their responses, a Limiter or a Client.
+type RateLimiter interface {
+	Wait(ctx context.Context, method, path string) error
+	Report(method, path string, status int, h http.Header)
+}
+
+// Client asks the rate limit service of the keti instances for permission over the broker
+type Client struct {
+	// How long to wait for a reply to an acquire request
+	Timeout time.Duration
+
+	nc *nats.Conn
+}
+
+// NewClient creates a client of the service reachable over nc.
+func NewClient(nc *nats.Conn) *Client {
+	return &Client{Timeout: 5 * time.Second, nc: nc}
+}
+
+// Reserve asks for a call on the route, it returns 0 when granted or how long to wait before asking again.
+func (c *Client) Reserve(method, path string) (time.Duration, error) {
+	data, err := json.Marshal(&Request{Method: method, Path: path})
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := c.nc.Request(AcquireSubject, data, c.Timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	var g Grant
+	if err := json.Unmarshal(msg.Data, &g); err != nil {
+		return 0, err
+	}
+
+	return g.Wait, nil
+}
+
+// Wait blocks until a call on the route is granted, or ctx is done.
+func (c *Client) Wait(ctx context.Context, method, path string) error {
+	return wait(ctx, func() (time.Duration, error) { return c.Reserve(method, path) })
+}
+
+// Report sends the response to a granted call to the service.
+func (c *Client) Report(method, path string, status int, h http.Header) {
+	data, err := json.Marshal(&Request{Method: method, Path: path, Status: status, Headers: h})
+	if err != nil {
+		return
+	}
+
+	c.nc.Publish(ReportSubject, data)
+}
+
+// Transport is an http.RoundTripper waiting for the rate limiter before every request
+type Transport struct {
+	// Used for the requests, http.DefaultTransport if nil
+	Base http.RoundTripper
+
+	Limiter RateLimiter
+}
+
+// RoundTrip waits for the route of the request to be granted, then reports its response.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if err := t.Limiter.Wait(req.Context(), req.Method, req.URL.Path); err != nil {
+		return nil, err
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.Limiter.Report(req.Method, req.URL.Path, resp.StatusCode, resp.Header)
+
+	return resp, nil
+}
@@ -0,0 +1,29 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Run creates the rate limiter and serves it over nc, it returns nil if it is disabled in config.
+func Run(ctx context.Context, nc *nats.Conn) *Limiter {
+	rc := config.Options.RateLimit
+	if !rc.Enabled {
+		return nil
+	}
+
+	l := New(rc.GlobalLimit)
+	if err := l.Serve(nc); err != nil {
+		log.Fatalf("Cannot subscribe to rate limit subjects: %s", err)
+	}
+	go l.prune(ctx, time.Minute)
+
+	log.Infof("Serving rate limits on %s, %d requests per second globally", AcquireSubject, rc.GlobalLimit)
+
+	return l
+}
@@ -0,0 +1,351 @@
+// Package ratelimit tracks the Discord REST rate limits from the bucket headers of the responses,
+// and shares them with the other instances and with clients over the broker.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nuid"
+)
+
+// DefaultGlobalLimit is the number of requests per second Discord allows a bot across all routes
+const DefaultGlobalLimit = 50
+
+// bucket is the state of a Discord rate limit bucket
+type bucket struct {
+	limit     int
+	remaining int
+	reset     time.Time
+
+	// Longest reset delay seen, taken as the length of the window
+	period time.Duration
+}
+
+// Limiter grants REST calls within the Discord rate limits.
+// Unknown routes are allowed until a response tells their bucket.
+type Limiter struct {
+	sync.Mutex
+
+	// Requests per second allowed across all routes, 0 to only follow global 429s
+	GlobalLimit int
+
+	// Bucket keys by route, and bucket states by bucket key
+	routes  map[string]string
+	buckets map[string]*bucket
+
+	// Set by a global 429
+	globalReset time.Time
+
+	// Requests granted in the current second
+	window time.Time
+	count  int
+
+	// Set when serving, to share the state with the other instances
+	nc *nats.Conn
+	id string
+}
+
+// New creates a limiter allowing globalLimit requests per second.
+func New(globalLimit int) *Limiter {
+	return &Limiter{
+		GlobalLimit: globalLimit,
+		routes:      make(map[string]string),
+		buckets:     make(map[string]*bucket),
+		id:          nuid.Next(),
+	}
+}
+
+// SetGlobalLimit changes the number of requests per second allowed across all routes.
+func (l *Limiter) SetGlobalLimit(n int) {
+	l.Lock()
+	l.GlobalLimit = n
+	l.Unlock()
+}
+
+// Route returns the rate limit route of a request, the path with the IDs and tokens replaced except
+// the major parameters, which get buckets of their own.
+func Route(method, path string) string {
+	path = strings.Trim(path, "/")
+	path = strings.TrimPrefix(path, "api/")
+	if strings.HasPrefix(path, "v") {
+		if i := strings.IndexByte(path, '/'); i > 0 {
+			if _, err := strconv.Atoi(path[1:i]); err == nil {
+				path = path[i+1:]
+			}
+		}
+	}
+
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		prev := ""
+		if i > 0 {
+			prev = parts[i-1]
+		}
+
+		switch {
+		case prev == "channels" || prev == "guilds" || prev == "webhooks":
+			// Major parameter
+		case i > 1 && (parts[i-2] == "webhooks" || parts[i-2] == "interactions"):
+			// Tokens are secrets, and routes are shared with the other instances
+			parts[i] = ":token"
+		case prev == "reactions":
+			parts[i] = ":emoji"
+		case isID(p):
+			parts[i] = ":id"
+		}
+	}
+
+	return method + " /" + strings.Join(parts, "/")
+}
+
+// major returns the major parameter of a route, its first channel, guild or webhook
+func major(route string) string {
+	parts := strings.Split(route, "/")
+	for i := 1; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "channels", "guilds", "webhooks":
+			return parts[i] + "/" + parts[i+1]
+		}
+	}
+
+	return ""
+}
+
+func isID(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Reserve grants a call on the route and returns 0, or returns how long to wait before asking again.
+func (l *Limiter) Reserve(method, path string) time.Duration {
+	route := Route(method, path)
+	now := time.Now()
+
+	l.Lock()
+
+	var wait time.Duration
+	if now.Before(l.globalReset) {
+		wait = l.globalReset.Sub(now)
+	}
+
+	if l.GlobalLimit > 0 {
+		if now.Sub(l.window) >= time.Second {
+			l.window, l.count = now, 0
+		}
+		if l.count >= l.GlobalLimit {
+			if w := l.window.Add(time.Second).Sub(now); w > wait {
+				wait = w
+			}
+		}
+	}
+
+	b := l.buckets[l.routes[route]]
+	if b != nil {
+		if !now.Before(b.reset) {
+			// Assume a new window until a response tells
+			b.remaining, b.reset = b.limit, now.Add(b.period)
+		} else if b.remaining <= 0 {
+			if w := b.reset.Sub(now); w > wait {
+				wait = w
+			}
+		}
+	}
+
+	if wait > 0 {
+		l.Unlock()
+		reservationsCounter.WithLabelValues("delayed").Inc()
+		return wait
+	}
+
+	l.count++
+	if b != nil {
+		b.remaining--
+	}
+	l.Unlock()
+
+	// Publishing may block on the broker connection, the other calls do not wait for it
+	reservationsCounter.WithLabelValues("granted").Inc()
+	l.publish(&update{Route: route, Reserved: true})
+
+	return 0
+}
+
+// Wait blocks until a call on the route is granted, or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, method, path string) error {
+	return wait(ctx, func() (time.Duration, error) { return l.Reserve(method, path), nil })
+}
+
+func wait(ctx context.Context, reserve func() (time.Duration, error)) error {
+	for {
+		d, err := reserve()
+		if err != nil || d <= 0 {
+			return err
+		}
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Report updates the limits from the response to a call on the route.
+func (l *Limiter) Report(method, path string, status int, h http.Header) {
+	u := parseHeaders(Route(method, path), status, h, time.Now())
+	if u == nil {
+		return
+	}
+
+	l.apply(u)
+	l.publish(u)
+}
+
+// update is a change of the limits, shared between instances
+type update struct {
+	Origin string `json:"origin"`
+	Route  string `json:"route"`
+
+	// Bucket state from the response headers
+	Bucket    string    `json:"bucket,omitempty"`
+	Limit     int       `json:"limit,omitempty"`
+	Remaining int       `json:"remaining,omitempty"`
+	Reset     time.Time `json:"reset,omitempty"`
+
+	// Set by a global 429
+	GlobalReset time.Time `json:"global_reset,omitempty"`
+
+	// A call on the route was granted
+	Reserved bool `json:"reserved,omitempty"`
+}
+
+// parseHeaders reads the rate limit headers of a response, or returns nil if it has none.
+func parseHeaders(route string, status int, h http.Header, now time.Time) *update {
+	u := &update{Route: route}
+
+	if status == http.StatusTooManyRequests {
+		retry, _ := strconv.ParseFloat(h.Get("Retry-After"), 64)
+		reset := now.Add(time.Duration(retry * float64(time.Second)))
+
+		scope := h.Get("X-RateLimit-Scope")
+		if h.Get("X-RateLimit-Global") == "true" || scope == "global" {
+			u.GlobalReset = reset
+			scope = "global"
+		} else if u.Bucket = h.Get("X-RateLimit-Bucket"); u.Bucket != "" {
+			u.Reset = reset
+		}
+		if scope == "" {
+			scope = "user"
+		}
+		limitedCounter.WithLabelValues(scope).Inc()
+
+		if u.Bucket == "" && u.GlobalReset.IsZero() {
+			return nil
+		}
+		return u
+	}
+
+	if u.Bucket = h.Get("X-RateLimit-Bucket"); u.Bucket == "" {
+		return nil
+	}
+	u.Limit, _ = strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	u.Remaining, _ = strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	resetAfter, _ := strconv.ParseFloat(h.Get("X-RateLimit-Reset-After"), 64)
+	u.Reset = now.Add(time.Duration(resetAfter * float64(time.Second)))
+
+	return u
+}
+
+// apply merges an update into the state. Responses come back out of order, so within
+// the same reset window the lowest remaining count wins.
+func (l *Limiter) apply(u *update) {
+	l.Lock()
+	defer l.Unlock()
+
+	if u.GlobalReset.After(l.globalReset) {
+		l.globalReset = u.GlobalReset
+	}
+
+	if u.Reserved {
+		now := time.Now()
+		if now.Sub(l.window) >= time.Second {
+			l.window, l.count = now, 0
+		}
+		l.count++
+		if b := l.buckets[l.routes[u.Route]]; b != nil && now.Before(b.reset) {
+			b.remaining--
+		}
+		return
+	}
+
+	if u.Bucket == "" {
+		return
+	}
+
+	key := u.Bucket + " " + major(u.Route)
+	l.routes[u.Route] = key
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{remaining: u.Remaining}
+		l.buckets[key] = b
+	}
+	if u.Limit > 0 {
+		if p := u.Reset.Sub(now); p > b.period {
+			b.period = p
+		}
+	}
+
+	switch {
+	case !ok:
+		b.limit, b.reset = u.Limit, u.Reset
+	case u.Limit == 0:
+		// 429 without the bucket state
+		b.remaining = 0
+		if u.Reset.After(b.reset) {
+			b.reset = u.Reset
+		}
+	case u.Reset.Sub(b.reset) > time.Second || !now.Before(b.reset):
+		// New window
+		b.limit, b.remaining, b.reset = u.Limit, u.Remaining, u.Reset
+	case u.Remaining < b.remaining:
+		b.remaining = u.Remaining
+	}
+}
+
+// publish shares an update with the other instances.
+func (l *Limiter) publish(u *update) {
+	if l.nc == nil {
+		return
+	}
+
+	u.Origin = l.id
+	data, err := json.Marshal(u)
+	if err != nil {
+		log.Errorf("Cannot encode rate limit update: %s", err)
+		return
+	}
+	if err := l.nc.Publish(SyncSubject, data); err != nil {
+		log.Errorf("Cannot publish on %s: %s", SyncSubject, err)
+	}
+}
@@ -0,0 +1,216 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		method, path, route string
+	}{
+		{"POST", "/api/v10/channels/123/messages", "POST /channels/123/messages"},
+		{"PATCH", "/api/v9/channels/123/messages/456", "PATCH /channels/123/messages/:id"},
+		{"PUT", "/api/v10/guilds/1/members/2/roles/3", "PUT /guilds/1/members/:id/roles/:id"},
+		{"PUT", "/api/v10/channels/1/messages/2/reactions/%F0%9F%91%8D/@me", "PUT /channels/1/messages/:id/reactions/:emoji/@me"},
+		{"POST", "/api/v10/interactions/55/aW50ZXJhY3Rpb24/callback", "POST /interactions/:id/:token/callback"},
+		{"POST", "/api/v10/webhooks/1047566290853937192/s3cretT0ken", "POST /webhooks/1047566290853937192/:token"},
+		{"PATCH", "/api/v10/webhooks/1047566290853937192/s3cretT0ken/messages/@original", "PATCH /webhooks/1047566290853937192/:token/messages/@original"},
+		{"GET", "/api/v10/webhooks/1047566290853937192", "GET /webhooks/1047566290853937192"},
+		{"GET", "/gateway/bot", "GET /gateway/bot"},
+	}
+
+	for _, tt := range tests {
+		if got := Route(tt.method, tt.path); got != tt.route {
+			t.Errorf("Route(%s, %s) = %s, want %s", tt.method, tt.path, got, tt.route)
+		}
+	}
+}
+
+func TestMajor(t *testing.T) {
+	tests := map[string]string{
+		"POST /channels/123/messages":               "channels/123",
+		"PUT /guilds/1/members/:id/roles/:id":       "guilds/1",
+		"POST /webhooks/1047566290853937192/:token": "webhooks/1047566290853937192",
+		"POST /interactions/:id/:token/callback":    "",
+		"GET /users/@me":                            "",
+	}
+
+	for route, want := range tests {
+		if got := major(route); got != want {
+			t.Errorf("major(%s) = %q, want %q", route, got, want)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	now := time.Now()
+	route := "POST /channels/123/messages"
+
+	tests := []struct {
+		name    string
+		status  int
+		headers map[string]string
+		want    *update
+	}{
+		{
+			"bucket state",
+			http.StatusOK,
+			map[string]string{"X-RateLimit-Bucket": "abc", "X-RateLimit-Limit": "5", "X-RateLimit-Remaining": "4", "X-RateLimit-Reset-After": "2.5"},
+			&update{Route: route, Bucket: "abc", Limit: 5, Remaining: 4, Reset: now.Add(2500 * time.Millisecond)},
+		},
+		{
+			"no bucket",
+			http.StatusOK,
+			map[string]string{"X-RateLimit-Limit": "5"},
+			nil,
+		},
+		{
+			"global 429",
+			http.StatusTooManyRequests,
+			map[string]string{"X-RateLimit-Global": "true", "Retry-After": "1.5"},
+			&update{Route: route, GlobalReset: now.Add(1500 * time.Millisecond)},
+		},
+		{
+			"global scope 429",
+			http.StatusTooManyRequests,
+			map[string]string{"X-RateLimit-Scope": "global", "X-RateLimit-Bucket": "abc", "Retry-After": "1"},
+			&update{Route: route, GlobalReset: now.Add(time.Second)},
+		},
+		{
+			"user scope 429",
+			http.StatusTooManyRequests,
+			map[string]string{"X-RateLimit-Scope": "user", "X-RateLimit-Bucket": "abc", "Retry-After": "2"},
+			&update{Route: route, Bucket: "abc", Reset: now.Add(2 * time.Second)},
+		},
+		{
+			"shared scope 429",
+			http.StatusTooManyRequests,
+			map[string]string{"X-RateLimit-Scope": "shared", "X-RateLimit-Bucket": "abc", "Retry-After": "2"},
+			&update{Route: route, Bucket: "abc", Reset: now.Add(2 * time.Second)},
+		},
+		{
+			"429 without bucket",
+			http.StatusTooManyRequests,
+			map[string]string{"Retry-After": "2"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+
+		got := parseHeaders(route, tt.status, h, now)
+		if got == nil || tt.want == nil {
+			if got != tt.want {
+				t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+			}
+			continue
+		}
+		if *got != *tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	route := "POST /channels/123/messages"
+	state := func(remaining int, reset time.Duration) *update {
+		return &update{Route: route, Bucket: "abc", Limit: 5, Remaining: remaining, Reset: time.Now().Add(reset)}
+	}
+
+	tests := []struct {
+		name      string
+		updates   []*update
+		limit     int
+		remaining int
+		reset     time.Duration
+	}{
+		{"first response", []*update{state(4, 2*time.Second)}, 5, 4, 2 * time.Second},
+		{"out of order", []*update{state(2, 2*time.Second), state(3, 2*time.Second)}, 5, 2, 2 * time.Second},
+		{"lowest remaining", []*update{state(3, 2*time.Second), state(2, 2*time.Second)}, 5, 2, 2 * time.Second},
+		{"new window", []*update{state(0, time.Second), state(4, 3*time.Second)}, 5, 4, 3 * time.Second},
+		{"expired window", []*update{state(0, -time.Second), state(4, time.Second)}, 5, 4, time.Second},
+		{
+			"429 without bucket state",
+			[]*update{state(3, time.Second), {Route: route, Bucket: "abc", Reset: time.Now().Add(2 * time.Second)}},
+			5, 0, 2 * time.Second,
+		},
+		{
+			"429 first",
+			[]*update{{Route: route, Bucket: "abc", Reset: time.Now().Add(2 * time.Second)}},
+			0, 0, 2 * time.Second,
+		},
+		{"reserved", []*update{state(3, 2*time.Second), {Route: route, Reserved: true}}, 5, 2, 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		l := New(0)
+		for _, u := range tt.updates {
+			l.apply(u)
+		}
+
+		b := l.buckets[l.routes[route]]
+		if b == nil {
+			t.Errorf("%s: no bucket", tt.name)
+			continue
+		}
+		if b.limit != tt.limit || b.remaining != tt.remaining {
+			t.Errorf("%s: limit %d remaining %d, want %d and %d", tt.name, b.limit, b.remaining, tt.limit, tt.remaining)
+		}
+		if d := time.Until(b.reset) - tt.reset; d > 0 || d < -100*time.Millisecond {
+			t.Errorf("%s: reset in %s, want %s", tt.name, time.Until(b.reset), tt.reset)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	path := "/api/v10/channels/123/messages"
+	bucket := func(remaining int, reset time.Duration) func(*Limiter) {
+		return func(l *Limiter) {
+			l.apply(&update{Route: Route("POST", path), Bucket: "abc", Limit: 5, Remaining: remaining, Reset: time.Now().Add(reset)})
+		}
+	}
+
+	tests := []struct {
+		name  string
+		setup func(*Limiter)
+		path  string
+		wait  time.Duration
+	}{
+		{"unknown route", func(*Limiter) {}, path, 0},
+		{"remaining", bucket(1, 2*time.Second), path, 0},
+		{"exhausted", bucket(0, 2*time.Second), path, 2 * time.Second},
+		{"reset passed", bucket(0, -time.Second), path, 0},
+		{"other major parameter", bucket(0, 2*time.Second), "/api/v10/channels/456/messages", 0},
+		{"global 429", func(l *Limiter) { l.globalReset = time.Now().Add(time.Second) }, path, time.Second},
+		{"global limit", func(l *Limiter) { l.GlobalLimit, l.window, l.count = 2, time.Now(), 2 }, path, time.Second},
+		{"no global limit", func(l *Limiter) { l.GlobalLimit, l.window, l.count = 0, time.Now(), 100 }, path, 0},
+	}
+
+	for _, tt := range tests {
+		l := New(DefaultGlobalLimit)
+		tt.setup(l)
+
+		got := l.Reserve("POST", tt.path)
+		if tt.wait == 0 && got != 0 {
+			t.Errorf("%s: wait %s, want a grant", tt.name, got)
+		} else if tt.wait > 0 && (got <= tt.wait-100*time.Millisecond || got > tt.wait) {
+			t.Errorf("%s: wait %s, want %s", tt.name, got, tt.wait)
+		}
+	}
+
+	// Granted calls count against the bucket
+	l := New(DefaultGlobalLimit)
+	bucket(1, 2*time.Second)(l)
+	if got := l.Reserve("POST", path); got != 0 {
+		t.Fatalf("Wait %s for the last call of the bucket", got)
+	}
+	if got := l.Reserve("POST", path); got == 0 {
+		t.Error("Granted a call past the bucket limit")
+	}
+}
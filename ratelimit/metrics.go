@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reservationsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_ratelimit_reservations_total",
+		Help: "REST calls asked to the rate limiter, by result",
+	}, []string{"result"})
+
+	limitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_ratelimit_429_total",
+		Help: "REST responses rate limited by Discord, by scope",
+	}, []string{"scope"})
+
+	bucketsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "keti_ratelimit_buckets",
+		Help: "Rate limit buckets tracked",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reservationsCounter)
+	prometheus.MustRegister(limitedCounter)
+	prometheus.MustRegister(bucketsGauge)
+}
+
+// prune drops the buckets idle for longer than interval, and updates the bucket count.
+func (l *Limiter) prune(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-interval)
+
+			l.Lock()
+			for key, b := range l.buckets {
+				if b.reset.Before(cutoff) {
+					delete(l.buckets, key)
+				}
+			}
+			for route, key := range l.routes {
+				if _, ok := l.buckets[key]; !ok {
+					delete(l.routes, route)
+				}
+			}
+			bucketsGauge.Set(float64(len(l.buckets)))
+			l.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
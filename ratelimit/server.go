@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// Broker subjects of the rate limit service, requests and reports are JSON:
+//
+//	ratelimit.acquire   {"method": "POST", "path": "/channels/<id>/messages"}
+//	                    replied with {"wait": <nanoseconds>}, the call is granted when 0,
+//	                    otherwise ask again once the wait is over
+//	ratelimit.report    {"method": ..., "path": ..., "status": 200, "headers": {...}}
+//	                    the response to a granted call, with its headers
+const (
+	AcquireSubject = "ratelimit.acquire"
+	ReportSubject  = "ratelimit.report"
+
+	// SyncSubject is where instances share their updates
+	SyncSubject = "ratelimit.sync"
+)
+
+// Queue group of the instances answering acquire requests and reports
+const queueGroup = "keti.ratelimit"
+
+// Request asks for a call on a route, or reports its response
+type Request struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	// Set on reports
+	Status  int         `json:"status,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+// Grant is the reply to an acquire request
+type Grant struct {
+	Wait time.Duration `json:"wait"`
+}
+
+// Serve shares the limits with the other instances over nc, and answers the clients.
+func (l *Limiter) Serve(nc *nats.Conn) error {
+	l.Lock()
+	l.nc = nc
+	l.Unlock()
+
+	if _, err := nc.Subscribe(SyncSubject, l.onSync); err != nil {
+		return err
+	}
+	if _, err := nc.QueueSubscribe(AcquireSubject, queueGroup, l.onAcquire); err != nil {
+		return err
+	}
+	_, err := nc.QueueSubscribe(ReportSubject, queueGroup, l.onReport)
+
+	return err
+}
+
+func (l *Limiter) onSync(msg *nats.Msg) {
+	var u update
+	if err := json.Unmarshal(msg.Data, &u); err != nil {
+		log.Errorf("Cannot decode rate limit update: %s", err)
+		return
+	}
+	if u.Origin == l.id {
+		return
+	}
+
+	l.apply(&u)
+}
+
+func (l *Limiter) onAcquire(msg *nats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+
+	var req Request
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Errorf("Cannot decode rate limit request: %s", err)
+		return
+	}
+
+	data, _ := json.Marshal(&Grant{Wait: l.Reserve(req.Method, req.Path)})
+	if err := l.nc.Publish(msg.Reply, data); err != nil {
+		log.Errorf("Cannot reply to rate limit request: %s", err)
+	}
+}
+
+func (l *Limiter) onReport(msg *nats.Msg) {
+	var req Request
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		log.Errorf("Cannot decode rate limit report: %s", err)
+		return
+	}
+
+	// Header names may not be canonical
+	h := make(http.Header, len(req.Headers))
+	for k, vs := range req.Headers {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+
+	l.Report(req.Method, req.Path, req.Status, h)
+}
@@ -0,0 +1,190 @@
+// Package resp keeps a Redis protocol compatible store up to date with the
+// guilds, channels, roles and members derived from gateway dispatches.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error is an error reply sent by the server
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// ErrProtocol is returned when the server reply cannot be parsed
+var ErrProtocol = errors.New("Invalid RESP reply")
+
+// Conn is a minimal RESP client connection supporting pipelining, it is not safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// Timeout of every network operation, none when 0
+	Timeout time.Duration
+}
+
+// Dial connects to a RESP server.
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewConn(conn, timeout), nil
+}
+
+// NewConn wraps an established connection.
+func NewConn(conn net.Conn, timeout time.Duration) *Conn {
+	return &Conn{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		Timeout: timeout,
+	}
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a command and returns its reply, which is a string, an int64, a []byte,
+// a []interface{} or nil. Error replies are returned as Error.
+// It must not be called while pipelined replies are still to be received.
+func (c *Conn) Do(args ...string) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	return c.Receive()
+}
+
+// Send buffers a command, its reply is read with Receive after Flush.
+func (c *Conn) Send(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(arg))
+		c.w.WriteString(arg)
+		if _, err := c.w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush writes the buffered commands.
+func (c *Conn) Flush() error {
+	c.deadline()
+	return c.w.Flush()
+}
+
+// Receive reads the reply of the oldest command sent.
+func (c *Conn) Receive() (interface{}, error) {
+	c.deadline()
+
+	return readReply(c.r)
+}
+
+func (c *Conn) deadline() {
+	if c.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+}
+
+func isReplyError(err error) bool {
+	_, ok := err.(Error)
+	return ok
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrProtocol
+	}
+
+	return line[:len(line)-2], nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			// Errors inside arrays are kept as values
+			item, err := readReply(r)
+			if err != nil && !isReplyError(err) {
+				return nil, err
+			}
+			if err != nil {
+				item = err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+
+	return nil, ErrProtocol
+}
+
+// ReadCommand reads a command sent as an array of bulk strings, as servers do.
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, ErrProtocol
+	}
+
+	args := make([]string, len(items))
+	for i, item := range items {
+		b, ok := item.([]byte)
+		if !ok {
+			return nil, ErrProtocol
+		}
+		args[i] = string(b)
+	}
+
+	return args, nil
+}
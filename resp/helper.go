@@ -0,0 +1,36 @@
+package resp
+
+import (
+	"context"
+	"sync"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/log"
+	"github.com/codechimp-io/keti/state"
+)
+
+// Run starts the RESP state sink set in config, it returns nil if no address is set.
+func Run(ctx context.Context, wg *sync.WaitGroup) *Sink {
+	sc := config.Options.State
+	if sc.RedisAddr == "" {
+		return nil
+	}
+
+	entities, err := state.ParseEntities(sc.Entities)
+	if err != nil {
+		log.Fatalf("Invalid KETI_STATE_ENTITIES: %s", err)
+	}
+
+	s := NewSink(sc.RedisAddr, sc.RedisQueue)
+	s.Entities = entities
+	s.Password = sc.RedisPassword
+	s.DB = sc.RedisDB
+	s.Prefix = sc.RedisPrefix
+
+	wg.Add(1)
+	go s.Run(ctx, wg)
+
+	log.Infof("Writing state to %s under %s", sc.RedisAddr, sc.RedisPrefix)
+
+	return s
+}
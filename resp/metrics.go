@@ -0,0 +1,22 @@
+package resp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sinkAppliedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_resp_sink_applied_total",
+		Help: "Dispatches written to the RESP state store, by type",
+	}, []string{"type"})
+
+	sinkDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_resp_sink_dropped_total",
+		Help: "Dispatches not written to the RESP state store, by reason",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(sinkAppliedCounter)
+	prometheus.MustRegister(sinkDroppedCounter)
+}
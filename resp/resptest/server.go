@@ -0,0 +1,334 @@
+// Package resptest provides an in-memory Redis protocol server standing in for
+// the real thing when testing the RESP state sink.
+package resptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/codechimp-io/keti/resp"
+)
+
+// Server is an in-memory RESP server supporting the string and set commands used by resp.Sink
+type Server struct {
+	sync.Mutex
+
+	// Address the server listens on
+	Addr string
+
+	// If set, clients must AUTH with it
+	Password string
+
+	// Database read by Get, Members and Keys
+	DB int
+
+	listener  net.Listener
+	dbs       map[int]*keyspace
+	clients   map[net.Conn]struct{}
+	commands  int
+	pipelines int
+}
+
+// keyspace holds the keys of a database
+type keyspace struct {
+	strings map[string]string
+	sets    map[string]map[string]struct{}
+}
+
+func newKeyspace() *keyspace {
+	return &keyspace{
+		strings: make(map[string]string),
+		sets:    make(map[string]map[string]struct{}),
+	}
+}
+
+// NewServer starts a server listening on a random local port.
+func NewServer() (*Server, error) {
+	s, err := NewUnstartedServer()
+	if err != nil {
+		return nil, err
+	}
+	s.Start()
+
+	return s, nil
+}
+
+// NewUnstartedServer returns a server listening on a random local port, it accepts
+// connections once Start is called so that Password can be set.
+func NewUnstartedServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		Addr:     l.Addr().String(),
+		listener: l,
+		dbs:      make(map[int]*keyspace),
+		clients:  make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Start accepts connections.
+func (s *Server) Start() {
+	go s.serve()
+}
+
+// Close stops listening, established connections are left to the clients.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// CloseClients closes the established connections, the server keeps listening.
+func (s *Server) CloseClients() {
+	s.Lock()
+	defer s.Unlock()
+
+	for conn := range s.clients {
+		conn.Close()
+	}
+}
+
+// Get returns the string value of key.
+func (s *Server) Get(key string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	v, ok := s.db(s.DB).strings[key]
+	return v, ok
+}
+
+// Members returns the members of the set at key, sorted.
+func (s *Server) Members(key string) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.db(s.DB).members(key)
+}
+
+// Keys returns all the keys, sorted.
+func (s *Server) Keys() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	ks := s.db(s.DB)
+	keys := make([]string, 0, len(ks.strings)+len(ks.sets))
+	for k := range ks.strings {
+		keys = append(keys, k)
+	}
+	for k := range ks.sets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Commands returns the number of commands received.
+func (s *Server) Commands() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.commands
+}
+
+// Pipelines returns the number of times replies were written, once per batch of pipelined commands.
+func (s *Server) Pipelines() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.pipelines
+}
+
+// db returns the keyspace of database n, the lock must be held.
+func (s *Server) db(n int) *keyspace {
+	ks, ok := s.dbs[n]
+	if !ok {
+		ks = newKeyspace()
+		s.dbs[n] = ks
+	}
+
+	return ks
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	s.Lock()
+	s.clients[conn] = struct{}{}
+	s.Unlock()
+	defer func() {
+		s.Lock()
+		delete(s.clients, conn)
+		s.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authed := s.Password == ""
+	db := 0
+
+	for {
+		args, err := resp.ReadCommand(r)
+		if err != nil {
+			return
+		}
+
+		if len(args) > 0 && strings.ToUpper(args[0]) == "AUTH" {
+			if len(args) == 2 && args[1] == s.Password {
+				authed = true
+				w.WriteString("+OK\r\n")
+			} else {
+				w.WriteString("-WRONGPASS invalid password\r\n")
+			}
+		} else if !authed {
+			w.WriteString("-NOAUTH Authentication required.\r\n")
+		} else if len(args) == 2 && strings.ToUpper(args[0]) == "SELECT" {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 0 || n > 15 {
+				w.WriteString("-ERR DB index is out of range\r\n")
+			} else {
+				db = n
+				w.WriteString("+OK\r\n")
+			}
+		} else {
+			writeReply(w, s.exec(db, args))
+		}
+
+		// Flush once the pipelined commands were all handled
+		if r.Buffered() == 0 {
+			s.Lock()
+			s.pipelines++
+			s.Unlock()
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) exec(db int, args []string) interface{} {
+	s.Lock()
+	defer s.Unlock()
+
+	s.commands++
+	ks := s.db(db)
+
+	if len(args) == 0 {
+		return resp.Error("ERR empty command")
+	}
+
+	cmd := strings.ToUpper(args[0])
+	switch {
+	case cmd == "PING":
+		return "PONG"
+	case cmd == "FLUSHALL":
+		s.dbs = make(map[int]*keyspace)
+		return "OK"
+	case cmd == "GET" && len(args) == 2:
+		if v, ok := ks.strings[args[1]]; ok {
+			return []byte(v)
+		}
+		return nil
+	case cmd == "SET" && len(args) == 3:
+		delete(ks.sets, args[1])
+		ks.strings[args[1]] = args[2]
+		return "OK"
+	case cmd == "DEL" && len(args) > 1:
+		var n int64
+		for _, k := range args[1:] {
+			if _, ok := ks.strings[k]; ok {
+				n++
+			} else if _, ok := ks.sets[k]; ok {
+				n++
+			}
+			delete(ks.strings, k)
+			delete(ks.sets, k)
+		}
+		return n
+	case cmd == "SADD" && len(args) > 2:
+		set, ok := ks.sets[args[1]]
+		if !ok {
+			set = make(map[string]struct{})
+			ks.sets[args[1]] = set
+		}
+		var n int64
+		for _, m := range args[2:] {
+			if _, ok := set[m]; !ok {
+				set[m] = struct{}{}
+				n++
+			}
+		}
+		return n
+	case cmd == "SREM" && len(args) > 2:
+		set := ks.sets[args[1]]
+		var n int64
+		for _, m := range args[2:] {
+			if _, ok := set[m]; ok {
+				delete(set, m)
+				n++
+			}
+		}
+		if len(set) == 0 {
+			delete(ks.sets, args[1])
+		}
+		return n
+	case cmd == "SMEMBERS" && len(args) == 2:
+		members := ks.members(args[1])
+		items := make([]interface{}, len(members))
+		for i, m := range members {
+			items[i] = []byte(m)
+		}
+		return items
+	case cmd == "SCARD" && len(args) == 2:
+		return int64(len(ks.sets[args[1]]))
+	}
+
+	return resp.Error(fmt.Sprintf("ERR unknown command or wrong number of arguments for '%s'", args[0]))
+}
+
+func (ks *keyspace) members(key string) []string {
+	members := make([]string, 0, len(ks.sets[key]))
+	for m := range ks.sets[key] {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+
+	return members
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		w.WriteString("+" + v + "\r\n")
+	case resp.Error:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case []byte:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n")
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package resp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codechimp-io/keti/log"
+	"github.com/codechimp-io/keti/state"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ErrQueueFull is returned by HandleDispatch when the sink falls behind
+var ErrQueueFull = errors.New("State sink queue is full")
+
+// Dispatch types the sink applies
+var sinkEvents = map[string]struct{}{
+	"GUILD_CREATE":        struct{}{},
+	"GUILD_UPDATE":        struct{}{},
+	"GUILD_DELETE":        struct{}{},
+	"CHANNEL_CREATE":      struct{}{},
+	"CHANNEL_UPDATE":      struct{}{},
+	"CHANNEL_DELETE":      struct{}{},
+	"THREAD_CREATE":       struct{}{},
+	"THREAD_UPDATE":       struct{}{},
+	"THREAD_DELETE":       struct{}{},
+	"GUILD_ROLE_CREATE":   struct{}{},
+	"GUILD_ROLE_UPDATE":   struct{}{},
+	"GUILD_ROLE_DELETE":   struct{}{},
+	"GUILD_MEMBER_ADD":    struct{}{},
+	"GUILD_MEMBER_UPDATE": struct{}{},
+	"GUILD_MEMBER_REMOVE": struct{}{},
+	"GUILD_MEMBERS_CHUNK": struct{}{},
+}
+
+type dispatch struct {
+	typ  string
+	data []byte
+}
+
+// Sink writes the state derived from dispatches to a Redis protocol compatible server.
+// Keys, all under Prefix, are:
+//
+//	guild:<id>                  guild JSON, without its lists
+//	guild:<id>:channels         set of channel and thread IDs
+//	guild:<id>:roles            set of role IDs
+//	guild:<id>:members          set of member user IDs
+//	channel:<id>                channel or thread JSON
+//	role:<id>                   role JSON
+//	member:<guild_id>:<id>      member JSON
+//
+// Dispatches are queued and written in the background by Run.
+type Sink struct {
+	// Entities to write
+	state.Entities
+
+	// Server address, password and database
+	Addr     string
+	Password string
+	DB       int
+
+	// Prefix of every key
+	Prefix string
+
+	// Timeout of every network operation
+	Timeout time.Duration
+
+	queue chan dispatch
+	conn  *Conn
+}
+
+// NewSink creates a sink writing guilds, channels and roles to addr, queueing up to size dispatches.
+func NewSink(addr string, size int) *Sink {
+	return &Sink{
+		Entities: state.Entities{Guilds: true, Channels: true, Roles: true},
+		Addr:     addr,
+		Prefix:   "keti:",
+		Timeout:  5 * time.Second,
+		queue:    make(chan dispatch, size),
+	}
+}
+
+// HandleDispatch queues a dispatch received by shard, it implements discord.StateSink.
+func (s *Sink) HandleDispatch(shard int, e *discordgo.Event) error {
+	if _, ok := sinkEvents[e.Type]; !ok {
+		return nil
+	}
+
+	// The event is not ours to keep
+	d := dispatch{e.Type, append([]byte(nil), e.RawData...)}
+
+	select {
+	case s.queue <- d:
+		return nil
+	default:
+		sinkDroppedCounter.WithLabelValues("queue_full").Inc()
+		return ErrQueueFull
+	}
+}
+
+// Run writes the queued dispatches, reconnecting as needed, this is a blocking call until ctx is done.
+func (s *Sink) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		select {
+		case d := <-s.queue:
+			if err := s.write(d); err != nil {
+				log.Errorf("Cannot write %s to the state store: %s", d.typ, err)
+				sinkDroppedCounter.WithLabelValues("error").Inc()
+			}
+		case <-ctx.Done():
+			if s.conn != nil {
+				s.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// write applies a dispatch, dropping the connection on network errors.
+func (s *Sink) write(d dispatch) error {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	err := s.apply(d.typ, d.data)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return err
+	}
+
+	sinkAppliedCounter.WithLabelValues(d.typ).Inc()
+	return nil
+}
+
+func (s *Sink) dial() (*Conn, error) {
+	conn, err := Dial(s.Addr, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Password != "" {
+		if _, err := conn.Do("AUTH", s.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.DB != 0 {
+		if _, err := conn.Do("SELECT", strconv.Itoa(s.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// apply translates a dispatch to commands and sends them in one pipeline.
+func (s *Sink) apply(typ string, data []byte) error {
+	p := &pipeline{conn: s.conn}
+
+	switch typ {
+	case "GUILD_CREATE":
+		var g struct {
+			ID       string            `json:"id"`
+			Channels []json.RawMessage `json:"channels"`
+			Threads  []json.RawMessage `json:"threads"`
+			Roles    []json.RawMessage `json:"roles"`
+			Members  []json.RawMessage `json:"members"`
+		}
+		if err := json.Unmarshal(data, &g); err != nil {
+			return err
+		}
+
+		// A guild coming back after an outage replaces everything we knew
+		if err := s.clearGuild(p, g.ID); err != nil {
+			return err
+		}
+
+		if s.Guilds {
+			_, stripped, err := state.StripGuild(data)
+			if err != nil {
+				return err
+			}
+			p.send("SET", s.Prefix+"guild:"+g.ID, string(stripped))
+		}
+		if s.Channels {
+			for _, list := range [][]json.RawMessage{g.Channels, g.Threads} {
+				for _, ch := range list {
+					if err := s.putChannel(p, g.ID, ch); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if s.Roles {
+			for _, r := range g.Roles {
+				if err := s.putRole(p, g.ID, r); err != nil {
+					return err
+				}
+			}
+		}
+		if s.Members {
+			for _, mb := range g.Members {
+				if err := s.putMember(p, g.ID, mb); err != nil {
+					return err
+				}
+			}
+		}
+
+	case "GUILD_UPDATE":
+		if !s.Guilds {
+			return nil
+		}
+
+		id, stripped, err := state.StripGuild(data)
+		if err != nil {
+			return err
+		}
+		p.send("SET", s.Prefix+"guild:"+id, string(stripped))
+
+	case "GUILD_DELETE":
+		var g struct {
+			ID          string `json:"id"`
+			Unavailable bool   `json:"unavailable"`
+		}
+		if err := json.Unmarshal(data, &g); err != nil {
+			return err
+		}
+
+		// Outages keep the state, the guild comes back with a GUILD_CREATE
+		if !g.Unavailable {
+			if err := s.clearGuild(p, g.ID); err != nil {
+				return err
+			}
+		}
+
+	case "CHANNEL_CREATE", "CHANNEL_UPDATE", "THREAD_CREATE", "THREAD_UPDATE":
+		if !s.Channels {
+			return nil
+		}
+
+		var ch struct {
+			GuildID string `json:"guild_id"`
+		}
+		if err := json.Unmarshal(data, &ch); err != nil {
+			return err
+		}
+		if ch.GuildID == "" {
+			// Private channels are not stored
+			return nil
+		}
+		if err := s.putChannel(p, ch.GuildID, data); err != nil {
+			return err
+		}
+
+	case "CHANNEL_DELETE", "THREAD_DELETE":
+		var ch struct {
+			ID      string `json:"id"`
+			GuildID string `json:"guild_id"`
+		}
+		if err := json.Unmarshal(data, &ch); err != nil {
+			return err
+		}
+		p.send("SREM", s.Prefix+"guild:"+ch.GuildID+":channels", ch.ID)
+		p.send("DEL", s.Prefix+"channel:"+ch.ID)
+
+	case "GUILD_ROLE_CREATE", "GUILD_ROLE_UPDATE":
+		if !s.Roles {
+			return nil
+		}
+
+		var r struct {
+			GuildID string          `json:"guild_id"`
+			Role    json.RawMessage `json:"role"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if err := s.putRole(p, r.GuildID, r.Role); err != nil {
+			return err
+		}
+
+	case "GUILD_ROLE_DELETE":
+		var r struct {
+			GuildID string `json:"guild_id"`
+			RoleID  string `json:"role_id"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		p.send("SREM", s.Prefix+"guild:"+r.GuildID+":roles", r.RoleID)
+		p.send("DEL", s.Prefix+"role:"+r.RoleID)
+
+	case "GUILD_MEMBER_ADD", "GUILD_MEMBER_UPDATE":
+		if !s.Members {
+			return nil
+		}
+
+		var mb struct {
+			GuildID string `json:"guild_id"`
+		}
+		if err := json.Unmarshal(data, &mb); err != nil {
+			return err
+		}
+		if err := s.putMember(p, mb.GuildID, data); err != nil {
+			return err
+		}
+
+	case "GUILD_MEMBER_REMOVE":
+		var mb struct {
+			GuildID string `json:"guild_id"`
+			User    struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		}
+		if err := json.Unmarshal(data, &mb); err != nil {
+			return err
+		}
+		p.send("SREM", s.Prefix+"guild:"+mb.GuildID+":members", mb.User.ID)
+		p.send("DEL", s.Prefix+"member:"+mb.GuildID+":"+mb.User.ID)
+
+	case "GUILD_MEMBERS_CHUNK":
+		if !s.Members {
+			return nil
+		}
+
+		var chunk struct {
+			GuildID string            `json:"guild_id"`
+			Members []json.RawMessage `json:"members"`
+		}
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return err
+		}
+		for _, mb := range chunk.Members {
+			if err := s.putMember(p, chunk.GuildID, mb); err != nil {
+				return err
+			}
+		}
+	}
+
+	return p.exec()
+}
+
+func (s *Sink) putChannel(p *pipeline, guildID string, data json.RawMessage) error {
+	id, err := objectID(data)
+	if err != nil {
+		return err
+	}
+
+	p.send("SET", s.Prefix+"channel:"+id, string(data))
+	p.send("SADD", s.Prefix+"guild:"+guildID+":channels", id)
+
+	return nil
+}
+
+func (s *Sink) putRole(p *pipeline, guildID string, data json.RawMessage) error {
+	id, err := objectID(data)
+	if err != nil {
+		return err
+	}
+
+	p.send("SET", s.Prefix+"role:"+id, string(data))
+	p.send("SADD", s.Prefix+"guild:"+guildID+":roles", id)
+
+	return nil
+}
+
+func (s *Sink) putMember(p *pipeline, guildID string, data json.RawMessage) error {
+	var mb struct {
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(data, &mb); err != nil {
+		return err
+	}
+
+	p.send("SET", s.Prefix+"member:"+guildID+":"+mb.User.ID, string(data))
+	p.send("SADD", s.Prefix+"guild:"+guildID+":members", mb.User.ID)
+
+	return nil
+}
+
+// clearGuild queues the deletion of the guild and everything indexed under it,
+// it must be called before any command is queued in p.
+func (s *Sink) clearGuild(p *pipeline, id string) error {
+	guild := s.Prefix + "guild:" + id
+
+	lists := []struct {
+		set, prefix string
+	}{
+		{guild + ":channels", s.Prefix + "channel:"},
+		{guild + ":roles", s.Prefix + "role:"},
+		{guild + ":members", s.Prefix + "member:" + id + ":"},
+	}
+
+	// Read the indexes first, the replies of p are only read by exec
+	for _, l := range lists {
+		if err := s.conn.Send("SMEMBERS", l.set); err != nil {
+			return err
+		}
+	}
+	if err := s.conn.Flush(); err != nil {
+		return err
+	}
+	replies := make([]interface{}, len(lists))
+	for i := range lists {
+		reply, err := s.conn.Receive()
+		if err != nil {
+			return err
+		}
+		replies[i] = reply
+	}
+
+	for i, l := range lists {
+		members, _ := replies[i].([]interface{})
+		for _, m := range members {
+			if b, ok := m.([]byte); ok {
+				p.send("DEL", l.prefix+string(b))
+			}
+		}
+		p.send("DEL", l.set)
+	}
+	p.send("DEL", guild)
+
+	return nil
+}
+
+// pipeline buffers commands and reads all their replies at once
+type pipeline struct {
+	conn *Conn
+	n    int
+	err  error
+}
+
+func (p *pipeline) send(args ...string) {
+	if p.err == nil {
+		p.err = p.conn.Send(args...)
+		p.n++
+	}
+}
+
+// exec flushes the commands and returns the first error, network errors first.
+func (p *pipeline) exec() error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.n == 0 {
+		return nil
+	}
+	if err := p.conn.Flush(); err != nil {
+		return err
+	}
+
+	var replyErr error
+	for ; p.n > 0; p.n-- {
+		if _, err := p.conn.Receive(); err != nil {
+			if _, ok := err.(Error); !ok {
+				return err
+			}
+			if replyErr == nil {
+				replyErr = err
+			}
+		}
+	}
+
+	return replyErr
+}
+
+func objectID(data json.RawMessage) (string, error) {
+	var o struct {
+		ID string `json:"id"`
+	}
+	err := json.Unmarshal(data, &o)
+
+	return o.ID, err
+}
@@ -0,0 +1,198 @@
+package resp_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codechimp-io/keti/resp"
+	"github.com/codechimp-io/keti/resp/resptest"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const guildCreate = `{"id":"100","name":"Guild","unavailable":false,` +
+	`"channels":[{"id":"101","type":0,"name":"general"},{"id":"102","type":2,"name":"voice"}],` +
+	`"threads":[{"id":"103","type":11,"name":"thread","parent_id":"101"}],` +
+	`"roles":[{"id":"100","name":"@everyone"},{"id":"104","name":"mods"}],` +
+	`"members":[{"user":{"id":"105"},"roles":["104"]}]}`
+
+// startSink runs a sink against srv until the test ends.
+func startSink(t *testing.T, srv *resptest.Server, configure func(*resp.Sink)) *resp.Sink {
+	t.Helper()
+
+	s := resp.NewSink(srv.Addr, 100)
+	s.Timeout = time.Second
+	if configure != nil {
+		configure(s)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go s.Run(ctx, wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	return s
+}
+
+// newServer starts a server with the given password until the test ends.
+func newServer(t *testing.T, password string) *resptest.Server {
+	t.Helper()
+
+	srv, err := resptest.NewUnstartedServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Password = password
+	srv.Start()
+	t.Cleanup(func() { srv.Close() })
+
+	return srv
+}
+
+func dispatch(t *testing.T, s *resp.Sink, typ, data string) {
+	t.Helper()
+
+	if err := s.HandleDispatch(0, &discordgo.Event{Type: typ, RawData: []byte(data)}); err != nil {
+		t.Fatalf("HandleDispatch %s: %s", typ, err)
+	}
+}
+
+// waitKey waits until key is set on srv.
+func waitKey(t *testing.T, srv *resptest.Server, key string) string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if v, ok := srv.Get(key); ok {
+			return v
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Key %s was never set, keys: %v", key, srv.Keys())
+
+	return ""
+}
+
+func TestSinkGuildCreate(t *testing.T) {
+	srv := newServer(t, "")
+	s := startSink(t, srv, func(s *resp.Sink) {
+		s.Members = true
+	})
+
+	dispatch(t, s, "GUILD_CREATE", guildCreate)
+	waitKey(t, srv, "keti:guild:100")
+
+	if got, want := srv.Members("keti:guild:100:channels"), []string{"101", "102", "103"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Channels = %v, want %v", got, want)
+	}
+	if got, want := srv.Members("keti:guild:100:roles"), []string{"100", "104"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Roles = %v, want %v", got, want)
+	}
+	if got, want := srv.Members("keti:guild:100:members"), []string{"105"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Members = %v, want %v", got, want)
+	}
+	if v, _ := srv.Get("keti:channel:103"); v == "" {
+		t.Error("Thread 103 was not stored")
+	}
+
+	// A deleted guild takes everything indexed under it
+	dispatch(t, s, "GUILD_DELETE", `{"id":"100"}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.Keys()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if keys := srv.Keys(); len(keys) > 0 {
+		t.Errorf("Keys left after GUILD_DELETE: %v", keys)
+	}
+}
+
+// TestSinkPipelining checks a dispatch is written in two round trips, the index reads and the writes,
+// whatever the number of commands.
+func TestSinkPipelining(t *testing.T) {
+	srv := newServer(t, "")
+	s := startSink(t, srv, nil)
+
+	dispatch(t, s, "GUILD_CREATE", guildCreate)
+	waitKey(t, srv, "keti:guild:100")
+
+	if n := srv.Pipelines(); n != 2 {
+		t.Errorf("GUILD_CREATE took %d round trips, want 2", n)
+	}
+	if n := srv.Commands(); n < 10 {
+		t.Errorf("GUILD_CREATE sent %d commands, want at least 10", n)
+	}
+
+	before := srv.Pipelines()
+	dispatch(t, s, "GUILD_ROLE_CREATE", `{"guild_id":"100","role":{"id":"106","name":"new"}}`)
+	waitKey(t, srv, "keti:role:106")
+	if n := srv.Pipelines() - before; n != 1 {
+		t.Errorf("GUILD_ROLE_CREATE took %d round trips, want 1", n)
+	}
+}
+
+func TestSinkAuthSelect(t *testing.T) {
+	srv := newServer(t, "s3cret")
+	srv.Lock()
+	srv.DB = 3
+	srv.Unlock()
+
+	s := startSink(t, srv, func(s *resp.Sink) {
+		s.Password = "s3cret"
+		s.DB = 3
+		s.Prefix = "test:"
+	})
+	dispatch(t, s, "GUILD_ROLE_CREATE", `{"guild_id":"100","role":{"id":"104","name":"mods"}}`)
+	waitKey(t, srv, "test:role:104")
+
+	// Nothing is written to the default database
+	srv.Lock()
+	srv.DB = 0
+	srv.Unlock()
+	if keys := srv.Keys(); len(keys) > 0 {
+		t.Errorf("Keys written to database 0: %v", keys)
+	}
+}
+
+func TestSinkWrongPassword(t *testing.T) {
+	srv := newServer(t, "s3cret")
+
+	s := startSink(t, srv, func(s *resp.Sink) {
+		s.Password = "wrong"
+	})
+	dispatch(t, s, "GUILD_ROLE_CREATE", `{"guild_id":"100","role":{"id":"104","name":"mods"}}`)
+
+	time.Sleep(100 * time.Millisecond)
+	if keys := srv.Keys(); len(keys) > 0 {
+		t.Errorf("Keys written without authenticating: %v", keys)
+	}
+}
+
+func TestSinkReconnect(t *testing.T) {
+	srv := newServer(t, "s3cret")
+
+	s := startSink(t, srv, func(s *resp.Sink) {
+		s.Password = "s3cret"
+	})
+	dispatch(t, s, "GUILD_ROLE_CREATE", `{"guild_id":"100","role":{"id":"104","name":"mods"}}`)
+	waitKey(t, srv, "keti:role:104")
+
+	srv.CloseClients()
+
+	// The dispatch written on the broken connection is lost, the sink reconnects for the next ones
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		dispatch(t, s, "GUILD_ROLE_UPDATE", `{"guild_id":"100","role":{"id":"107","name":"back"}}`)
+		if _, ok := srv.Get("keti:role:107"); ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("The sink did not reconnect, keys: %v", srv.Keys())
+}
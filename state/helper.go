@@ -0,0 +1,46 @@
+package state
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/codechimp-io/keti/config"
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+func init() {
+	// Also the entities of the Redis sink
+	config.RegisterCheck("KETI_STATE_ENTITIES", func(c *config.Config) error {
+		_, err := ParseEntities(c.State.Entities)
+		return err
+	})
+}
+
+// Run creates the state cache with the entities set in config and serves it over nc,
+// it returns nil if the cache is disabled.
+func Run(ctx context.Context, nc *nats.Conn) *Cache {
+	sc := config.Options.State
+	if !sc.Enabled {
+		return nil
+	}
+
+	entities, err := ParseEntities(sc.Entities)
+	if err != nil {
+		log.Fatalf("Invalid KETI_STATE_ENTITIES: %s", err)
+	}
+
+	c := New()
+	c.Entities = entities
+
+	if _, err := c.Serve(nc); err != nil {
+		log.Fatalf("Cannot subscribe to %s requests: %s", SubjectPrefix, err)
+	}
+	go c.updateStats(ctx, 10*time.Second)
+
+	log.Infof("Serving state cache on %s> (%s)", SubjectPrefix, strings.Join(sc.Entities, ", "))
+
+	return c
+}
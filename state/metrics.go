@@ -0,0 +1,49 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	entitiesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keti_state_entities",
+		Help: "Entities in the state cache, by kind",
+	}, []string{"kind"})
+
+	bytesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keti_state_bytes",
+		Help: "Size of the payloads in the state cache, by kind",
+	}, []string{"kind"})
+
+	requestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "keti_state_requests_total",
+		Help: "State requests answered, by kind and result",
+	}, []string{"kind", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(entitiesGauge)
+	prometheus.MustRegister(bytesGauge)
+	prometheus.MustRegister(requestsCounter)
+}
+
+func (c *Cache) updateStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			counts, bytes := c.Stats()
+			for kind, n := range counts {
+				entitiesGauge.WithLabelValues(kind).Set(float64(n))
+				bytesGauge.WithLabelValues(kind).Set(float64(bytes[kind]))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package state
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/codechimp-io/keti/log"
+
+	"github.com/nats-io/go-nats"
+)
+
+// SubjectPrefix is the prefix of the broker subjects the cache answers requests on:
+//
+//	state.guild.<id>               guild with its channels and roles
+//	state.channel.<id>             guild channel or thread
+//	state.role.<id>                role
+//	state.member.<guild_id>.<id>   guild member
+//
+// Replies are the JSON entity. Only the instance caching it replies, so that requests work the same
+// across the instances of a cluster, requests for entities no instance caches time out.
+const SubjectPrefix = "state."
+
+// Serve answers state requests received over nc.
+func (c *Cache) Serve(nc *nats.Conn) (*nats.Subscription, error) {
+	return nc.Subscribe(SubjectPrefix+">", func(msg *nats.Msg) {
+		if msg.Reply == "" {
+			return
+		}
+
+		tokens := strings.Split(strings.TrimPrefix(msg.Subject, SubjectPrefix), ".")
+		data, err := c.lookup(tokens)
+		if err != nil {
+			log.Errorf("Cannot answer state request %s: %s", msg.Subject, err)
+		}
+
+		// Subjects are chosen by the clients, only the known kinds are labelled
+		kind := "unknown"
+		switch tokens[0] {
+		case KindGuild, KindChannel, KindRole, KindMember:
+			kind = tokens[0]
+		}
+
+		if data == nil {
+			// Another instance may have it, a null reply would beat theirs
+			requestsCounter.WithLabelValues(kind, "miss").Inc()
+			return
+		}
+		requestsCounter.WithLabelValues(kind, "hit").Inc()
+
+		if err := nc.Publish(msg.Reply, data); err != nil {
+			log.Errorf("Cannot reply to state request %s: %s", msg.Subject, err)
+		}
+	})
+}
+
+func (c *Cache) lookup(tokens []string) (json.RawMessage, error) {
+	switch {
+	case len(tokens) == 2 && tokens[0] == KindGuild:
+		return c.Guild(tokens[1])
+	case len(tokens) == 2 && tokens[0] == KindChannel:
+		return c.Channel(tokens[1]), nil
+	case len(tokens) == 2 && tokens[0] == KindRole:
+		return c.Role(tokens[1]), nil
+	case len(tokens) == 3 && tokens[0] == KindMember:
+		return c.Member(tokens[1], tokens[2]), nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,574 @@
+// Package state keeps a lean in-process cache of guilds, channels, roles and members,
+// built from the dispatches keti forwards and queried by consumers over the broker.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Kinds of cached entities
+const (
+	KindGuild   = "guild"
+	KindChannel = "channel"
+	KindRole    = "role"
+	KindMember  = "member"
+)
+
+var kinds = []string{KindGuild, KindChannel, KindRole, KindMember}
+
+// StrippedGuildFields are the guild fields cached separately or not at all
+var StrippedGuildFields = []string{
+	"channels", "threads", "roles", "members", "presences", "voice_states",
+	"emojis", "stickers", "stage_instances", "guild_scheduled_events",
+}
+
+// Entities selects the kinds of entities to cache
+type Entities struct {
+	Guilds   bool
+	Channels bool
+	Roles    bool
+	Members  bool
+}
+
+// ParseEntities parses entity kinds given by plural name, e.g. guilds,channels,roles.
+func ParseEntities(names []string) (Entities, error) {
+	var e Entities
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "guilds":
+			e.Guilds = true
+		case "channels":
+			e.Channels = true
+		case "roles":
+			e.Roles = true
+		case "members":
+			e.Members = true
+		case "":
+		default:
+			return e, fmt.Errorf("Unknown state entity %q", name)
+		}
+	}
+
+	return e, nil
+}
+
+type guild struct {
+	data        json.RawMessage
+	unavailable bool
+	channels    map[string]struct{}
+	roles       map[string]struct{}
+	members     map[string]json.RawMessage
+}
+
+type stats struct {
+	count int
+	bytes int
+}
+
+// Cache is the state built from gateway dispatches. Entities are stored as their raw
+// JSON payload, guilds without the lists cached separately or not at all.
+type Cache struct {
+	sync.RWMutex
+
+	// Entities to cache, guilds are always tracked to index the other entities
+	Entities
+
+	guilds   map[string]*guild
+	channels map[string]json.RawMessage
+	roles    map[string]json.RawMessage
+	stats    map[string]*stats
+}
+
+// New creates an empty cache of guilds, channels and roles.
+func New() *Cache {
+	c := &Cache{
+		Entities: Entities{Guilds: true, Channels: true, Roles: true},
+		guilds:   make(map[string]*guild),
+		channels: make(map[string]json.RawMessage),
+		roles:    make(map[string]json.RawMessage),
+		stats:    make(map[string]*stats, len(kinds)),
+	}
+	for _, k := range kinds {
+		c.stats[k] = &stats{}
+	}
+
+	return c
+}
+
+// HandleDispatch updates the cache from a dispatch received by shard, it implements discord.StateSink.
+func (c *Cache) HandleDispatch(shard int, e *discordgo.Event) error {
+	return c.Apply(e.Type, e.RawData)
+}
+
+// Apply updates the cache from a dispatch payload, unrelated dispatches are ignored.
+func (c *Cache) Apply(typ string, data json.RawMessage) error {
+	switch typ {
+	case "READY":
+		var r struct {
+			Guilds []struct {
+				ID string `json:"id"`
+			} `json:"guilds"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+
+		c.Lock()
+		for _, g := range r.Guilds {
+			if _, ok := c.guilds[g.ID]; !ok {
+				c.guilds[g.ID] = c.newGuild()
+				c.stats[KindGuild].count++
+			}
+			c.guilds[g.ID].unavailable = true
+		}
+		c.Unlock()
+
+	case "GUILD_CREATE":
+		return c.guildCreate(data)
+
+	case "GUILD_UPDATE":
+		if !c.Guilds {
+			return nil
+		}
+
+		id, stripped, err := StripGuild(data)
+		if err != nil {
+			return err
+		}
+
+		c.Lock()
+		g := c.guild(id)
+		g.data = c.put(KindGuild, g.data, stripped)
+		c.Unlock()
+
+	case "GUILD_DELETE":
+		var g struct {
+			ID          string `json:"id"`
+			Unavailable bool   `json:"unavailable"`
+		}
+		if err := json.Unmarshal(data, &g); err != nil {
+			return err
+		}
+
+		c.Lock()
+		if g.Unavailable {
+			// Outage, the guild comes back with a GUILD_CREATE
+			c.guild(g.ID).unavailable = true
+		} else {
+			c.deleteGuild(g.ID)
+		}
+		c.Unlock()
+
+	case "CHANNEL_CREATE", "CHANNEL_UPDATE", "THREAD_CREATE", "THREAD_UPDATE":
+		if !c.Channels {
+			return nil
+		}
+
+		var ch struct {
+			ID      string `json:"id"`
+			GuildID string `json:"guild_id"`
+		}
+		if err := json.Unmarshal(data, &ch); err != nil {
+			return err
+		}
+		if ch.GuildID == "" {
+			// Private channels are not cached
+			return nil
+		}
+
+		c.Lock()
+		c.guild(ch.GuildID).channels[ch.ID] = struct{}{}
+		c.channels[ch.ID] = c.put(KindChannel, c.channels[ch.ID], data)
+		c.Unlock()
+
+	case "CHANNEL_DELETE", "THREAD_DELETE":
+		var ch struct {
+			ID      string `json:"id"`
+			GuildID string `json:"guild_id"`
+		}
+		if err := json.Unmarshal(data, &ch); err != nil {
+			return err
+		}
+
+		c.Lock()
+		if g, ok := c.guilds[ch.GuildID]; ok {
+			delete(g.channels, ch.ID)
+		}
+		c.deleteChannel(ch.ID)
+		c.Unlock()
+
+	case "GUILD_ROLE_CREATE", "GUILD_ROLE_UPDATE":
+		if !c.Roles {
+			return nil
+		}
+
+		var r struct {
+			GuildID string          `json:"guild_id"`
+			Role    json.RawMessage `json:"role"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		id, err := objectID(r.Role)
+		if err != nil {
+			return err
+		}
+
+		c.Lock()
+		c.guild(r.GuildID).roles[id] = struct{}{}
+		c.roles[id] = c.put(KindRole, c.roles[id], r.Role)
+		c.Unlock()
+
+	case "GUILD_ROLE_DELETE":
+		var r struct {
+			GuildID string `json:"guild_id"`
+			RoleID  string `json:"role_id"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+
+		c.Lock()
+		if g, ok := c.guilds[r.GuildID]; ok {
+			delete(g.roles, r.RoleID)
+		}
+		c.deleteRole(r.RoleID)
+		c.Unlock()
+
+	case "GUILD_MEMBER_ADD", "GUILD_MEMBER_UPDATE":
+		if !c.Members {
+			return nil
+		}
+
+		var mb struct {
+			GuildID string `json:"guild_id"`
+			User    struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		}
+		if err := json.Unmarshal(data, &mb); err != nil {
+			return err
+		}
+
+		c.Lock()
+		g := c.guild(mb.GuildID)
+		g.members[mb.User.ID] = c.put(KindMember, g.members[mb.User.ID], data)
+		c.Unlock()
+
+	case "GUILD_MEMBER_REMOVE":
+		var mb struct {
+			GuildID string `json:"guild_id"`
+			User    struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		}
+		if err := json.Unmarshal(data, &mb); err != nil {
+			return err
+		}
+
+		c.Lock()
+		if g, ok := c.guilds[mb.GuildID]; ok {
+			c.deleteMember(g, mb.User.ID)
+		}
+		c.Unlock()
+
+	case "GUILD_MEMBERS_CHUNK":
+		if !c.Members {
+			return nil
+		}
+
+		var chunk struct {
+			GuildID string            `json:"guild_id"`
+			Members []json.RawMessage `json:"members"`
+		}
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			return err
+		}
+
+		c.Lock()
+		defer c.Unlock()
+
+		return c.putMembers(c.guild(chunk.GuildID), chunk.Members)
+	}
+
+	return nil
+}
+
+func (c *Cache) guildCreate(data json.RawMessage) error {
+	var g struct {
+		ID       string            `json:"id"`
+		Channels []json.RawMessage `json:"channels"`
+		Threads  []json.RawMessage `json:"threads"`
+		Roles    []json.RawMessage `json:"roles"`
+		Members  []json.RawMessage `json:"members"`
+	}
+	if err := json.Unmarshal(data, &g); err != nil {
+		return err
+	}
+
+	_, stripped, err := StripGuild(data)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// A guild coming back after an outage replaces everything we knew
+	c.deleteGuild(g.ID)
+	cg := c.guild(g.ID)
+	if c.Guilds {
+		cg.data = c.put(KindGuild, nil, stripped)
+	}
+
+	if c.Channels {
+		for _, list := range [][]json.RawMessage{g.Channels, g.Threads} {
+			for _, ch := range list {
+				id, err := objectID(ch)
+				if err != nil {
+					return err
+				}
+				cg.channels[id] = struct{}{}
+				c.channels[id] = c.put(KindChannel, c.channels[id], ch)
+			}
+		}
+	}
+
+	if c.Roles {
+		for _, r := range g.Roles {
+			id, err := objectID(r)
+			if err != nil {
+				return err
+			}
+			cg.roles[id] = struct{}{}
+			c.roles[id] = c.put(KindRole, c.roles[id], r)
+		}
+	}
+
+	if c.Members {
+		return c.putMembers(cg, g.Members)
+	}
+
+	return nil
+}
+
+// Guild returns the cached guild with its channels and roles, or nil if it is unknown.
+func (c *Cache) Guild(id string) (json.RawMessage, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	g, ok := c.guilds[id]
+	if !ok {
+		return nil, nil
+	}
+
+	fields := map[string]interface{}{
+		"id":          id,
+		"unavailable": g.unavailable,
+	}
+	if g.data != nil {
+		var data map[string]json.RawMessage
+		if err := json.Unmarshal(g.data, &data); err != nil {
+			return nil, err
+		}
+		for k, v := range data {
+			fields[k] = v
+		}
+	}
+	if c.Channels {
+		fields["channels"] = c.list(g.channels, c.channels)
+	}
+	if c.Roles {
+		fields["roles"] = c.list(g.roles, c.roles)
+	}
+
+	return json.Marshal(fields)
+}
+
+// Channel returns the cached guild channel or thread, or nil if it is unknown.
+func (c *Cache) Channel(id string) json.RawMessage {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.channels[id]
+}
+
+// Role returns the cached role, or nil if it is unknown.
+func (c *Cache) Role(id string) json.RawMessage {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.roles[id]
+}
+
+// Member returns the cached guild member, or nil if it is unknown.
+func (c *Cache) Member(guildID, userID string) json.RawMessage {
+	c.RLock()
+	defer c.RUnlock()
+
+	if g, ok := c.guilds[guildID]; ok {
+		return g.members[userID]
+	}
+
+	return nil
+}
+
+// Stats returns the number of cached entities and their size in bytes, by kind.
+func (c *Cache) Stats() (counts, bytes map[string]int) {
+	c.RLock()
+	defer c.RUnlock()
+
+	counts = make(map[string]int, len(kinds))
+	bytes = make(map[string]int, len(kinds))
+	for k, s := range c.stats {
+		counts[k] = s.count
+		bytes[k] = s.bytes
+	}
+
+	return
+}
+
+func (c *Cache) newGuild() *guild {
+	return &guild{
+		channels: make(map[string]struct{}),
+		roles:    make(map[string]struct{}),
+		members:  make(map[string]json.RawMessage),
+	}
+}
+
+// guild returns the guild, creating it if needed, it must be called with the lock held.
+func (c *Cache) guild(id string) *guild {
+	g, ok := c.guilds[id]
+	if !ok {
+		g = c.newGuild()
+		c.guilds[id] = g
+		c.stats[KindGuild].count++
+	}
+	g.unavailable = false
+
+	return g
+}
+
+// put returns a copy of data to store in place of old, accounting for its size.
+// It must be called with the lock held.
+func (c *Cache) put(kind string, old, data json.RawMessage) json.RawMessage {
+	s := c.stats[kind]
+	if old == nil {
+		if kind != KindGuild {
+			s.count++
+		}
+	} else {
+		s.bytes -= len(old)
+	}
+	s.bytes += len(data)
+
+	// The payload buffer is not ours to keep
+	return append(json.RawMessage(nil), data...)
+}
+
+func (c *Cache) putMembers(g *guild, members []json.RawMessage) error {
+	for _, mb := range members {
+		var m struct {
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		}
+		if err := json.Unmarshal(mb, &m); err != nil {
+			return err
+		}
+		g.members[m.User.ID] = c.put(KindMember, g.members[m.User.ID], mb)
+	}
+
+	return nil
+}
+
+func (c *Cache) deleteGuild(id string) {
+	g, ok := c.guilds[id]
+	if !ok {
+		return
+	}
+
+	for ch := range g.channels {
+		c.deleteChannel(ch)
+	}
+	for r := range g.roles {
+		c.deleteRole(r)
+	}
+	for u := range g.members {
+		c.deleteMember(g, u)
+	}
+
+	c.stats[KindGuild].count--
+	c.stats[KindGuild].bytes -= len(g.data)
+	delete(c.guilds, id)
+}
+
+func (c *Cache) deleteChannel(id string) {
+	if data, ok := c.channels[id]; ok {
+		c.stats[KindChannel].count--
+		c.stats[KindChannel].bytes -= len(data)
+		delete(c.channels, id)
+	}
+}
+
+func (c *Cache) deleteRole(id string) {
+	if data, ok := c.roles[id]; ok {
+		c.stats[KindRole].count--
+		c.stats[KindRole].bytes -= len(data)
+		delete(c.roles, id)
+	}
+}
+
+func (c *Cache) deleteMember(g *guild, id string) {
+	if data, ok := g.members[id]; ok {
+		c.stats[KindMember].count--
+		c.stats[KindMember].bytes -= len(data)
+		delete(g.members, id)
+	}
+}
+
+// list returns the entities of ids, it must be called with the lock held.
+func (c *Cache) list(ids map[string]struct{}, entities map[string]json.RawMessage) []json.RawMessage {
+	list := make([]json.RawMessage, 0, len(ids))
+	for id := range ids {
+		if data, ok := entities[id]; ok {
+			list = append(list, data)
+		}
+	}
+
+	return list
+}
+
+// StripGuild returns the guild ID and its payload without the lists cached separately.
+func StripGuild(data json.RawMessage) (string, json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", nil, err
+	}
+
+	var id string
+	if err := json.Unmarshal(fields["id"], &id); err != nil {
+		return "", nil, err
+	}
+
+	for _, f := range StrippedGuildFields {
+		delete(fields, f)
+	}
+	stripped, err := json.Marshal(fields)
+
+	return id, stripped, err
+}
+
+func objectID(data json.RawMessage) (string, error) {
+	var o struct {
+		ID string `json:"id"`
+	}
+	err := json.Unmarshal(data, &o)
+
+	return o.ID, err
+}
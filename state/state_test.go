@@ -0,0 +1,183 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const (
+	testGuild   = `{"id":"1","name":"keti","channels":[{"id":"10","name":"general"}],"threads":[{"id":"11","name":"thread"}],"roles":[{"id":"20","name":"admin"}],"members":[{"user":{"id":"30"},"nick":"bot"}],"presences":[{"status":"online"}]}`
+	testChannel = `{"id":"12","guild_id":"1","name":"new"}`
+	testMember  = `{"guild_id":"1","user":{"id":"31"},"nick":"user"}`
+)
+
+func apply(t *testing.T, c *Cache, typ, data string) {
+	t.Helper()
+
+	if err := c.Apply(typ, json.RawMessage(data)); err != nil {
+		t.Fatalf("%s: %v", typ, err)
+	}
+}
+
+func checkStats(t *testing.T, c *Cache, counts, bytes map[string]int) {
+	t.Helper()
+
+	gotCounts, gotBytes := c.Stats()
+	if !reflect.DeepEqual(gotCounts, counts) {
+		t.Errorf("Counts %v, want %v", gotCounts, counts)
+	}
+	if !reflect.DeepEqual(gotBytes, bytes) {
+		t.Errorf("Bytes %v, want %v", gotBytes, bytes)
+	}
+}
+
+func TestStripGuild(t *testing.T) {
+	id, stripped, err := StripGuild(json.RawMessage(testGuild))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1" || string(stripped) != `{"id":"1","name":"keti"}` {
+		t.Errorf("Stripped guild %s %s", id, stripped)
+	}
+}
+
+func TestCacheAccounting(t *testing.T) {
+	c := New()
+	c.Members = true
+
+	// Guilds of READY are tracked as unavailable until their GUILD_CREATE
+	apply(t, c, "READY", `{"guilds":[{"id":"1","unavailable":true},{"id":"2","unavailable":true}]}`)
+	checkStats(t, c,
+		map[string]int{KindGuild: 2, KindChannel: 0, KindRole: 0, KindMember: 0},
+		map[string]int{KindGuild: 0, KindChannel: 0, KindRole: 0, KindMember: 0})
+
+	apply(t, c, "GUILD_CREATE", testGuild)
+	guild := len(`{"id":"1","name":"keti"}`)
+	channels := len(`{"id":"10","name":"general"}`) + len(`{"id":"11","name":"thread"}`)
+	role := len(`{"id":"20","name":"admin"}`)
+	member := len(`{"user":{"id":"30"},"nick":"bot"}`)
+	checkStats(t, c,
+		map[string]int{KindGuild: 2, KindChannel: 2, KindRole: 1, KindMember: 1},
+		map[string]int{KindGuild: guild, KindChannel: channels, KindRole: role, KindMember: member})
+
+	// Updates replace the size of the entity, creations add to the count
+	apply(t, c, "GUILD_UPDATE", `{"id":"1","name":"keti2","roles":[]}`)
+	guild = len(`{"id":"1","name":"keti2"}`)
+	apply(t, c, "GUILD_ROLE_UPDATE", `{"guild_id":"1","role":{"id":"20","name":"owner"}}`)
+	role = len(`{"id":"20","name":"owner"}`)
+	apply(t, c, "CHANNEL_CREATE", testChannel)
+	channels += len(testChannel)
+	apply(t, c, "GUILD_MEMBER_ADD", testMember)
+	member += len(testMember)
+	checkStats(t, c,
+		map[string]int{KindGuild: 2, KindChannel: 3, KindRole: 1, KindMember: 2},
+		map[string]int{KindGuild: guild, KindChannel: channels, KindRole: role, KindMember: member})
+
+	// Private channels are not cached
+	apply(t, c, "CHANNEL_CREATE", `{"id":"99","type":1}`)
+	if c.Channel("99") != nil {
+		t.Error("Private channel cached")
+	}
+
+	apply(t, c, "CHANNEL_DELETE", testChannel)
+	channels -= len(testChannel)
+	apply(t, c, "GUILD_MEMBER_REMOVE", testMember)
+	member -= len(testMember)
+	checkStats(t, c,
+		map[string]int{KindGuild: 2, KindChannel: 2, KindRole: 1, KindMember: 1},
+		map[string]int{KindGuild: guild, KindChannel: channels, KindRole: role, KindMember: member})
+
+	// An outage keeps the guild, leaving it drops everything cached for it
+	apply(t, c, "GUILD_DELETE", `{"id":"1","unavailable":true}`)
+	if c.Channel("10") == nil {
+		t.Error("Channel dropped by an outage")
+	}
+	apply(t, c, "GUILD_DELETE", `{"id":"1"}`)
+	checkStats(t, c,
+		map[string]int{KindGuild: 1, KindChannel: 0, KindRole: 0, KindMember: 0},
+		map[string]int{KindGuild: 0, KindChannel: 0, KindRole: 0, KindMember: 0})
+	if g, _ := c.Guild("1"); g != nil {
+		t.Errorf("Guild %s cached after leaving it", g)
+	}
+}
+
+func TestCacheGuildCreateReplaces(t *testing.T) {
+	c := New()
+	c.Members = true
+
+	apply(t, c, "GUILD_CREATE", testGuild)
+	apply(t, c, "GUILD_MEMBER_ADD", testMember)
+
+	// A guild back from an outage may have lost channels, roles and members
+	apply(t, c, "GUILD_CREATE", `{"id":"1","name":"keti","channels":[{"id":"10","name":"renamed"}],"roles":[],"members":[]}`)
+	checkStats(t, c,
+		map[string]int{KindGuild: 1, KindChannel: 1, KindRole: 0, KindMember: 0},
+		map[string]int{
+			KindGuild:   len(`{"id":"1","name":"keti"}`),
+			KindChannel: len(`{"id":"10","name":"renamed"}`),
+			KindRole:    0,
+			KindMember:  0,
+		})
+
+	if c.Channel("11") != nil || c.Role("20") != nil || c.Member("1", "31") != nil {
+		t.Error("Entities of the previous GUILD_CREATE still cached")
+	}
+	if string(c.Channel("10")) != `{"id":"10","name":"renamed"}` {
+		t.Errorf("Channel %s, want the new one", c.Channel("10"))
+	}
+}
+
+func TestCacheEntities(t *testing.T) {
+	tests := []struct {
+		name     string
+		entities Entities
+		counts   map[string]int
+	}{
+		{"none", Entities{}, map[string]int{KindGuild: 1, KindChannel: 0, KindRole: 0, KindMember: 0}},
+		{"guilds", Entities{Guilds: true}, map[string]int{KindGuild: 1, KindChannel: 0, KindRole: 0, KindMember: 0}},
+		{"channels", Entities{Channels: true}, map[string]int{KindGuild: 1, KindChannel: 3, KindRole: 0, KindMember: 0}},
+		{"roles", Entities{Roles: true}, map[string]int{KindGuild: 1, KindChannel: 0, KindRole: 1, KindMember: 0}},
+		{"members", Entities{Members: true}, map[string]int{KindGuild: 1, KindChannel: 0, KindRole: 0, KindMember: 3}},
+	}
+
+	for _, tt := range tests {
+		c := New()
+		c.Entities = tt.entities
+
+		apply(t, c, "GUILD_CREATE", testGuild)
+		apply(t, c, "GUILD_UPDATE", `{"id":"1","name":"keti2"}`)
+		apply(t, c, "CHANNEL_CREATE", testChannel)
+		apply(t, c, "GUILD_ROLE_CREATE", `{"guild_id":"1","role":{"id":"21"}}`)
+		apply(t, c, "GUILD_ROLE_DELETE", `{"guild_id":"1","role_id":"21"}`)
+		apply(t, c, "GUILD_MEMBER_ADD", testMember)
+		apply(t, c, "GUILD_MEMBERS_CHUNK", `{"guild_id":"1","members":[{"user":{"id":"32"}}]}`)
+
+		counts, bytes := c.Stats()
+		if !reflect.DeepEqual(counts, tt.counts) {
+			t.Errorf("%s: counts %v, want %v", tt.name, counts, tt.counts)
+		}
+		if tt.entities.Guilds != (bytes[KindGuild] > 0) {
+			t.Errorf("%s: %d bytes of guilds cached", tt.name, bytes[KindGuild])
+		}
+		for _, k := range []string{KindChannel, KindRole, KindMember} {
+			if (counts[k] == 0) != (bytes[k] == 0) {
+				t.Errorf("%s: %d %s cached in %d bytes", tt.name, counts[k], k, bytes[k])
+			}
+		}
+	}
+}
+
+func TestParseEntities(t *testing.T) {
+	e, err := ParseEntities([]string{"guilds", " Members", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e != (Entities{Guilds: true, Members: true}) {
+		t.Errorf("Parsed %+v", e)
+	}
+
+	if _, err := ParseEntities([]string{"emojis"}); err == nil {
+		t.Error("Unknown entity parsed")
+	}
+}